@@ -0,0 +1,265 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"WHOKNOWS_VARIATIONS/util"
+	"github.com/gin-gonic/gin"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `form:"current_password" json:"current_password"`
+	Code            string `form:"code" json:"code"`
+	Password        string `form:"password" json:"password"`
+	Password2       string `form:"password2" json:"password2"`
+}
+
+type ChangeEmailRequest struct {
+	CurrentPassword string `form:"current_password" json:"current_password"`
+	Code            string `form:"code" json:"code"`
+	Email           string `form:"email" json:"email"`
+}
+
+type DeleteAccountRequest struct {
+	CurrentPassword string `form:"current_password" json:"current_password"`
+	Code            string `form:"code" json:"code"`
+}
+
+// recentLoginWindow is how long after a single sign-on login an account
+// without a password may make sensitive changes without a 2FA code.
+const recentLoginWindow = 5 * time.Minute
+
+// confirmCurrentPassword re-checks the password before sensitive account
+// changes. Wrong guesses count towards the login lockout, so a hijacked
+// session cannot be used to brute-force the password. Accounts without a
+// password (single sign-on only) confirm with a 2FA code or by having just
+// logged in.
+func confirmCurrentPassword(c *gin.Context, user AuthUser, password, code string) bool {
+	now := time.Now()
+	accountKey := accountThrottleKey(user.Username)
+	if wait := accountLoginThrottle.LockedFor(accountKey, now); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"current_password", 0}, Msg: "too many failed attempts, try again later", Type: "auth_error"}}})
+		return false
+	}
+
+	_, _, _, hashed, err := GetUserByIDQuery(db, strconv.Itoa(user.ID))
+	if err != nil {
+		log.Printf("[ACCOUNT] Failed to load user_id=%d: %v", user.ID, err)
+		sendValidationError(c, "current_password", "could not check your password")
+		return false
+	}
+	if strings.HasPrefix(hashed, "!") {
+		return confirmRecentLogin(c, user, code, accountKey, now)
+	}
+	if ok, _, _ := verifyPassword(hashed, password); !ok {
+		log.Printf("[ACCOUNT] Wrong current password for user_id=%d from IP=%s", user.ID, c.ClientIP())
+		recordLoginFailure(c.ClientIP(), accountKey, now)
+		recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: user.ID, ActorName: user.Username, Details: map[string]any{"reason": "wrong_current_password"}})
+		sendValidationError(c, "current_password", "your current password is incorrect")
+		return false
+	}
+	return true
+}
+
+// confirmRecentLogin stands in for the password of single sign-on accounts:
+// a session younger than recentLoginWindow or, with 2FA enrolled, a code.
+func confirmRecentLogin(c *gin.Context, user AuthUser, code, accountKey string, now time.Time) bool {
+	if started := currentSessionStarted(c); !started.IsZero() && now.Sub(started) < recentLoginWindow {
+		return true
+	}
+	if code != "" {
+		enabled, totp, err := userHasTwoFactor(user.ID)
+		if err != nil {
+			log.Printf("[ACCOUNT] Failed to load 2FA for user_id=%d: %v", user.ID, err)
+			sendValidationError(c, "code", "could not check your code")
+			return false
+		}
+		if enabled {
+			ok, err := verifySecondFactor(totp, code)
+			if err != nil {
+				log.Printf("[ACCOUNT] Failed to verify 2FA code for user_id=%d: %v", user.ID, err)
+			}
+			if ok {
+				return true
+			}
+			log.Printf("[ACCOUNT] Wrong 2FA code for user_id=%d from IP=%s", user.ID, c.ClientIP())
+			recordLoginFailure(c.ClientIP(), accountKey, now)
+			recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: user.ID, ActorName: user.Username, Details: map[string]any{"reason": "wrong_2fa_code"}})
+			sendValidationError(c, "code", "invalid authentication code")
+			return false
+		}
+	}
+	sendValidationError(c, "current_password", "log in again with single sign-on to confirm this change")
+	return false
+}
+
+// apiChangePassword godoc
+// @Summary Change the password of the logged-in user
+// @Description Signs out all other sessions.
+// @Tags Account
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} HTTPValidationError
+// @Router /api/account/password [post]
+func apiChangePassword(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form ChangePasswordRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	if form.Password == "" {
+		sendValidationError(c, "password", "you have to enter a password")
+		return
+	}
+	if form.Password != form.Password2 {
+		sendValidationError(c, "password2", "the two passwords do not match")
+		return
+	}
+	if rejectWeakPassword(c, form.Password, user.Username, user.Email) {
+		return
+	}
+	if !confirmCurrentPassword(c, user, form.CurrentPassword, form.Code) {
+		return
+	}
+
+	hash, err := hashPassword(form.Password)
+	if err == nil {
+		err = UpdateUserPasswordQuery(db, user.ID, hash)
+	}
+	if err != nil {
+		log.Printf("[ACCOUNT] Failed to change password for user_id=%d: %v", user.ID, err)
+		sendValidationError(c, "password", "could not update password")
+		return
+	}
+
+	// Sign out everywhere else; this browser gets a fresh session.
+	if _, err := RevokeUserSessionsQuery(db, user.ID); err != nil {
+		log.Printf("[ACCOUNT] Failed to revoke sessions for user_id=%d: %v", user.ID, err)
+	}
+	if _, err := RevokeUserRefreshTokensQuery(db, user.ID); err != nil {
+		log.Printf("[ACCOUNT] Failed to revoke refresh tokens for user_id=%d: %v", user.ID, err)
+	}
+	if err := startSession(c, user.ID); err != nil {
+		log.Printf("[ACCOUNT] Failed to issue session for user_id=%d: %v", user.ID, err)
+		util.RemoveAuthCookie(c)
+	}
+
+	log.Printf("[ACCOUNT] Password changed for user_id=%d", user.ID)
+	auditSelf(c, auditPasswordChanged, nil)
+	code := http.StatusOK
+	msg := "password changed"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiChangeEmail godoc
+// @Summary Change the email address of the logged-in user
+// @Description The new address has to be verified again; a notice is sent to the old one.
+// @Tags Account
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body ChangeEmailRequest true "Current password and new email"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} HTTPValidationError
+// @Router /api/account/email [post]
+func apiChangeEmail(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form ChangeEmailRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	email := normalizeIdentifier(form.Email)
+	if email == "" || !emailPattern.MatchString(email) {
+		sendValidationError(c, "email", "you have to enter a valid email address")
+		return
+	}
+	if identifierKey(email) == identifierKey(user.Email) {
+		sendValidationError(c, "email", "that is already your email address")
+		return
+	}
+	if !confirmCurrentPassword(c, user, form.CurrentPassword, form.Code) {
+		return
+	}
+
+	if err := UpdateUserEmailQuery(db, user.ID, email); err != nil {
+		log.Printf("[ACCOUNT] Failed to change email for user_id=%d: %v", user.ID, err)
+		c.JSON(http.StatusUnprocessableEntity, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"email", 0}, Msg: "email taken", Type: "db_error"}}})
+		return
+	}
+	if err := sendVerificationEmail(user.ID, user.Username, email); err != nil {
+		log.Printf("[ACCOUNT] Failed to send verification email to user_id=%d: %v", user.ID, err)
+	}
+	sendMailAsync(Mail{
+		To:      user.Email,
+		Subject: "Your ¿Who Knows? email address was changed",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"The email address of your account was changed to " + email + ".\n\n" +
+			"If you did not do this, reset your password and contact us.\n",
+	})
+
+	log.Printf("[ACCOUNT] Email changed for user_id=%d", user.ID)
+	auditSelf(c, auditEmailChanged, map[string]any{"old_email": user.Email, "new_email": email})
+	code := http.StatusOK
+	msg := "email changed, check your inbox to verify the new address"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiDeleteAccount godoc
+// @Summary Permanently delete the logged-in user's account
+// @Description Removes the user with all sessions, tokens, API keys and linked logins. Security events are kept without name, IP addresses, browser or details.
+// @Tags Account
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body DeleteAccountRequest true "Current password; single sign-on accounts send a 2FA code or log in again first"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} HTTPValidationError
+// @Router /api/account [delete]
+func apiDeleteAccount(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form DeleteAccountRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	if !confirmCurrentPassword(c, user, form.CurrentPassword, form.Code) {
+		return
+	}
+
+	if err := DeleteUserQuery(db, user.ID); err != nil {
+		log.Printf("[ACCOUNT] Failed to delete user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not delete account"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	util.RemoveAuthCookie(c)
+	accountLoginThrottle.Reset(accountThrottleKey(user.Username))
+
+	log.Printf("[ACCOUNT] Deleted account user_id=%d", user.ID)
+	auditSelf(c, auditAccountDeleted, nil)
+	// The events stay for the record, but no longer say who or from where.
+	if _, err := PseudonymizeAuditEventsQuery(db, user.ID, user.Username); err != nil {
+		log.Printf("[ACCOUNT] Failed to pseudonymize audit events of user_id=%d: %v", user.ID, err)
+	}
+	code := http.StatusOK
+	msg := "account deleted"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
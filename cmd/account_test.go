@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loginWithPassword is loginAs for a user whose stored hash matches password.
+func loginWithPassword(t *testing.T, userID int, username, password string) *http.Cookie {
+	t.Helper()
+	cookie := loginAs(t, userID, username)
+	hash, _ := hashPassword(password)
+	mockGetUserByIDQuery = func(_ *sql.DB, id string) (int, string, string, string, error) {
+		return userID, username, username + "@example.com", hash, nil
+	}
+	return cookie
+}
+
+func TestChangePassword(t *testing.T) {
+	router := setupRouter()
+	loginAs(t, 81, "changer") // another device
+	cookie := loginWithPassword(t, 81, "changer", "oldpw")
+	var stored string
+	mockUpdateUserPassword = func(_ *sql.DB, _ int, h string) error { stored = h; return nil }
+	defer func() { mockUpdateUserPassword = nil }()
+
+	w := postJSON(router, "/api/account/password", `{"current_password":"wrong","password":"Vivid-Lantern-42","password2":"Vivid-Lantern-42"}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Empty(t, stored)
+
+	w = postJSON(router, "/api/account/password", `{"current_password":"oldpw","password":"Vivid-Lantern-42","password2":"Vivid-Lantern-42"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	ok, _, _ := verifyPassword(stored, "Vivid-Lantern-42")
+	assert.True(t, ok)
+
+	// Only the session that changed the password survives.
+	sessions, _ := ListSessionsQuery(db, 81)
+	assert.Len(t, sessions, 1)
+	assert.NotNil(t, authCookie(w))
+}
+
+func TestChangeEmailRequiresReverification(t *testing.T) {
+	inbox := &MemoryMailer{}
+	mailer = inbox
+	router := setupRouter()
+	cookie := loginWithPassword(t, 82, "mover", "pw")
+	var changedTo string
+	mockUpdateUserEmail = func(_ *sql.DB, _ int, e string) error { changedTo = e; return nil }
+	defer func() { mockUpdateUserEmail = nil }()
+
+	w := postJSON(router, "/api/account/email", `{"current_password":"pw","email":"not-an-email"}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = postJSON(router, "/api/account/email", `{"current_password":"pw","email":"new@example.com"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "new@example.com", changedTo)
+
+	verification := waitForMail(t, inbox, "new@example.com")
+	assert.NotEmpty(t, tokenFromMail(t, verification))
+	notice := waitForMail(t, inbox, "mover@example.com")
+	assert.Contains(t, notice.Body, "new@example.com")
+}
+
+func TestDeleteAccount(t *testing.T) {
+	router := setupRouter()
+	cookie := loginWithPassword(t, 83, "leaver", "pw")
+	w := postJSON(router, "/api/keys", `{"name":"cron"}`, cookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httpDelete(router, "/api/account", `{"current_password":"nope"}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httpDelete(router, "/api/account", `{"current_password":"pw"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	sessions, _ := ListSessionsQuery(db, 83)
+	assert.Empty(t, sessions)
+	keys, _ := ListAPIKeysQuery(db, 83)
+	assert.Empty(t, keys)
+
+	w = httpDelete(router, "/api/account", `{"current_password":"pw"}`, cookie)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The history stays, but no longer says who or from where.
+	events, _ := ListUserAuditEventsQuery(db, 83)
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, auditAccountDeleted, events[0].Event)
+	}
+	for _, e := range events {
+		assert.Empty(t, e.ActorName)
+		assert.Empty(t, e.IP)
+		assert.Empty(t, e.UserAgent)
+		assert.Nil(t, e.Details)
+	}
+}
+
+func TestPasswordlessAccountNeedsRecentLoginOrCode(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 161, "ssoonly")
+	_, recovery := enrollTwoFactor(t, router, cookie)
+	mockGetUserByIDQuery = func(_ *sql.DB, id string) (int, string, string, string, error) {
+		return 161, "ssoonly", "ssoonly@example.com", unusablePassword, nil
+	}
+
+	// An hour-old session alone is not enough.
+	fakeSessions.mu.Lock()
+	for id, s := range fakeSessions.m {
+		if s.UserID == 161 {
+			s.CreatedAt = time.Now().Add(-time.Hour)
+			fakeSessions.m[id] = s
+		}
+	}
+	fakeSessions.mu.Unlock()
+	w := httpDelete(router, "/api/account", `{}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = httpDelete(router, "/api/account", `{"code":"aaaa-bbbb-cccc-dddd"}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = httpDelete(router, "/api/account", `{"code":"`+recovery[0]+`"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Right after a single sign-on login no code is needed.
+	cookie = loginAs(t, 162, "ssofresh")
+	mockGetUserByIDQuery = func(_ *sql.DB, id string) (int, string, string, string, error) {
+		return 162, "ssofresh", "ssofresh@example.com", unusablePassword, nil
+	}
+	w = httpDelete(router, "/api/account", `{}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SetRoleRequest struct {
+	Role string `form:"role" json:"role"`
+}
+
+type UnlockRequest struct {
+	Username string `form:"username" json:"username"`
+	IP       string `form:"ip" json:"ip"`
+}
+
+// apiAdminUnlock godoc
+// @Summary Clear login lockouts for an account and/or client IP
+// @Tags Admin
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body UnlockRequest true "Username and/or IP to unlock"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/admin/unlock [post]
+func apiAdminUnlock(c *gin.Context) {
+	var form UnlockRequest
+	if err := c.ShouldBind(&form); err != nil || (form.Username == "" && form.IP == "") {
+		sendValidationError(c, "username", "you have to enter a username or an IP")
+		return
+	}
+
+	admin, _ := currentUser(c)
+	cleared := false
+	if form.Username != "" {
+		cleared = accountLoginThrottle.Reset(accountThrottleKey(form.Username)) || cleared
+	}
+	if form.IP != "" {
+		cleared = ipLoginThrottle.Reset(form.IP) || cleared
+	}
+	log.Printf("[ADMIN] %s unlocked username=%q ip=%q (had lockout: %t)", admin.Username, form.Username, form.IP, cleared)
+	recordAudit(c, AuditEvent{Event: auditAdminUnlock, ActorID: admin.ID, ActorName: admin.Username, Details: map[string]any{"username": form.Username, "ip": form.IP, "cleared": cleared}})
+
+	code := http.StatusOK
+	msg := "no lockout found"
+	if cleared {
+		msg = "lockout cleared"
+	}
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiAdminSetRole godoc
+// @Summary Change the role of a user
+// @Tags Admin
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param id path int true "User id"
+// @Param request body SetRoleRequest true "New role (user/admin)"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Failure 404 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/admin/users/{id}/role [put]
+func apiAdminSetRole(c *gin.Context) {
+	var form SetRoleRequest
+	if err := c.ShouldBind(&form); err != nil || !validRole(form.Role) {
+		sendValidationError(c, "role", "role must be one of: user, admin")
+		return
+	}
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		sendValidationError(c, "id", "invalid user id")
+		return
+	}
+
+	admin, _ := currentUser(c)
+	if userID == admin.ID && form.Role != roleAdmin {
+		// Avoid locking the last admin out by accident.
+		sendValidationError(c, "role", "you cannot remove your own admin role")
+		return
+	}
+
+	updated, err := SetUserRoleQuery(db, userID, form.Role)
+	if err != nil {
+		log.Printf("[ADMIN] Failed to set role for user_id=%d: %v", userID, err)
+		code := http.StatusInternalServerError
+		msg := "could not update role"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	if !updated {
+		code := http.StatusNotFound
+		msg := "user not found"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	log.Printf("[ADMIN] %s set role of user_id=%d to %s", admin.Username, userID, form.Role)
+	recordAudit(c, AuditEvent{Event: auditAdminRoleChanged, ActorID: admin.ID, ActorName: admin.Username, TargetID: userID, Details: map[string]any{"role": form.Role}})
+	code := http.StatusOK
+	msg := "role updated"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreateAPIKeyQuery      func(db *sql.DB, k APIKey) (int64, error)
+	GetAPIKeyByPrefixQuery func(db *sql.DB, prefix string) (APIKey, error)
+	ListAPIKeysQuery       func(db *sql.DB, userID int) ([]APIKey, error)
+	RevokeAPIKeyQuery      func(db *sql.DB, userID int, keyID int64) (bool, error)
+	TouchAPIKeyQuery       func(db *sql.DB, keyID int64) error
+)
+
+// ---- Real implementations ----
+
+func realCreateAPIKeyQuery(db *sql.DB, k APIKey) (int64, error) {
+	query := "INSERT INTO api_keys (user_id, name, prefix, key_hash) VALUES ($1, $2, $3, $4) RETURNING id"
+	var id int64
+	err := db.QueryRow(query, k.UserID, k.Name, k.Prefix, k.KeyHash).Scan(&id)
+	return id, err
+}
+
+// realGetAPIKeyByPrefixQuery returns sql.ErrNoRows for unknown or revoked keys.
+func realGetAPIKeyByPrefixQuery(db *sql.DB, prefix string) (APIKey, error) {
+	query := `
+SELECT id, user_id, name, prefix, key_hash, created_at, last_used_at
+FROM api_keys
+WHERE prefix = $1 AND revoked_at IS NULL`
+
+	var k APIKey
+	var lastUsed sql.NullTime
+	if err := db.QueryRow(query, prefix).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &k.CreatedAt, &lastUsed); err != nil {
+		return APIKey{}, err
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	return k, nil
+}
+
+func realListAPIKeysQuery(db *sql.DB, userID int) ([]APIKey, error) {
+	query := `
+SELECT id, user_id, name, prefix, created_at, last_used_at
+FROM api_keys
+WHERE user_id = $1 AND revoked_at IS NULL
+ORDER BY created_at DESC`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			k.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func realRevokeAPIKeyQuery(db *sql.DB, userID int, keyID int64) (bool, error) {
+	res, err := db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", keyID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func realTouchAPIKeyQuery(db *sql.DB, keyID int64) error {
+	_, err := db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", keyID)
+	return err
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreateAPIKeyQuery = realCreateAPIKeyQuery
+	GetAPIKeyByPrefixQuery = realGetAPIKeyByPrefixQuery
+	ListAPIKeysQuery = realListAPIKeysQuery
+	RevokeAPIKeyQuery = realRevokeAPIKeyQuery
+	TouchAPIKeyQuery = realTouchAPIKeyQuery
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Personal API keys look like "wk_<prefix>_<secret>". The prefix is stored in
+// clear text to find the row; only a SHA-256 hash of the whole key is stored.
+const (
+	apiKeyTag          = "wk_"
+	apiKeyPrefixLength = 8
+	apiKeyNameMaxLen   = 64
+	maxAPIKeysPerUser  = 10
+
+	contextAPIKeyIDKey = "apiKeyID"
+
+	// apiKeyTouchInterval throttles last_used_at updates like sessionTouchInterval.
+	apiKeyTouchInterval = time.Minute
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+type CreateAPIKeyRequest struct {
+	Name string `form:"name" json:"name"`
+}
+
+// apiKeyRequestLimiter caps requests per key.
+var apiKeyRequestLimiter = newRateLimiter(120, time.Minute)
+
+func newAPIKey() (key, prefix string, err error) {
+	raw := make([]byte, apiKeyPrefixLength/2)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	prefix = hex.EncodeToString(raw)
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyTag + prefix + "_" + secret, prefix, nil
+}
+
+// apiKeyPrefix extracts the lookup prefix, or "" when key is malformed.
+func apiKeyPrefix(key string) string {
+	rest, ok := strings.CutPrefix(key, apiKeyTag)
+	if !ok || len(rest) <= apiKeyPrefixLength+1 || rest[apiKeyPrefixLength] != '_' {
+		return ""
+	}
+	return rest[:apiKeyPrefixLength]
+}
+
+// apiKeyAuth authenticates "Authorization: Bearer wk_..." requests and stores
+// the key owner in the context. Requests without the header are left to
+// sessionMiddleware; a present but invalid key is rejected.
+func apiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(key, apiKeyTag) {
+			c.Next()
+			return
+		}
+
+		apiKey, err := lookupAPIKey(strings.TrimSpace(key))
+		if err != nil {
+			log.Printf("[APIKEY] Rejected API key from IP=%s", c.ClientIP())
+			code := http.StatusUnauthorized
+			msg := "invalid API key"
+			c.AbortWithStatusJSON(http.StatusUnauthorized, AuthResponse{&code, &msg})
+			return
+		}
+
+		if !apiKeyRequestLimiter.Allow(apiKey.Prefix) {
+			code := http.StatusTooManyRequests
+			msg := "API key rate limit exceeded, try again later"
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, AuthResponse{&code, &msg})
+			return
+		}
+
+		id, username, email, _, err := GetUserByIDQuery(db, strconv.Itoa(apiKey.UserID))
+		if err != nil {
+			log.Printf("[APIKEY] Key %s belongs to unknown user_id=%d: %v", apiKey.Prefix, apiKey.UserID, err)
+			code := http.StatusUnauthorized
+			msg := "invalid API key"
+			c.AbortWithStatusJSON(http.StatusUnauthorized, AuthResponse{&code, &msg})
+			return
+		}
+
+		apiKeyRequestCounter.WithLabelValues(apiKey.Prefix).Inc()
+		if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > apiKeyTouchInterval {
+			if err := TouchAPIKeyQuery(db, apiKey.ID); err != nil {
+				log.Printf("[APIKEY] Failed to update last_used_at for key %s: %v", apiKey.Prefix, err)
+			}
+		}
+
+		verified, err := GetUserEmailVerifiedQuery(db, id)
+		if err != nil {
+			log.Printf("[APIKEY] Failed to load email_verified for user_id=%d: %v", id, err)
+		}
+		c.Set(contextUserKey, AuthUser{ID: id, Username: username, Email: email, EmailVerified: verified, Role: loadUserRole(id)})
+		c.Set(contextAPIKeyIDKey, apiKey.ID)
+		c.Set(contextCredentialAuthKey, true)
+		c.Next()
+	}
+}
+
+func lookupAPIKey(key string) (APIKey, error) {
+	prefix := apiKeyPrefix(key)
+	if prefix == "" {
+		return APIKey{}, errInvalidAPIKey
+	}
+	apiKey, err := GetAPIKeyByPrefixQuery(db, prefix)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(apiKey.KeyHash)) != 1 {
+		return APIKey{}, errInvalidAPIKey
+	}
+	return apiKey, nil
+}
+
+// apiListAPIKeys godoc
+// @Summary List the logged-in user's API keys
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} APIKeysResponse
+// @Failure 401 {object} AuthResponse
+// @Router /api/keys [get]
+func apiListAPIKeys(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	keys, err := ListAPIKeysQuery(db, user.ID)
+	if err != nil {
+		log.Printf("[APIKEY] Failed to list keys for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not list API keys"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	c.JSON(http.StatusOK, APIKeysResponse{Data: keys})
+}
+
+// apiCreateAPIKey godoc
+// @Summary Create a named API key; the key is only shown once
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param body body CreateAPIKeyRequest true "Key name"
+// @Success 201 {object} APIKeyCreatedResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/keys [post]
+func apiCreateAPIKey(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form CreateAPIKeyRequest
+	if err := c.ShouldBind(&form); err != nil || strings.TrimSpace(form.Name) == "" {
+		sendValidationError(c, "name", "you have to name the key")
+		return
+	}
+	name := strings.TrimSpace(form.Name)
+	if len(name) > apiKeyNameMaxLen {
+		sendValidationError(c, "name", "the name can be at most 64 characters")
+		return
+	}
+
+	existing, err := ListAPIKeysQuery(db, user.ID)
+	if err == nil && len(existing) >= maxAPIKeysPerUser {
+		sendValidationError(c, "name", "you already have the maximum number of API keys, revoke one first")
+		return
+	}
+
+	key, prefix, err := newAPIKey()
+	apiKey := APIKey{UserID: user.ID, Name: name, Prefix: prefix, KeyHash: hashToken(key), CreatedAt: time.Now()}
+	if err == nil {
+		apiKey.ID, err = CreateAPIKeyQuery(db, apiKey)
+	}
+	if err != nil {
+		log.Printf("[APIKEY] Failed to create key for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not create API key"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+
+	log.Printf("[APIKEY] user_id=%d created key %s", user.ID, prefix)
+	auditSelf(c, auditAPIKeyCreated, map[string]any{"key_id": apiKey.ID, "prefix": prefix, "name": apiKey.Name})
+	c.JSON(http.StatusCreated, APIKeyCreatedResponse{APIKey: apiKey, Key: key})
+}
+
+// apiRevokeAPIKey godoc
+// @Summary Revoke one of the logged-in user's API keys
+// @Tags Auth
+// @Produce json
+// @Param id path int true "API key id"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 404 {object} AuthResponse
+// @Router /api/keys/{id} [delete]
+func apiRevokeAPIKey(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	revoked := false
+	if err == nil {
+		revoked, err = RevokeAPIKeyQuery(db, user.ID, keyID)
+		if err != nil {
+			log.Printf("[APIKEY] Failed to revoke key for user_id=%d: %v", user.ID, err)
+			code := http.StatusInternalServerError
+			msg := "could not revoke API key"
+			c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+			return
+		}
+	}
+	if !revoked {
+		code := http.StatusNotFound
+		msg := "API key not found"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	log.Printf("[APIKEY] user_id=%d revoked key id=%d", user.ID, keyID)
+	auditSelf(c, auditAPIKeyRevoked, map[string]any{"key_id": keyID})
+	code := http.StatusOK
+	msg := "API key revoked"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
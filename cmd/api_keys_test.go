@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func searchWithKey(router http.Handler, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/search?q=hello", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 51, "scripter")
+	mockSearchPagesQuery = func(_ *sql.DB, _ SearchParams) (SearchPage, error) {
+		return SearchPage{}, nil
+	}
+
+	w := postJSON(router, "/api/keys", `{"name":"nightly job"}`, cookie)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := decode[APIKeyCreatedResponse](t, w.Body.Bytes())
+	assert.Equal(t, "nightly job", created.Name)
+	assert.Equal(t, created.Prefix, apiKeyPrefix(created.Key))
+	assert.NotContains(t, w.Body.String(), `"KeyHash"`)
+
+	// Only the hash is stored.
+	stored, err := GetAPIKeyByPrefixQuery(db, created.Prefix)
+	assert.NoError(t, err)
+	assert.Equal(t, hashToken(created.Key), stored.KeyHash)
+	assert.Nil(t, stored.LastUsedAt)
+
+	w = searchWithKey(router, created.Key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiKeyRequestCounter.WithLabelValues(created.Prefix)))
+	stored, _ = GetAPIKeyByPrefixQuery(db, created.Prefix)
+	assert.NotNil(t, stored.LastUsedAt)
+
+	w = sendJSON(router, "GET", "/api/keys", "", cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	list := decode[APIKeysResponse](t, w.Body.Bytes())
+	assert.Len(t, list.Data, 1)
+
+	w = httpDelete(router, "/api/keys/"+strconv.FormatInt(created.ID, 10), "", cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = searchWithKey(router, created.Key)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAPIKeyRejectsWrongSecret(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 52, "guesser")
+	w := postJSON(router, "/api/keys", `{"name":"ci"}`, cookie)
+	created := decode[APIKeyCreatedResponse](t, w.Body.Bytes())
+
+	forged := apiKeyTag + created.Prefix + "_not-the-secret"
+	assert.Equal(t, http.StatusUnauthorized, searchWithKey(router, forged).Code)
+	assert.Equal(t, http.StatusUnauthorized, searchWithKey(router, "wk_garbage").Code)
+}
+
+func TestAPIKeyManagementNeedsLogin(t *testing.T) {
+	router := setupRouter()
+	w := postJSON(router, "/api/keys", `{"name":"x"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	cookie := loginAs(t, 53, "other")
+	w = httpDelete(router, "/api/keys/999999", "", cookie)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = postJSON(router, "/api/keys", `{"name":"  "}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit event names. They are stored as-is, so only add new ones; renaming
+// would split the history.
+const (
+	auditLoginSucceeded     = "login.succeeded"
+	auditLoginFailed        = "login.failed"
+	auditLogout             = "logout"
+	auditRegistered         = "user.registered"
+	auditAccountDeleted     = "user.deleted"
+	auditPasswordChanged    = "password.changed"
+	auditPasswordReset      = "password.reset"
+	auditEmailChanged       = "email.changed"
+	auditTwoFactorEnabled   = "2fa.enabled"
+	auditTwoFactorDisabled  = "2fa.disabled"
+	auditSessionsRevoked    = "sessions.revoked"
+	auditAPIKeyCreated      = "api_key.created"
+	auditAPIKeyRevoked      = "api_key.revoked"
+	auditAdminUnlock        = "admin.unlock"
+	auditAdminRoleChanged   = "admin.role_changed"
+	auditAdminInviteCreated = "admin.invitation_created"
+	auditAdminInviteRevoked = "admin.invitation_revoked"
+	auditRefreshTokenReused = "refresh_token.reused"
+)
+
+// Audit events are purged after auditRetention (AUDIT_RETENTION). The
+// database refuses to delete events younger than minAuditRetention, so the
+// setting cannot be used to wipe recent history.
+const (
+	defaultAuditRetention = 365 * 24 * time.Hour
+	minAuditRetention     = 90 * 24 * time.Hour
+	auditPurgeInterval    = 24 * time.Hour
+)
+
+var auditRetention = defaultAuditRetention
+
+const (
+	defaultAuditPageSize    = 50
+	maxAuditPageSize        = 500
+	maxAuditUserAgentLength = 512
+	maxAuditActorNameLength = 256
+)
+
+func configureAuditRetention() error {
+	raw := os.Getenv("AUDIT_RETENTION")
+	if raw == "" {
+		return nil
+	}
+	retention, err := time.ParseDuration(raw)
+	if err != nil || retention < minAuditRetention {
+		return fmt.Errorf("invalid AUDIT_RETENTION %q (a duration of at least %s)", raw, minAuditRetention)
+	}
+	auditRetention = retention
+	return nil
+}
+
+// purgeAuditEvents deletes events older than auditRetention once a day.
+func purgeAuditEvents(db *sql.DB) {
+	for {
+		if n, err := DeleteAuditEventsBeforeQuery(db, time.Now().Add(-auditRetention)); err != nil {
+			log.Printf("[AUDIT] Purging old events failed: %v", err)
+		} else if n > 0 {
+			log.Printf("[AUDIT] Purged %d events older than %s", n, auditRetention)
+		}
+		time.Sleep(auditPurgeInterval)
+	}
+}
+
+// recordAudit appends an event to the audit log, filling in time, client IP
+// and user agent from the request. The log lines stay as they are; this is
+// the structured copy. A failed insert is logged but never fails the request.
+func recordAudit(c *gin.Context, e AuditEvent) {
+	e.OccurredAt = time.Now().UTC()
+	e.IP = c.ClientIP()
+	e.UserAgent = auditText(c.Request.UserAgent(), maxAuditUserAgentLength)
+	e.ActorName = auditText(e.ActorName, maxAuditActorNameLength)
+	if err := InsertAuditEventQuery(db, e); err != nil {
+		log.Printf("[AUDIT] Failed to record %s for actor=%q: %v", e.Event, e.ActorName, err)
+	}
+}
+
+// auditText makes client-supplied text storable: Postgres rejects invalid
+// UTF-8 and NUL bytes in TEXT columns, and a cut may not split a character.
+// The result is at most maxBytes long.
+func auditText(s string, maxBytes int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "")
+	if len(s) <= maxBytes {
+		return s
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// auditSelf is the common case of the logged-in user acting on their own account.
+func auditSelf(c *gin.Context, event string, details map[string]any) {
+	user, _ := currentUser(c)
+	recordAudit(c, AuditEvent{Event: event, ActorID: user.ID, ActorName: user.Username, TargetID: user.ID, Details: details})
+}
+
+func parseAuditTime(c *gin.Context, field string) (time.Time, bool) {
+	raw := c.Query(field)
+	if raw == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		sendValidationError(c, field, "invalid time, use RFC 3339, e.g. 2006-01-02T15:04:05Z")
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// apiAdminAuditEvents godoc
+// @Summary Query the security audit log
+// @Description Newest first. Pass next_before from the response as before to get the next page.
+// @Tags Admin
+// @Produce json
+// @Param event query string false "Event name, e.g. login.failed"
+// @Param actor_id query int false "User id of the actor"
+// @Param actor query string false "Username of the actor (also matches failed logins for unknown users)"
+// @Param ip query string false "Client IP"
+// @Param since query string false "Only events at or after this time (RFC 3339)"
+// @Param until query string false "Only events before this time (RFC 3339)"
+// @Param before query int false "Only events with a smaller id (pagination cursor)"
+// @Param limit query int false "Page size (default 50, max 500)"
+// @Success 200 {object} AuditEventsResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/admin/audit [get]
+func apiAdminAuditEvents(c *gin.Context) {
+	filter := AuditFilter{
+		Event: c.Query("event"),
+		Actor: c.Query("actor"),
+		IP:    c.Query("ip"),
+		Limit: defaultAuditPageSize,
+	}
+
+	for _, p := range []struct {
+		name string
+		into func(int64)
+	}{
+		{"actor_id", func(v int64) { filter.ActorID = int(v) }},
+		{"before", func(v int64) { filter.Before = v }},
+		{"limit", func(v int64) { filter.Limit = int(v) }},
+	} {
+		raw := c.Query(p.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v < 1 {
+			sendValidationError(c, p.name, p.name+" must be a positive integer")
+			return
+		}
+		p.into(v)
+	}
+	filter.Limit = min(filter.Limit, maxAuditPageSize)
+
+	var ok bool
+	if filter.Since, ok = parseAuditTime(c, "since"); !ok {
+		return
+	}
+	if filter.Until, ok = parseAuditTime(c, "until"); !ok {
+		return
+	}
+
+	events, err := ListAuditEventsQuery(db, filter)
+	if err != nil {
+		log.Printf("[AUDIT] Failed to query audit events: %v", err)
+		code := http.StatusInternalServerError
+		msg := "could not load audit events"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+
+	resp := AuditEventsResponse{Data: events}
+	if len(events) == filter.Limit {
+		next := events[len(events)-1].ID
+		resp.NextBefore = &next
+	}
+	c.JSON(http.StatusOK, resp)
+}
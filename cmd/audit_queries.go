@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEvent struct {
+	ID         int64          `json:"id"`
+	OccurredAt time.Time      `json:"occurred_at"`
+	Event      string         `json:"event"`
+	ActorID    int            `json:"actor_id,omitempty"`
+	ActorName  string         `json:"actor_name,omitempty"`
+	TargetID   int            `json:"target_id,omitempty"`
+	IP         string         `json:"ip"`
+	UserAgent  string         `json:"user_agent"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// AuditFilter narrows ListAuditEventsQuery; zero values match everything.
+// Results are newest first, Before is the id to continue below.
+type AuditFilter struct {
+	Event   string
+	ActorID int
+	Actor   string
+	IP      string
+	Since   time.Time
+	Until   time.Time
+	Before  int64
+	Limit   int
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	InsertAuditEventQuery        func(db *sql.DB, e AuditEvent) error
+	ListAuditEventsQuery         func(db *sql.DB, f AuditFilter) ([]AuditEvent, error)
+	ListUserAuditEventsQuery     func(db *sql.DB, userID int) ([]AuditEvent, error)
+	PseudonymizeAuditEventsQuery func(db *sql.DB, userID int, username string) (int64, error)
+	DeleteAuditEventsBeforeQuery func(db *sql.DB, before time.Time) (int64, error)
+)
+
+// ---- Real implementations ----
+
+func nullableID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func realInsertAuditEventQuery(db *sql.DB, e AuditEvent) error {
+	var details any
+	if len(e.Details) > 0 {
+		raw, err := json.Marshal(e.Details)
+		if err != nil {
+			return err
+		}
+		details = string(raw)
+	}
+	query := `
+INSERT INTO audit_events (occurred_at, event, actor_id, actor_name, target_id, ip, user_agent, details)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb)`
+
+	_, err := db.Exec(query, e.OccurredAt, e.Event, nullableID(e.ActorID), e.ActorName, nullableID(e.TargetID), e.IP, e.UserAgent, details)
+	return err
+}
+
+func realListAuditEventsQuery(db *sql.DB, f AuditFilter) ([]AuditEvent, error) {
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+	if f.Event != "" {
+		add("event = ?", f.Event)
+	}
+	if f.ActorID != 0 {
+		add("actor_id = ?", f.ActorID)
+	}
+	if f.Actor != "" {
+		add("lower(actor_name) = lower(?)", f.Actor)
+	}
+	if f.IP != "" {
+		add("ip = ?", f.IP)
+	}
+	if !f.Since.IsZero() {
+		add("occurred_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("occurred_at < ?", f.Until)
+	}
+	if f.Before != 0 {
+		add("id < ?", f.Before)
+	}
+
+	query := "SELECT id, occurred_at, event, actor_id, actor_name, target_id, ip, user_agent, details FROM audit_events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+// realListUserAuditEventsQuery returns the events a user did or that were
+// done to their account, newest first.
+func realListUserAuditEventsQuery(db *sql.DB, userID int) ([]AuditEvent, error) {
+	rows, err := db.Query(`
+SELECT id, occurred_at, event, actor_id, actor_name, target_id, ip, user_agent, details
+FROM audit_events WHERE actor_id = $1 OR target_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+// realPseudonymizeAuditEventsQuery strips name, IP, user agent and details
+// from a deleted user's events, including failed logins under their name.
+// What happened and when stays; the append-only trigger allows exactly this
+// update and nothing else.
+func realPseudonymizeAuditEventsQuery(db *sql.DB, userID int, username string) (int64, error) {
+	res, err := db.Exec(`
+UPDATE audit_events SET actor_name = '', ip = '', user_agent = '', details = NULL
+WHERE actor_id = $1 OR (actor_id IS NULL AND lower(actor_name) = lower($2))`, userID, username)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func realDeleteAuditEventsBeforeQuery(db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.Exec("DELETE FROM audit_events WHERE occurred_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanAuditEvents(rows *sql.Rows) ([]AuditEvent, error) {
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var actorID, targetID sql.NullInt64
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Event, &actorID, &e.ActorName, &targetID, &e.IP, &e.UserAgent, &details); err != nil {
+			return nil, err
+		}
+		e.ActorID = int(actorID.Int64)
+		e.TargetID = int(targetID.Int64)
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &e.Details); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	InsertAuditEventQuery = realInsertAuditEventQuery
+	ListAuditEventsQuery = realListAuditEventsQuery
+	ListUserAuditEventsQuery = realListUserAuditEventsQuery
+	PseudonymizeAuditEventsQuery = realPseudonymizeAuditEventsQuery
+	DeleteAuditEventsBeforeQuery = realDeleteAuditEventsBeforeQuery
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auditEvents(t *testing.T, router http.Handler, query string, cookie *http.Cookie) AuditEventsResponse {
+	t.Helper()
+	w := sendJSON(router, "GET", "/api/admin/audit?"+query, "", cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return decode[AuditEventsResponse](t, w.Body.Bytes())
+}
+
+func TestFailedLoginIsAudited(t *testing.T) {
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 0, "", "", "", errors.New("not found")
+	}
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString(`{"username":"audit-ghost","password":"x"}`))
+	withCSRF(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "audit-test/1.0")
+	req.RemoteAddr = "203.0.113.7:4711"
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	admin := loginAs(t, 1, "admin")
+	resp := auditEvents(t, router, "event="+auditLoginFailed+"&actor=AUDIT-GHOST&ip=203.0.113.7", admin)
+	if assert.Len(t, resp.Data, 1) {
+		e := resp.Data[0]
+		assert.Equal(t, "audit-ghost", e.ActorName)
+		assert.Zero(t, e.ActorID)
+		assert.Equal(t, "audit-test/1.0", e.UserAgent)
+		assert.Equal(t, "invalid_credentials", e.Details["reason"])
+		assert.False(t, e.OccurredAt.IsZero())
+	}
+}
+
+func TestAuditStoresOnlyValidText(t *testing.T) {
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 0, "", "", "", errors.New("not found")
+	}
+	router := setupRouter()
+
+	// A form body keeps raw bytes, and "é" is two bytes: the limit falls mid-character.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString("username=ghost%FF%00x&password=x"))
+	withCSRF(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", "a"+strings.Repeat("é", maxAuditUserAgentLength)+"\xfe")
+	req.RemoteAddr = "203.0.113.8:4711"
+	router.ServeHTTP(w, req)
+
+	admin := loginAs(t, 1, "admin")
+	resp := auditEvents(t, router, "event="+auditLoginFailed+"&ip=203.0.113.8", admin)
+	if assert.Len(t, resp.Data, 1) {
+		e := resp.Data[0]
+		assert.True(t, utf8.ValidString(e.UserAgent))
+		assert.Equal(t, "a"+strings.Repeat("é", (maxAuditUserAgentLength-1)/2), e.UserAgent)
+		assert.True(t, utf8.ValidString(e.ActorName))
+		assert.NotContains(t, e.ActorName, "\x00")
+	}
+	assert.Equal(t, "abc", auditText("abc", 3))
+	assert.Equal(t, "ab", auditText("abé", 3))
+}
+
+func TestAdminActionsAreAuditedAndPaginated(t *testing.T) {
+	router := setupRouter()
+	admin := loginAs(t, 1, "admin")
+	for _, name := range []string{"audit-a", "audit-b", "audit-c"} {
+		w := postJSON(router, "/api/admin/unlock", `{"username":"`+name+`"}`, admin)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	page := auditEvents(t, router, "event="+auditAdminUnlock+"&actor_id=1&limit=2", admin)
+	assert.Len(t, page.Data, 2)
+	assert.Equal(t, "audit-c", page.Data[0].Details["username"])
+	if assert.NotNil(t, page.NextBefore) {
+		next := auditEvents(t, router, "event="+auditAdminUnlock+"&actor_id=1&limit=2&before="+strconv.FormatInt(*page.NextBefore, 10), admin)
+		assert.NotEmpty(t, next.Data)
+		assert.Equal(t, "audit-a", next.Data[0].Details["username"])
+	}
+}
+
+func TestAuditEndpointAccess(t *testing.T) {
+	router := setupRouter()
+	user := loginAs(t, 131, "nosy")
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, "GET", "/api/admin/audit", "", user).Code)
+
+	admin := loginAs(t, 1, "admin")
+	assert.Equal(t, http.StatusUnprocessableEntity, sendJSON(router, "GET", "/api/admin/audit?limit=-1", "", admin).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, sendJSON(router, "GET", "/api/admin/audit?since=yesterday", "", admin).Code)
+}
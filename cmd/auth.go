@@ -2,14 +2,22 @@ package main
 
 import (
 	"log"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	"WHOKNOWS_VARIATIONS/util"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// emailPattern accepts one address without whitespace: a local part, "@" and
+// a domain with at least one dot. Anchored, so no line breaks can ride along
+// into mail headers.
+var emailPattern = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+
 type LoginRequest struct {
 	Username string `form:"username" json:"username"`
 	Password string `form:"password" json:"password"`
@@ -20,6 +28,8 @@ type RegisterRequest struct {
 	Email     string `form:"email" json:"email"`
 	Password  string `form:"password" json:"password"`
 	Password2 string `form:"password2" json:"password2"`
+	// InviteCode is required when REGISTRATION_MODE is invite-only.
+	InviteCode string `form:"invite_code" json:"invite_code"`
 }
 
 // apiLogin godoc
@@ -30,7 +40,9 @@ type RegisterRequest struct {
 // @Produce json
 // @Param request body LoginRequest true "Credentials"
 // @Success 200 {object} AuthResponse
+// @Success 202 {object} TwoFactorChallengeResponse "Password accepted, complete with /api/login/2fa"
 // @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} HTTPValidationError
 // @Router /api/login [post]
 func apiLogin(c *gin.Context) {
 	var creds LoginRequest
@@ -39,26 +51,89 @@ func apiLogin(c *gin.Context) {
 		c.JSON(422, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"body", 0}, Msg: "invalid form data", Type: "validation_error"}}})
 		return
 	}
+	creds.Username = normalizeIdentifier(creds.Username)
 
-	id, _, _, hashed, err := GetUserByUsernameQuery(db, creds.Username)
+	id, ok := checkLoginCredentials(c, creds.Username, creds.Password)
+	if !ok {
+		return
+	}
+
+	twoFactor, _, err := userHasTwoFactor(id)
 	if err != nil {
-		log.Printf("[LOGIN] Invalid username: %s", creds.Username)
-		c.JSON(422, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"username", 0}, Msg: "invalid username", Type: "auth_error"}}})
+		log.Printf("[LOGIN] Failed to load 2FA state for username=%s: %v", creds.Username, err)
+		c.JSON(http.StatusInternalServerError, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"session", 0}, Msg: "could not start session", Type: "session_error"}}})
 		return
 	}
-	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(creds.Password)) != nil {
-		log.Printf("[LOGIN] Invalid password for username: %s", creds.Username)
-		c.JSON(422, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"password", 0}, Msg: "invalid password", Type: "auth_error"}}})
+	if twoFactor {
+		challenge, err := newTwoFactorChallenge(id, creds.Username, "password")
+		if err != nil {
+			log.Printf("[LOGIN] Failed to create 2FA challenge for username=%s: %v", creds.Username, err)
+			c.JSON(http.StatusInternalServerError, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"session", 0}, Msg: "could not start session", Type: "session_error"}}})
+			return
+		}
+		log.Printf("[LOGIN] 2FA required for username: %s", creds.Username)
+		c.JSON(http.StatusAccepted, TwoFactorChallengeResponse{StatusCode: http.StatusAccepted, Message: "2FA required", Challenge: challenge})
 		return
 	}
 
-	util.SetAuthCookie(c, id)
+	if err := startSession(c, id); err != nil {
+		log.Printf("[LOGIN] Failed to issue session for username=%s: %v", creds.Username, err)
+		c.JSON(http.StatusInternalServerError, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"session", 0}, Msg: "could not start session", Type: "session_error"}}})
+		return
+	}
 	code := 200
 	msg := "login successful"
 	log.Printf("[LOGIN] Login successful for username: %s", creds.Username)
+	recordAudit(c, AuditEvent{Event: auditLoginSucceeded, ActorID: id, ActorName: creds.Username, Details: map[string]any{"method": "password"}})
 	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
 }
 
+// checkLoginCredentials runs the password part of a login: lockouts, the
+// password check, hash upgrades and the email verification gate. It sends
+// the error response itself and returns the user id when the password is
+// right. A second factor is up to the caller.
+func checkLoginCredentials(c *gin.Context, username, password string) (int, bool) {
+	now := time.Now()
+	accountKey := accountThrottleKey(username)
+	wait := max(ipLoginThrottle.LockedFor(c.ClientIP(), now), accountLoginThrottle.LockedFor(accountKey, now))
+	if wait > 0 {
+		log.Printf("[LOGIN] Locked out attempt for username=%s from IP=%s", username, c.ClientIP())
+		loginFailureCounter.WithLabelValues("locked").Inc()
+		recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorName: username, Details: map[string]any{"reason": "locked_out"}})
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"credentials", 0}, Msg: "too many failed login attempts, try again later", Type: "auth_error"}}})
+		return 0, false
+	}
+
+	id, _, _, hashed, err := GetUserByUsernameQuery(db, username)
+	if err != nil {
+		// Burn the same time as a real bcrypt check so response timing does not reveal unknown usernames.
+		hashed = dummyPasswordHash()
+		id = 0
+	}
+	ok, rehash, scheme := verifyPassword(hashed, password)
+	if !ok || id == 0 {
+		log.Printf("[LOGIN] Invalid credentials for username=%s from IP=%s", username, c.ClientIP())
+		recordLoginFailure(c.ClientIP(), accountKey, now)
+		recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: id, ActorName: username, Details: map[string]any{"reason": "invalid_credentials"}})
+		c.JSON(422, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"credentials", 0}, Msg: "invalid username or password", Type: "auth_error"}}})
+		return 0, false
+	}
+	accountLoginThrottle.Reset(accountKey)
+	if rehash {
+		upgradePasswordHash(id, password, scheme)
+	}
+	if emailVerificationMode == verificationModeBlock {
+		if verified, err := GetUserEmailVerifiedQuery(db, id); err != nil || !verified {
+			log.Printf("[LOGIN] Unverified email for username: %s", username)
+			recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: id, ActorName: username, Details: map[string]any{"reason": "email_unverified"}})
+			c.JSON(http.StatusForbidden, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"email", 0}, Msg: "please verify your email address before logging in", Type: "auth_error"}}})
+			return 0, false
+		}
+	}
+	return id, true
+}
+
 // apiRegister godoc
 // @Summary Register a new user and set auth cookie
 // @Tags Auth
@@ -77,6 +152,13 @@ func apiRegister(c *gin.Context) {
 		sendValidationError(c, "body", "invalid form data")
 		return
 	}
+	form.Username = normalizeIdentifier(form.Username)
+	form.Email = normalizeIdentifier(form.Email)
+	if rejectClosedRegistration(c) {
+		log.Printf("[REGISTER] Refused signup for username=%q: registration is closed", form.Username)
+		userSignupCounter.WithLabelValues("failed").Inc()
+		return
+	}
 
 	if form.Username == "" {
 		log.Printf("[REGISTER] Missing username")
@@ -84,7 +166,7 @@ func apiRegister(c *gin.Context) {
 		sendValidationError(c, "username", "you have to enter a username")
 		return
 	}
-	if form.Email == "" || !regexp.MustCompile(`.+@.+\..+`).MatchString(form.Email) {
+	if form.Email == "" || !emailPattern.MatchString(form.Email) {
 		log.Printf("[REGISTER] Invalid email: %q", form.Email)
 		userSignupCounter.WithLabelValues("failed").Inc()
 		sendValidationError(c, "email", "you have to enter a valid email address")
@@ -103,24 +185,134 @@ func apiRegister(c *gin.Context) {
 		return
 	}
 
-	hash, _ := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
-	userID, err := InsertUserQuery(db, form.Username, form.Email, string(hash))
+	if rejectWeakPassword(c, form.Password, form.Username, form.Email) {
+		log.Printf("[REGISTER] Password rejected by policy for username=%q", form.Username)
+		userSignupCounter.WithLabelValues("failed").Inc()
+		return
+	}
+
+	hash, err := hashPassword(form.Password)
+	if err != nil {
+		log.Printf("[REGISTER] Failed to hash password: %v", err)
+		userSignupCounter.WithLabelValues("failed").Inc()
+		sendValidationError(c, "password", "could not process password")
+		return
+	}
+	invitationID, ok := claimInvitation(c, form.InviteCode)
+	if !ok {
+		log.Printf("[REGISTER] Missing or invalid invitation code for username=%q", form.Username)
+		userSignupCounter.WithLabelValues("failed").Inc()
+		return
+	}
+	userID, err := InsertUserQuery(db, form.Username, form.Email, hash)
 	if err != nil {
+		releaseInvitation(invitationID)
 		log.Printf("[REGISTER] Database error: %v", err)
 		userSignupCounter.WithLabelValues("failed").Inc()
 		c.JSON(422, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"database", 0}, Msg: "username or email taken", Type: "db_error"}}})
 		return
 	}
 
-	log.Printf("[REGISTER] User registered: %s", form.Username)
+	if invitationID != 0 {
+		log.Printf("[REGISTER] User registered: %s (invitation id=%d)", form.Username, invitationID)
+	} else {
+		log.Printf("[REGISTER] User registered: %s", form.Username)
+	}
 	userSignupCounter.WithLabelValues("success").Inc()
+	registered := AuditEvent{Event: auditRegistered, ActorID: int(userID), ActorName: form.Username, TargetID: int(userID)}
+	if invitationID != 0 {
+		registered.Details = map[string]any{"invitation_id": invitationID}
+	}
+	recordAudit(c, registered)
+
+	if err := sendVerificationEmail(int(userID), form.Username, form.Email); err != nil {
+		log.Printf("[REGISTER] Failed to send verification email to user_id=%d: %v", userID, err)
+	}
+	if emailVerificationMode == verificationModeBlock {
+		code := 200
+		msg := "user registered, check your email to verify your account"
+		c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+		return
+	}
 
-	util.SetAuthCookie(c, int(userID))
+	if err := startSession(c, int(userID)); err != nil {
+		log.Printf("[REGISTER] Failed to issue session for username=%s: %v", form.Username, err)
+		c.JSON(http.StatusInternalServerError, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"session", 0}, Msg: "could not start session", Type: "session_error"}}})
+		return
+	}
 	code := 200
 	msg := "user registered successfully"
 	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
 }
 
+// dummyPasswordHash is verified against when the username does not exist.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("not-a-real-password")
+	if err != nil {
+		log.Printf("[LOGIN] Failed to create dummy password hash: %v", err)
+	}
+	return hash
+})
+
+func recordLoginFailure(ip, accountKey string, now time.Time) {
+	loginFailureCounter.WithLabelValues("invalid_credentials").Inc()
+	if locked, until := ipLoginThrottle.Fail(ip, now); locked {
+		loginLockoutCounter.WithLabelValues("ip").Inc()
+		log.Printf("[LOGIN] IP=%s locked out until %s", ip, until.Format(time.RFC3339))
+	}
+	if locked, until := accountLoginThrottle.Fail(accountKey, now); locked {
+		loginLockoutCounter.WithLabelValues("account").Inc()
+		log.Printf("[LOGIN] Account %s locked out until %s", accountKey, until.Format(time.RFC3339))
+	}
+}
+
+// upgradePasswordHash replaces a legacy or outdated hash after a successful login.
+// Failures are only logged: the user already proved the password, and the next
+// login will try again.
+func upgradePasswordHash(userID int, password, scheme string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("[LOGIN] Failed to re-hash %s password for user_id=%d: %v", scheme, userID, err)
+		return
+	}
+	if err := UpdateUserPasswordQuery(db, userID, hash); err != nil {
+		log.Printf("[LOGIN] Failed to store re-hashed password for user_id=%d: %v", userID, err)
+		return
+	}
+	passwordRehashCounter.WithLabelValues(scheme).Inc()
+	log.Printf("[LOGIN] Upgraded %s password hash for user_id=%d", scheme, userID)
+}
+
+// startSession records a server-side session for userID and sets its signed token as the auth cookie.
+func startSession(c *gin.Context, userID int) error {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	userAgent := c.GetHeader("User-Agent")
+	browser, version := parseUserAgent(userAgent)
+	expiresAt := time.Now().Add(sessionTTL)
+
+	if err := CreateSessionQuery(db, Session{
+		ID:             sessionID,
+		UserID:         userID,
+		ExpiresAt:      expiresAt,
+		IP:             c.ClientIP(),
+		UserAgent:      userAgent,
+		Browser:        browser,
+		BrowserVersion: version,
+	}); err != nil {
+		return err
+	}
+
+	token, err := issueSessionToken(sessionID, userID, expiresAt)
+	if err != nil {
+		return err
+	}
+	util.SetAuthCookie(c, token, int(sessionTTL.Seconds()))
+	return nil
+}
+
 func sendValidationError(c *gin.Context, field, msg string) {
 	c.JSON(http.StatusUnprocessableEntity, HTTPValidationError{
 		Detail: []ValidationError{{
@@ -132,12 +324,19 @@ func sendValidationError(c *gin.Context, field, msg string) {
 }
 
 // apiLogout godoc
-// @Summary Clear the auth cookie
+// @Summary Revoke the current session and clear the auth cookie
 // @Tags Auth
 // @Produce json
 // @Success 200 {object} AuthResponse
-// @Router /api/logout [get]
+// @Failure 403 {object} AuthResponse "Missing or invalid CSRF token"
+// @Router /api/logout [post]
 func apiLogout(c *gin.Context) {
+	if user, ok := currentUser(c); ok {
+		if _, err := RevokeSessionQuery(db, user.ID, currentSessionID(c)); err != nil {
+			log.Printf("[LOGOUT] Failed to revoke session for user_id=%d: %v", user.ID, err)
+		}
+		auditSelf(c, auditLogout, nil)
+	}
 	util.RemoveAuthCookie(c)
 	code := 200
 	msg := "logged out"
@@ -145,23 +344,45 @@ func apiLogout(c *gin.Context) {
 	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
 }
 
+// apiLogoutCompat godoc
+// @Summary Deprecated GET variant of /api/logout, kept for old clients
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} AuthResponse
+// @Failure 403 {object} AuthResponse "Request came from another site"
+// @Router /api/logout [get]
+func apiLogoutCompat(c *gin.Context) {
+	c.Header("Deprecation", "true")
+	c.Header("Link", `</api/logout>; rel="alternate"; method="POST"`)
+	// A GET cannot carry the CSRF token, so at least refuse requests that
+	// another site triggered (e.g. <img src="/api/logout">).
+	if isCrossSiteRequest(c) {
+		log.Printf("[LOGOUT] Refused cross-site GET logout from IP=%s", c.ClientIP())
+		code := http.StatusForbidden
+		msg := "use POST /api/logout"
+		c.JSON(http.StatusForbidden, AuthResponse{&code, &msg})
+		return
+	}
+	apiLogout(c)
+}
+
 // apiSession godoc
-// @Summary Report session state based on auth cookie
+// @Summary Report session state based on the signed session cookie
 // @Tags Auth
 // @Produce json
-// @Success 200 {object} AuthResponse "statusCode 200 if cookie is present, 401 otherwise"
+// @Success 200 {object} AuthResponse "statusCode 200 if the session is valid, 401 otherwise"
 // @Router /api/session [get]
 func apiSession(c *gin.Context) {
-	_, err := c.Cookie("user_id")
-	if err != nil {
-		log.Printf("[SESSION] Missing user_id cookie")
+	user, ok := currentUser(c)
+	if !ok {
+		log.Printf("[SESSION] No valid session cookie")
 		code := 401
 		msg := "not logged in"
 		c.JSON(http.StatusOK, AuthResponse{&code, &msg})
 		return
 	}
 
-	log.Printf("[SESSION] Valid session detected from IP=%s", c.ClientIP())
+	log.Printf("[SESSION] Valid session for user_id=%d from IP=%s", user.ID, c.ClientIP())
 
 	code := 200
 	msg := "logged in"
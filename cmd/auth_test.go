@@ -16,22 +16,38 @@ import (
 
 func TestRegisterValidationErrors(t *testing.T) {
 	router := setupRouter()
-	body := `{"email":"x@y.z","password":"abc","password2":"abc"}`
+	body := `{"email":"x@y.z","password":"correct horse battery","password2":"correct horse battery"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/register", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
 }
 
+func TestRegisterRejectsMalformedEmail(t *testing.T) {
+	router := setupRouter()
+	for _, email := range []string{
+		`a@b.c\r\nBcc: victim@example.com`,
+		`a@b.c\nx`,
+		`first last@example.com`,
+		`a@b@c.d`,
+		`@example.com`,
+	} {
+		w := postJSON(router, "/api/register", `{"username":"mailer","email":"`+email+`","password":"correct horse battery","password2":"correct horse battery"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, email)
+	}
+}
+
 func TestRegisterSuccess(t *testing.T) {
 	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 1, nil }
 
 	router := setupRouter()
-	body := `{"username":"testuser","email":"user@example.com","password":"abc","password2":"abc"}`
+	body := `{"username":"testuser","email":"user@example.com","password":"correct horse battery","password2":"correct horse battery"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/register", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
@@ -46,9 +62,10 @@ func TestRegisterUsernameTaken(t *testing.T) {
 	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 0, errors.New("duplicate") }
 
 	router := setupRouter()
-	body := `{"username":"exists","email":"user@example.com","password":"abc","password2":"abc"}`
+	body := `{"username":"exists","email":"user@example.com","password":"correct horse battery","password2":"correct horse battery"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/register", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
@@ -64,6 +81,7 @@ func TestLoginInvalidBody(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString("invalid-json"))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
@@ -78,12 +96,14 @@ func TestLoginInvalidUsername(t *testing.T) {
 	body := `{"username":"nope","password":"x"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
 	assert.Equal(t, 422, w.Code)
 	resp := decode[HTTPValidationError](t, w.Body.Bytes())
-	assert.Equal(t, "username", resp.Detail[0].Loc[0])
+	assert.Equal(t, "credentials", resp.Detail[0].Loc[0])
+	assert.Equal(t, "invalid username or password", resp.Detail[0].Msg)
 }
 
 func TestLoginWrongPassword(t *testing.T) {
@@ -95,12 +115,25 @@ func TestLoginWrongPassword(t *testing.T) {
 	body := `{"username":"u","password":"badpw"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
 	assert.Equal(t, 422, w.Code)
 	resp := decode[HTTPValidationError](t, w.Body.Bytes())
-	assert.Equal(t, "password", resp.Detail[0].Loc[0])
+	assert.Equal(t, "credentials", resp.Detail[0].Loc[0])
+	assert.Equal(t, "invalid username or password", resp.Detail[0].Msg)
+}
+
+func TestSeededAdminCannotLogIn(t *testing.T) {
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 1, seededAdminUsername, "admin@example.com", passwordResetRequired, nil
+	}
+	router := setupRouter()
+	for _, password := range []string{seededAdminPassword, passwordResetRequired, ""} {
+		w := postJSON(router, "/api/login", `{"username":"admin","password":"`+password+`"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, password)
+	}
 }
 
 func TestApiLoginSuccess(t *testing.T) {
@@ -123,6 +156,7 @@ func TestApiLoginSuccess(t *testing.T) {
 	body := `{"username":"u","password":"goodpw"}`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString(body))
+	withCSRF(req)
 	req.Header.Set("Content-Type", "application/json")
 
 	router.ServeHTTP(w, req)
@@ -138,6 +172,29 @@ func TestApiLoginSuccess(t *testing.T) {
 	}
 }
 
+func TestLoginUpgradesLegacyMD5Hash(t *testing.T) {
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 1, "admin", "admin@example.com", "5f4dcc3b5aa765d61d8327deb882cf99", nil
+	}
+	var stored string
+	mockUpdateUserPassword = func(_ *sql.DB, id int, hash string) error {
+		stored = hash
+		return nil
+	}
+	defer func() { mockUpdateUserPassword = nil }()
+
+	router := setupRouter()
+	body := `{"username":"admin","password":"password"}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString(body))
+	withCSRF(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored), []byte("password")))
+}
+
 // --- /api/logout ---
 
 func TestLogout(t *testing.T) {
@@ -150,3 +207,19 @@ func TestLogout(t *testing.T) {
 	resp := decode[AuthResponse](t, w.Body.Bytes())
 	assert.Equal(t, "logged out", *resp.Message)
 }
+
+func TestLogoutRevokesSession(t *testing.T) {
+	cookie := loginAs(t, 3, "leaver")
+	router := setupRouter()
+
+	w := postJSON(router, "/api/logout", "", cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Replaying the old cookie must not restore the session.
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/session", nil)
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, 401, *resp.StatusCode)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"WHOKNOWS_VARIATIONS/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFCookieIssuedOnSafeRequests(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/session", nil)
+	router.ServeHTTP(w, req)
+
+	var csrf *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == util.CSRFCookieName {
+			csrf = c
+		}
+	}
+	if assert.NotNil(t, csrf) {
+		assert.NotEmpty(t, csrf.Value)
+		assert.False(t, csrf.HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, csrf.SameSite)
+	}
+}
+
+func TestCSRFRejectsForgedPosts(t *testing.T) {
+	router := setupRouter()
+	body := `{"username":"u","password":"p"}`
+
+	// No token at all, as from a cross-site form.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/login", bytes.NewBufferString("username=u&password=p"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Header that does not match the cookie.
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/login", bytes.NewBufferString(body))
+	req.AddCookie(&http.Cookie{Name: util.CSRFCookieName, Value: "a"})
+	req.Header.Set(csrfHeaderName, "b")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Form field is accepted for plain HTML forms.
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/login", bytes.NewBufferString("username=u&password=p&csrf_token=tok"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: util.CSRFCookieName, Value: "tok"})
+	router.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusForbidden, w.Code)
+}
+
+func TestCSRFSkipsOnlyAuthenticatedBearerRequests(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 163, "csrfbearer")
+
+	// Any Authorization header next to the session cookie proves nothing.
+	for _, header := range []string{"Bearer wk_something", "Basic Zm9vOmJhcg=="} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/logout", nil)
+		req.Header.Set("Authorization", header)
+		req.AddCookie(cookie)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, header)
+	}
+
+	// A valid access token authenticates the request on its own.
+	token, err := issueAccessToken(163, time.Now())
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLogoutCompatRefusesCrossSite(t *testing.T) {
+	cookie := loginAs(t, 101, "imgvictim")
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/logout", nil)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+}
+
+func TestAuthCookieIsSameSiteLax(t *testing.T) {
+	cookie := loginAs(t, 102, "samesite")
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+}
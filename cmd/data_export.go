@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Data access requests (GDPR art. 15). GET /api/me/export collects everything
+// stored about the user in the background; if that finishes within
+// exportSyncWait the file is returned directly, otherwise the client gets a
+// job id to poll at /api/me/export/{id}. Finished exports are kept in memory
+// for exportJobTTL.
+const exportJobTTL = time.Hour
+
+var (
+	exportSyncWait     = 2 * time.Second
+	exportRequestLimit = newRateLimiter(5, time.Hour)
+)
+
+type UserExport struct {
+	GeneratedAt  time.Time       `json:"generated_at"`
+	Profile      ExportProfile   `json:"profile"`
+	Sessions     []Session       `json:"sessions"`
+	APIKeys      []APIKey        `json:"api_keys"`
+	LinkedLogins []UserIdentity  `json:"linked_logins"`
+	TwoFactor    ExportTwoFactor `json:"two_factor"`
+	AuditEvents  []AuditEvent    `json:"security_events"`
+	Notes        []string        `json:"notes"`
+}
+
+type ExportProfile struct {
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+	HasPassword   bool   `json:"has_password"`
+}
+
+type ExportTwoFactor struct {
+	Enabled     bool       `json:"enabled"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+}
+
+type ExportJobResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+	JobID      string `json:"job_id"`
+	StatusURL  string `json:"status_url"`
+}
+
+type exportJob struct {
+	userID  int
+	created time.Time
+	done    chan struct{}
+	data    []byte
+	err     error
+}
+
+var exportJobs = struct {
+	mu sync.Mutex
+	m  map[string]*exportJob
+}{m: make(map[string]*exportJob)}
+
+// buildUserExport gathers the user's data. Secrets (password hash, TOTP
+// secret, token and key hashes) are left out on purpose.
+func buildUserExport(userID int) (UserExport, error) {
+	id, username, email, hashed, err := GetUserByIDQuery(db, strconv.Itoa(userID))
+	if err != nil {
+		return UserExport{}, err
+	}
+	verified, err := GetUserEmailVerifiedQuery(db, id)
+	if err != nil {
+		return UserExport{}, err
+	}
+	export := UserExport{
+		GeneratedAt: time.Now().UTC(),
+		Profile: ExportProfile{
+			ID:            id,
+			Username:      username,
+			Email:         email,
+			EmailVerified: verified,
+			Role:          loadUserRole(id),
+			HasPassword:   len(hashed) > 0 && hashed[0] != '!',
+		},
+		Notes: []string{
+			"Searches are not linked to user accounts, so no search history is stored about you.",
+			"Passwords, two-factor secrets and API keys are only stored as hashes and are not included.",
+			fmt.Sprintf("Security events are kept for %d days. When you delete your account they are kept without your name, IP addresses, browser or details.", int(auditRetention.Hours()/24)),
+		},
+	}
+
+	if export.Sessions, err = ListSessionsQuery(db, id); err != nil {
+		return UserExport{}, err
+	}
+	if export.APIKeys, err = ListAPIKeysQuery(db, id); err != nil {
+		return UserExport{}, err
+	}
+	if export.LinkedLogins, err = ListUserIdentitiesQuery(db, id); err != nil {
+		return UserExport{}, err
+	}
+	enabled, totp, err := userHasTwoFactor(id)
+	if err != nil {
+		return UserExport{}, err
+	}
+	export.TwoFactor = ExportTwoFactor{Enabled: enabled, ConfirmedAt: totp.ConfirmedAt}
+
+	if export.AuditEvents, err = ListUserAuditEventsQuery(db, id); err != nil {
+		return UserExport{}, err
+	}
+	for i, e := range export.AuditEvents {
+		// Where an admin acted on the account, their IP and browser are theirs.
+		if e.ActorID != id {
+			export.AuditEvents[i].IP, export.AuditEvents[i].UserAgent = "", ""
+		}
+	}
+	return export, nil
+}
+
+func startExportJob(userID int) (string, *exportJob, error) {
+	jobID, err := randomToken(16)
+	if err != nil {
+		return "", nil, err
+	}
+	job := &exportJob{userID: userID, created: time.Now(), done: make(chan struct{})}
+
+	exportJobs.mu.Lock()
+	for k, j := range exportJobs.m {
+		if time.Since(j.created) > exportJobTTL {
+			delete(exportJobs.m, k)
+		}
+	}
+	exportJobs.m[jobID] = job
+	exportJobs.mu.Unlock()
+
+	go func() {
+		defer close(job.done)
+		export, err := buildUserExport(userID)
+		if err == nil {
+			job.data, err = json.MarshalIndent(export, "", "  ")
+		}
+		job.err = err
+		if err != nil {
+			log.Printf("[EXPORT] Export for user_id=%d failed: %v", userID, err)
+		}
+	}()
+	return jobID, job, nil
+}
+
+func sendExportFile(c *gin.Context, job *exportJob) {
+	if job.err != nil {
+		code := http.StatusInternalServerError
+		msg := "could not export your data"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	filename := fmt.Sprintf("whoknows-export-%d-%s.json", job.userID, job.created.UTC().Format("20060102"))
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/json", job.data)
+}
+
+func sendExportPending(c *gin.Context, jobID string) {
+	c.JSON(http.StatusAccepted, ExportJobResponse{
+		StatusCode: http.StatusAccepted,
+		Message:    "your export is being prepared",
+		JobID:      jobID,
+		StatusURL:  "/api/me/export/" + jobID,
+	})
+}
+
+// apiExportMyData godoc
+// @Summary Download everything stored about the logged-in user
+// @Description Returns the JSON file directly, or 202 with a job to poll when the export takes longer.
+// @Tags Account
+// @Produce json
+// @Success 200 {object} UserExport
+// @Success 202 {object} ExportJobResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 429 {object} AuthResponse
+// @Router /api/me/export [get]
+func apiExportMyData(c *gin.Context) {
+	user, _ := currentUser(c)
+	if !exportRequestLimit.Allow(strconv.Itoa(user.ID)) {
+		code := http.StatusTooManyRequests
+		msg := "too many export requests, try again later"
+		c.JSON(http.StatusTooManyRequests, AuthResponse{&code, &msg})
+		return
+	}
+
+	jobID, job, err := startExportJob(user.ID)
+	if err != nil {
+		log.Printf("[EXPORT] Failed to start export for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not export your data"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	log.Printf("[EXPORT] Export requested by user_id=%d", user.ID)
+
+	select {
+	case <-job.done:
+		sendExportFile(c, job)
+	case <-time.After(exportSyncWait):
+		sendExportPending(c, jobID)
+	}
+}
+
+// apiExportJob godoc
+// @Summary Poll or download a pending data export
+// @Tags Account
+// @Produce json
+// @Param id path string true "Export job id"
+// @Success 200 {object} UserExport
+// @Success 202 {object} ExportJobResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 404 {object} AuthResponse
+// @Router /api/me/export/{id} [get]
+func apiExportJob(c *gin.Context) {
+	user, _ := currentUser(c)
+	jobID := c.Param("id")
+
+	exportJobs.mu.Lock()
+	job, ok := exportJobs.m[jobID]
+	exportJobs.mu.Unlock()
+	if !ok || job.userID != user.ID || time.Since(job.created) > exportJobTTL {
+		code := http.StatusNotFound
+		msg := "export not found"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	select {
+	case <-job.done:
+		sendExportFile(c, job)
+	default:
+		sendExportPending(c, jobID)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportMyData(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 91, "exporter")
+	postJSON(router, "/api/keys", `{"name":"backup"}`, cookie)
+
+	w := sendJSON(router, "GET", "/api/me/export", "", cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+
+	export := decode[UserExport](t, w.Body.Bytes())
+	assert.Equal(t, "exporter", export.Profile.Username)
+	assert.Equal(t, "exporter@example.com", export.Profile.Email)
+	assert.Len(t, export.Sessions, 1)
+	assert.Len(t, export.APIKeys, 1)
+	assert.NotContains(t, w.Body.String(), "key_hash")
+	if assert.NotEmpty(t, export.AuditEvents) {
+		assert.Equal(t, auditAPIKeyCreated, export.AuditEvents[0].Event)
+	}
+
+	w = sendJSON(router, "GET", "/api/me/export", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestExportMyDataAsync(t *testing.T) {
+	router := setupRouter()
+	exportSyncWait = 0
+	defer func() { exportSyncWait = 2 * time.Second }()
+	cookie := loginAs(t, 92, "bigaccount")
+
+	// Hold the export on its audit events until the request has answered 202.
+	release := make(chan struct{})
+	listEvents := ListUserAuditEventsQuery
+	ListUserAuditEventsQuery = func(db *sql.DB, userID int) ([]AuditEvent, error) {
+		<-release
+		return listEvents(db, userID)
+	}
+	defer func() { ListUserAuditEventsQuery = listEvents }()
+
+	w := sendJSON(router, "GET", "/api/me/export", "", cookie)
+	close(release)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	job := decode[ExportJobResponse](t, w.Body.Bytes())
+
+	assert.Eventually(t, func() bool {
+		w = sendJSON(router, "GET", job.StatusURL, "", cookie)
+		return w.Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "bigaccount", decode[UserExport](t, w.Body.Bytes()).Profile.Username)
+
+	// Other users cannot fetch someone else's export.
+	other := loginAs(t, 93, "snoop")
+	w = sendJSON(router, "GET", job.StatusURL, "", other)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
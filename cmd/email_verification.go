@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Email verification modes (EMAIL_VERIFICATION_MODE):
+//   - off:     verification mails are sent but never enforced
+//   - limited: unverified users can log in, but routes behind requireVerifiedEmail are refused
+//   - block:   unverified users cannot log in at all
+const (
+	verificationModeOff     = "off"
+	verificationModeLimited = "limited"
+	verificationModeBlock   = "block"
+
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var (
+	emailVerificationMode = verificationModeLimited
+
+	resendVerificationEmailLimiter = newRateLimiter(3, time.Hour)
+	resendVerificationIPLimiter    = newRateLimiter(10, time.Hour)
+)
+
+type VerifyEmailRequest struct {
+	Token string `form:"token" json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `form:"email" json:"email"`
+}
+
+func configureEmailVerification() error {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("EMAIL_VERIFICATION_MODE")))
+	switch mode {
+	case "":
+		return nil
+	case verificationModeOff, verificationModeLimited, verificationModeBlock:
+		emailVerificationMode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid EMAIL_VERIFICATION_MODE %q (expected off, limited or block)", mode)
+}
+
+func sendVerificationEmail(userID int, username, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	if err := CreateEmailVerificationQuery(db, userID, hashToken(token), time.Now().Add(emailVerificationTTL)); err != nil {
+		return err
+	}
+
+	link := appBaseURL() + "/api/verify?token=" + url.QueryEscape(token)
+	sendMailAsync(Mail{
+		To:      email,
+		Subject: "Confirm your ¿Who Knows? email address",
+		Body: "Hi " + username + ",\n\n" +
+			"Please confirm your email address by opening the link below within 48 hours:\n\n" +
+			link + "\n\n" +
+			"If you did not create an account, you can ignore this email.\n",
+	})
+	log.Printf("[VERIFY] Verification link issued for user_id=%d", userID)
+	return nil
+}
+
+// apiVerifyEmail godoc
+// @Summary Confirm an email address with the token from the verification mail
+// @Description Browsers following the mail link are redirected to the login page.
+// @Tags Auth
+// @Produce json
+// @Param token query string true "Verification token"
+// @Success 200 {object} AuthResponse
+// @Success 303 "Redirect for browsers"
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/verify [get]
+func apiVerifyEmail(c *gin.Context) {
+	var form VerifyEmailRequest
+	if err := c.ShouldBind(&form); err != nil || form.Token == "" {
+		sendValidationError(c, "token", "missing verification token")
+		return
+	}
+	wantsHTML := c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML
+
+	userID, err := ConsumeEmailVerificationQuery(db, hashToken(form.Token))
+	if err != nil {
+		log.Printf("[VERIFY] Invalid or expired verification token from IP=%s", c.ClientIP())
+		if wantsHTML {
+			c.Redirect(http.StatusSeeOther, "/login?verified=false")
+			return
+		}
+		sendValidationError(c, "token", "the verification link is invalid or has expired")
+		return
+	}
+
+	log.Printf("[VERIFY] Email verified for user_id=%d", userID)
+	if wantsHTML {
+		c.Redirect(http.StatusSeeOther, "/login?verified=true")
+		return
+	}
+	code := http.StatusOK
+	msg := "email address verified"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiResendVerification godoc
+// @Summary Send a new verification email
+// @Description Uses the logged-in user, or the email in the body when not logged in (block mode). The answer does not reveal whether the email exists.
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body ResendVerificationRequest false "Account email when not logged in"
+// @Success 200 {object} AuthResponse
+// @Failure 429 {object} AuthResponse
+// @Router /api/verify/resend [post]
+func apiResendVerification(c *gin.Context) {
+	var form ResendVerificationRequest
+	_ = c.ShouldBind(&form)
+
+	email := normalizeIdentifier(form.Email)
+	if user, ok := currentUser(c); ok {
+		email = user.Email
+	}
+	if email == "" {
+		sendValidationError(c, "email", "you have to enter an email address")
+		return
+	}
+
+	if !resendVerificationIPLimiter.Allow(c.ClientIP()) || !resendVerificationEmailLimiter.Allow(identifierKey(email)) {
+		log.Printf("[VERIFY] Resend rate limit hit from IP=%s", c.ClientIP())
+		code := http.StatusTooManyRequests
+		msg := "too many verification requests, try again later"
+		c.JSON(http.StatusTooManyRequests, AuthResponse{&code, &msg})
+		return
+	}
+
+	if id, username, dbEmail, _, err := GetUserByEmailQuery(db, email); err == nil {
+		verified, err := GetUserEmailVerifiedQuery(db, id)
+		if err == nil && !verified {
+			if err := sendVerificationEmail(id, username, dbEmail); err != nil {
+				log.Printf("[VERIFY] Failed to resend verification for user_id=%d: %v", id, err)
+			}
+		}
+	}
+
+	code := http.StatusOK
+	msg := "if the account exists and is unverified, a new verification link has been sent"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
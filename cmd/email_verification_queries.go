@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreateEmailVerificationQuery  func(db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error
+	ConsumeEmailVerificationQuery func(db *sql.DB, tokenHash string) (int, error)
+	GetUserEmailVerifiedQuery     func(db *sql.DB, userID int) (bool, error)
+	MarkEmailVerifiedQuery        func(db *sql.DB, userID int) error
+)
+
+// ---- Real implementations ----
+
+func realCreateEmailVerificationQuery(db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+	query := "INSERT INTO email_verifications (user_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+	_, err := db.Exec(query, userID, tokenHash, expiresAt)
+	return err
+}
+
+// realConsumeEmailVerificationQuery redeems the token and flags the user as
+// verified in one statement.
+func realConsumeEmailVerificationQuery(db *sql.DB, tokenHash string) (int, error) {
+	query := `
+WITH consumed AS (
+    UPDATE email_verifications
+    SET used_at = NOW()
+    WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+    RETURNING user_id
+)
+UPDATE users u
+SET email_verified = TRUE
+FROM consumed
+WHERE u.id = consumed.user_id
+RETURNING u.id`
+
+	var userID int
+	if err := db.QueryRow(query, tokenHash).Scan(&userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+func realGetUserEmailVerifiedQuery(db *sql.DB, userID int) (bool, error) {
+	var verified bool
+	if err := db.QueryRow("SELECT email_verified FROM users WHERE id = $1", userID).Scan(&verified); err != nil {
+		return false, err
+	}
+	return verified, nil
+}
+
+func realMarkEmailVerifiedQuery(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", userID)
+	return err
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreateEmailVerificationQuery = realCreateEmailVerificationQuery
+	ConsumeEmailVerificationQuery = realConsumeEmailVerificationQuery
+	GetUserEmailVerifiedQuery = realGetUserEmailVerifiedQuery
+	MarkEmailVerifiedQuery = realMarkEmailVerifiedQuery
+}
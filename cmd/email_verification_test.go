@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withVerificationMode(t *testing.T, mode string) {
+	t.Helper()
+	previous := emailVerificationMode
+	emailVerificationMode = mode
+	mockEmailVerified = func(int) bool { return false }
+	t.Cleanup(func() {
+		emailVerificationMode = previous
+		mockEmailVerified = nil
+	})
+}
+
+func TestRegisterSendsVerificationAndVerifyConfirms(t *testing.T) {
+	withVerificationMode(t, verificationModeLimited)
+	inbox := &MemoryMailer{}
+	mailer = inbox
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 21, nil }
+	router := setupRouter()
+
+	w := postJSON(router, "/api/register", `{"username":"newbie","email":"newbie@example.com","password":"correct horse battery","password2":"correct horse battery"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	token := tokenFromMail(t, waitForMail(t, inbox, "newbie@example.com"))
+
+	// Limited mode: logged in, but verified-only routes are refused.
+	cookie := loginAs(t, 21, "newbie")
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/sessions", nil)
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/verify?token="+token, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/sessions", nil)
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestVerifyInvalidToken(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/verify?token=bogus", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/verify?token=bogus", nil)
+	req.Header.Set("Accept", "text/html")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/login?verified=false", w.Header().Get("Location"))
+}
+
+func TestBlockModeRejectsUnverifiedLogin(t *testing.T) {
+	withVerificationMode(t, verificationModeBlock)
+	hash, _ := hashPassword("goodpw")
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 22, "blocked", "blocked@example.com", hash, nil
+	}
+	router := setupRouter()
+
+	w := postJSON(router, "/api/login", `{"username":"blocked","password":"goodpw"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	resp := decode[HTTPValidationError](t, w.Body.Bytes())
+	assert.Equal(t, "email", resp.Detail[0].Loc[0])
+}
+
+func TestResendVerification(t *testing.T) {
+	withVerificationMode(t, verificationModeBlock)
+	inbox := &MemoryMailer{}
+	mailer = inbox
+	mockGetUserByEmailQuery = func(_ *sql.DB, e string) (int, string, string, string, error) {
+		return 23, "resend", e, "hash", nil
+	}
+	router := setupRouter()
+
+	w := postJSON(router, "/api/verify/resend", `{"email":"resend@example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	waitForMail(t, inbox, "resend@example.com")
+}
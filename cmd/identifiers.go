@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Usernames and emails are stored as entered, but NFKC-normalized, and are
+// unique regardless of case: the users table has unique indexes on
+// lower(normalize(column, NFKC)) and every lookup compares the same
+// expression. So "Admin", "admin" and "ａｄｍｉｎ" (fullwidth) are one account.
+
+// normalizeIdentifier trims and NFKC-normalizes a username or email before it
+// is stored or looked up.
+func normalizeIdentifier(s string) string {
+	return norm.NFKC.String(strings.TrimSpace(s))
+}
+
+// identifierKey case-folds a normalized identifier for in-memory keys
+// (throttles, rate limits) and comparisons that never reach the database.
+// It is not the same function as the database's lower(), which depends on
+// the collation, so queries pass the raw value and let SQL apply
+// lower(normalize($1, NFKC)) itself. A Caser is not safe for concurrent use,
+// hence a fresh one per call.
+func identifierKey(s string) string {
+	return norm.NFKC.String(cases.Fold().String(normalizeIdentifier(s)))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifierKey(t *testing.T) {
+	assert.Equal(t, "admin", identifierKey("  Admin "))
+	assert.Equal(t, "admin", identifierKey("ａｄｍｉｎ")) // fullwidth
+	assert.Equal(t, identifierKey("Bob@Example.COM"), identifierKey("bob@example.com"))
+	assert.Equal(t, identifierKey("café"), identifierKey("café"))     // precomposed vs combining accent
+	assert.Equal(t, identifierKey("STRASSE"), identifierKey("straße")) // full case folding, not just lower-casing
+	assert.Equal(t, accountThrottleKey("ADMIN"), accountThrottleKey("admin"))
+
+	// Case is kept for display, only the Unicode form is normalized.
+	assert.Equal(t, "Café", normalizeIdentifier(" Café "))
+}
+
+func TestRegisterNormalizesIdentifiers(t *testing.T) {
+	var gotUsername, gotEmail string
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) {
+		gotUsername, gotEmail = u, e
+		return 121, nil
+	}
+	router := setupRouter()
+
+	w := postJSON(router, "/api/register", `{"username":" Ｊｏｓé ","email":"José@Example.com","password":"correct horse battery","password2":"correct horse battery"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "José", gotUsername)
+	assert.Equal(t, "José@Example.com", gotEmail)
+}
+
+func TestChangeEmailIgnoresCase(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 122, "caser")
+
+	w := postJSON(router, "/api/account/email", `{"current_password":"x","email":"CASER@Example.com"}`, cookie)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "that is already your email address", decode[HTTPValidationError](t, w.Body.Bytes()).Detail[0].Msg)
+}
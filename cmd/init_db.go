@@ -2,7 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,12 +23,36 @@ CREATE TABLE IF NOT EXISTS users (
 		return err
 	}
 
+	// Accounts that existed before email verification are treated as verified;
+	// the column default is flipped afterwards so new signups start unverified.
+	usersEmailVerified := `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT FALSE;`
+
+	if _, err := db.Exec(usersEmailVerified); err != nil {
+		return err
+	}
+
+	// Roles. The first admin is named with ADMIN_BOOTSTRAP_USER, see bootstrapAdmin.
+	usersRole := `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';`
+
+	if _, err := db.Exec(usersRole); err != nil {
+		return err
+	}
+
+	// Case-insensitive usernames and emails (see identifiers.go and
+	// migrations/003_case_insensitive_users.sql).
+	if err := ensureUserIdentifierIndexes(db); err != nil {
+		return err
+	}
+
 	pagesTable := `
 CREATE TABLE IF NOT EXISTS pages (
   id BIGSERIAL PRIMARY KEY,
   title TEXT NOT NULL,
   url TEXT NOT NULL UNIQUE,
-  language TEXT NOT NULL CHECK (language IN ('en', 'da')) DEFAULT 'en',
+  language TEXT NOT NULL DEFAULT 'en' CONSTRAINT pages_language_code_check CHECK (language ~ '^[a-z]{2,3}$'),
   last_updated TIMESTAMPTZ,
   content TEXT NOT NULL,
   tsv_document tsvector
@@ -35,28 +62,264 @@ CREATE TABLE IF NOT EXISTS pages (
 		return err
 	}
 
+	// Older databases only allow 'en' and 'da'; languages now come from the
+	// registry in languages.go, so only the shape of the code is checked.
+	pagesLanguageCheck := `
+DO $$
+BEGIN
+  IF NOT EXISTS (
+    SELECT 1 FROM pg_constraint
+    WHERE conrelid = 'pages'::regclass AND conname = 'pages_language_code_check'
+  ) THEN
+    ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_language_check;
+    ALTER TABLE pages ADD CONSTRAINT pages_language_code_check CHECK (language ~ '^[a-z]{2,3}$');
+  END IF;
+END$$;`
+
+	if _, err := db.Exec(pagesLanguageCheck); err != nil {
+		return err
+	}
+
+	sessionsTable := `
+CREATE TABLE IF NOT EXISTS sessions (
+  id TEXT PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_seen TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ,
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  browser TEXT NOT NULL DEFAULT '',
+  browser_version TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id
+  ON sessions (user_id) WHERE revoked_at IS NULL;`
+
+	if _, err := db.Exec(sessionsTable); err != nil {
+		return err
+	}
+
+	passwordResetsTable := `
+CREATE TABLE IF NOT EXISTS password_resets (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ
+);`
+
+	if _, err := db.Exec(passwordResetsTable); err != nil {
+		return err
+	}
+
+	emailVerificationsTable := `
+CREATE TABLE IF NOT EXISTS email_verifications (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ
+);`
+
+	if _, err := db.Exec(emailVerificationsTable); err != nil {
+		return err
+	}
+
+	twoFactorTables := `
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  confirmed_at TIMESTAMPTZ,
+  last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ,
+  UNIQUE (user_id, code_hash)
+);`
+
+	if _, err := db.Exec(twoFactorTables); err != nil {
+		return err
+	}
+
+	identitiesTable := `
+CREATE TABLE IF NOT EXISTS user_identities (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (issuer, subject)
+);`
+
+	if _, err := db.Exec(identitiesTable); err != nil {
+		return err
+	}
+
+	apiKeysTable := `
+CREATE TABLE IF NOT EXISTS api_keys (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL UNIQUE,
+  key_hash TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id
+  ON api_keys (user_id) WHERE revoked_at IS NULL;`
+
+	if _, err := db.Exec(apiKeysTable); err != nil {
+		return err
+	}
+
+	invitationsTable := `
+CREATE TABLE IF NOT EXISTS invitations (
+  id BIGSERIAL PRIMARY KEY,
+  code_hash TEXT NOT NULL UNIQUE,
+  note TEXT NOT NULL DEFAULT '',
+  created_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+  max_uses INTEGER NOT NULL CHECK (max_uses > 0),
+  uses INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  revoked_at TIMESTAMPTZ
+);`
+
+	if _, err := db.Exec(invitationsTable); err != nil {
+		return err
+	}
+
+	refreshTokensTable := `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  family_id TEXT NOT NULL,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id) WHERE revoked_at IS NULL;`
+
+	if _, err := db.Exec(refreshTokensTable); err != nil {
+		return err
+	}
+
+	// Security audit log. actor_id/target_id are not foreign keys so events
+	// outlive deleted accounts, and a trigger refuses UPDATE, DELETE and
+	// TRUNCATE: rows can only be appended, pseudonymized or purged once old.
+	auditEventsTable := `
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  event TEXT NOT NULL,
+  actor_id BIGINT,
+  actor_name TEXT NOT NULL DEFAULT '',
+  target_id BIGINT,
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  details JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_event ON audit_events (event, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id, id);
+-- The ?actor= filter and pseudonymizing a deleted account match the name
+-- with lower(actor_name).
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_name ON audit_events (lower(actor_name), id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_occurred_at ON audit_events (occurred_at);
+
+-- Two exceptions: pseudonymizing an event (only who, where and the details
+-- may be blanked) and purging events past the minimum retention of 90 days.
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE'
+     AND NEW.id = OLD.id AND NEW.occurred_at = OLD.occurred_at AND NEW.event = OLD.event
+     AND NEW.actor_id IS NOT DISTINCT FROM OLD.actor_id AND NEW.target_id IS NOT DISTINCT FROM OLD.target_id
+     AND NEW.actor_name = '' AND NEW.ip = '' AND NEW.user_agent = '' AND NEW.details IS NULL THEN
+    RETURN NEW;
+  END IF;
+  IF TG_OP = 'DELETE' AND OLD.occurred_at < NOW() - INTERVAL '90 days' THEN
+    RETURN OLD;
+  END IF;
+  RAISE EXCEPTION 'audit_events is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_no_update ON audit_events;
+CREATE TRIGGER audit_events_no_update
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+CREATE TRIGGER audit_events_no_truncate
+BEFORE TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();`
+
+	if _, err := db.Exec(auditEventsTable); err != nil {
+		return err
+	}
+
+	// Popular searches for /api/suggest, one row per normalized query.
+	searchQueriesTable := `
+CREATE TABLE IF NOT EXISTS search_queries (
+  language TEXT NOT NULL,
+  query TEXT NOT NULL,
+  hits BIGINT NOT NULL DEFAULT 1,
+  last_searched_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (language, query)
+);
+
+CREATE INDEX IF NOT EXISTS idx_search_queries_prefix
+  ON search_queries (language, query text_pattern_ops);
+
+-- Popularity is the number of distinct clients: one row per query and
+-- salted client hash, the salt changing daily (see searchClientKey).
+ALTER TABLE search_queries ADD COLUMN IF NOT EXISTS clients BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS search_query_clients (
+  language TEXT NOT NULL,
+  query TEXT NOT NULL,
+  client TEXT NOT NULL,
+  seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (language, query, client)
+);
+
+CREATE INDEX IF NOT EXISTS idx_search_query_clients_seen_at ON search_query_clients (seen_at);`
+
+	if _, err := db.Exec(searchQueriesTable); err != nil {
+		return err
+	}
+
 	// 3) Enable search extensions, trigger, and indexes (idempotent)
 	ftsSetup := `
 CREATE EXTENSION IF NOT EXISTS pg_trgm;
 
+-- The configuration comes from search_languages (see syncSearchLanguages);
+-- languages that are not registered use 'simple'.
 CREATE OR REPLACE FUNCTION pages_tsvector_update() RETURNS trigger AS $$
+DECLARE
+  cfg regconfig := COALESCE(
+    (SELECT regconfig FROM search_languages WHERE code = NEW.language),
+    'simple'::regconfig);
 BEGIN
   NEW.tsv_document :=
-    setweight(
-      to_tsvector(
-        (CASE NEW.language WHEN 'da' THEN 'danish' ELSE 'english' END)::regconfig,
-        coalesce(NEW.title, '')
-      ),
-      'A'
-    )
+    setweight(to_tsvector(cfg, coalesce(NEW.title, '')), 'A')
     ||
-    setweight(
-      to_tsvector(
-        (CASE NEW.language WHEN 'da' THEN 'danish' ELSE 'english' END)::regconfig,
-        coalesce(NEW.content, '')
-      ),
-      'B'
-    );
+    setweight(to_tsvector(cfg, coalesce(NEW.content, '')), 'B');
   RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -84,16 +347,38 @@ CREATE INDEX IF NOT EXISTS idx_pages_last_updated
 		return err
 	}
 
+	if err := syncSearchLanguages(db); err != nil {
+		return err
+	}
+
+	// Words of the indexed pages for "did you mean", rebuilt by
+	// refreshVocabulary. The trigram index finds close spellings.
+	vocabularyTable := `
+CREATE TABLE IF NOT EXISTS search_vocabulary (
+  language TEXT NOT NULL,
+  word TEXT NOT NULL,
+  ndoc INTEGER NOT NULL,
+  PRIMARY KEY (language, word)
+);
+
+CREATE INDEX IF NOT EXISTS idx_search_vocabulary_trgm
+  ON search_vocabulary USING GIN (word gin_trgm_ops);`
+
+	if _, err := db.Exec(vocabularyTable); err != nil {
+		return err
+	}
+
 	// 4) Seed admin user (SQLite: INSERT OR IGNORE -> PostgreSQL: ON CONFLICT DO NOTHING)
 	seedAdmin := `
-INSERT INTO users (username, email, password)
-VALUES ($1, $2, $3)
-ON CONFLICT (username) DO NOTHING;`
+INSERT INTO users (username, email, password, email_verified)
+VALUES ($1, $2, $3, TRUE)
+ON CONFLICT DO NOTHING;`
 
-	// NOTE: If you want to prevent duplicates by email as well, you can also choose:
-	// ON CONFLICT DO NOTHING
-	// but then you can't target a specific constraint/column set.
-	if _, err := db.Exec(seedAdmin, "admin", "keamonk1@stud.kea.dk", "5f4dcc3b5aa765d61d8327deb882cf99"); err != nil {
+	// Any conflict skips the seed: besides the plain UNIQUE constraints, the
+	// case-insensitive indexes also count "Admin" as the same user. Despite
+	// the name it is an ordinary user, and it has no password until someone
+	// sets one through the password reset flow.
+	if _, err := db.Exec(seedAdmin, seededAdminUsername, "keamonk1@stud.kea.dk", passwordResetRequired); err != nil {
 		return err
 	}
 
@@ -135,6 +420,151 @@ ON CONFLICT (url) DO NOTHING;`)
 	return nil
 }
 
+// ensureUserIdentifierIndexes creates the unique indexes on the normalized,
+// lower-cased username and email. Existing accounts that would collide are
+// logged and startup fails: running without the index would keep letting
+// "Admin" register next to "admin". Merge or rename the listed accounts
+// (see migrations/003_case_insensitive_users.sql) and start again.
+func ensureUserIdentifierIndexes(db *sql.DB) error {
+	for _, column := range []string{"username", "email"} {
+		collisions, err := findUserCollisions(db, column)
+		if err != nil {
+			return err
+		}
+		if len(collisions) > 0 {
+			for _, c := range collisions {
+				log.Printf("[INITDB] Users %v share the %s %q when case is ignored", c.ids, column, c.key)
+			}
+			return fmt.Errorf("cannot create the case-insensitive unique %s index: resolve the %d collision(s) logged above", column, len(collisions))
+		}
+
+		// column is one of the two literals above, never user input.
+		query := "CREATE UNIQUE INDEX IF NOT EXISTS users_" + column + "_ci_key ON users (lower(normalize(" + column + ", NFKC)))"
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type userCollision struct {
+	key string
+	ids []int64
+}
+
+func findUserCollisions(db *sql.DB, column string) ([]userCollision, error) {
+	query := `
+SELECT lower(normalize(` + column + `, NFKC)) AS key, array_agg(id ORDER BY id)::text
+FROM users
+GROUP BY 1
+HAVING COUNT(*) > 1
+ORDER BY 1`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	var collisions []userCollision
+	for rows.Next() {
+		var c userCollision
+		var ids string
+		if err := rows.Scan(&c.key, &ids); err != nil {
+			return nil, err
+		}
+		for _, part := range strings.Split(strings.Trim(ids, "{}"), ",") {
+			id, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			c.ids = append(c.ids, id)
+		}
+		collisions = append(collisions, c)
+	}
+	return collisions, rows.Err()
+}
+
+// syncSearchLanguages makes the search_languages table match the registry
+// and re-indexes the pages of every language whose configuration changed,
+// by touching them so pages_tsvector_trigger runs again.
+func syncSearchLanguages(db *sql.DB) error {
+	if _, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS search_languages (
+  code TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  regconfig REGCONFIG NOT NULL
+);`); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("tx.Rollback failed: %v", err)
+		}
+	}()
+
+	rows, err := tx.Query("SELECT code, regconfig::text FROM search_languages")
+	if err != nil {
+		return err
+	}
+	previous := map[string]string{}
+	for rows.Next() {
+		var code, cfg string
+		if err := rows.Scan(&code, &cfg); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		previous[code] = cfg
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	var changed []string
+	registered := map[string]bool{}
+	for _, l := range searchLanguages {
+		registered[l.Code] = true
+		if _, err := tx.Exec(`
+INSERT INTO search_languages (code, name, regconfig) VALUES ($1, $2, $3::regconfig)
+ON CONFLICT (code) DO UPDATE SET name = EXCLUDED.name, regconfig = EXCLUDED.regconfig`,
+			l.Code, l.Name, l.RegConfig); err != nil {
+			return err
+		}
+		if cfg, ok := previous[l.Code]; !ok || cfg != l.RegConfig {
+			changed = append(changed, l.Code)
+		}
+	}
+	for code := range previous {
+		if registered[code] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM search_languages WHERE code = $1", code); err != nil {
+			return err
+		}
+		changed = append(changed, code)
+	}
+
+	if len(changed) > 0 {
+		res, err := tx.Exec("UPDATE pages SET language = language WHERE language = ANY($1::text[])", changed)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Printf("[INITDB] Re-indexed %d page(s) for changed languages %v", n, changed)
+		}
+	}
+	return tx.Commit()
+}
+
 func getPageSeedData() []Page {
 	return []Page{
 		{"Go Basics", "https://go.dev/doc/tutorial/getting-started", "en", time.Time{}, "Go is a statically typed, compiled programming language designed at Google. Learn the basics of packages, functions, and goroutines."},
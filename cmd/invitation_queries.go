@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type Invitation struct {
+	ID        int64      `json:"id"`
+	CodeHash  string     `json:"-"`
+	Note      string     `json:"note"`
+	CreatedBy int        `json:"created_by"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreateInvitationQuery  func(db *sql.DB, inv Invitation) (int64, error)
+	ListInvitationsQuery   func(db *sql.DB) ([]Invitation, error)
+	RevokeInvitationQuery  func(db *sql.DB, id int64) (bool, error)
+	ClaimInvitationQuery   func(db *sql.DB, codeHash string) (int64, error)
+	ReleaseInvitationQuery func(db *sql.DB, id int64) error
+)
+
+// ---- Real implementations ----
+
+func realCreateInvitationQuery(db *sql.DB, inv Invitation) (int64, error) {
+	query := "INSERT INTO invitations (code_hash, note, created_by, max_uses, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	var id int64
+	err := db.QueryRow(query, inv.CodeHash, inv.Note, inv.CreatedBy, inv.MaxUses, inv.ExpiresAt).Scan(&id)
+	return id, err
+}
+
+func realListInvitationsQuery(db *sql.DB) ([]Invitation, error) {
+	query := `
+SELECT id, note, created_by, max_uses, uses, expires_at, created_at, revoked_at
+FROM invitations
+ORDER BY created_at DESC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		var createdBy sql.NullInt64
+		var revoked sql.NullTime
+		if err := rows.Scan(&inv.ID, &inv.Note, &createdBy, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedAt, &revoked); err != nil {
+			return nil, err
+		}
+		inv.CreatedBy = int(createdBy.Int64)
+		if revoked.Valid {
+			inv.RevokedAt = &revoked.Time
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func realRevokeInvitationQuery(db *sql.DB, id int64) (bool, error) {
+	res, err := db.Exec("UPDATE invitations SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// realClaimInvitationQuery uses up one use of a valid code in a single
+// statement, so two signups cannot both take the last use. It returns
+// sql.ErrNoRows for unknown, revoked, expired or used-up codes.
+func realClaimInvitationQuery(db *sql.DB, codeHash string) (int64, error) {
+	query := `
+UPDATE invitations SET uses = uses + 1
+WHERE code_hash = $1 AND revoked_at IS NULL AND expires_at > NOW() AND uses < max_uses
+RETURNING id`
+
+	var id int64
+	err := db.QueryRow(query, codeHash).Scan(&id)
+	return id, err
+}
+
+// realReleaseInvitationQuery gives a use back when the signup failed after claiming it.
+func realReleaseInvitationQuery(db *sql.DB, id int64) error {
+	_, err := db.Exec("UPDATE invitations SET uses = uses - 1 WHERE id = $1 AND uses > 0", id)
+	return err
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreateInvitationQuery = realCreateInvitationQuery
+	ListInvitationsQuery = realListInvitationsQuery
+	RevokeInvitationQuery = realRevokeInvitationQuery
+	ClaimInvitationQuery = realClaimInvitationQuery
+	ReleaseInvitationQuery = realReleaseInvitationQuery
+}
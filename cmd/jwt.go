@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Minimal JWT/JWKS support (RS256 only), enough to verify OpenID Connect ID
+// tokens and to issue and verify our own access tokens.
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwtAudience accepts both the string and the array form of the "aud" claim.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a jwtAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// splitJWT decodes the header and returns the raw claims and signature.
+func splitJWT(token string) (jwtHeader, []byte, []byte, string, error) {
+	var header jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, nil, "", errInvalidJWT
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, nil, "", errInvalidJWT
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return header, nil, nil, "", errInvalidJWT
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, nil, "", errInvalidJWT
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, nil, "", errInvalidJWT
+	}
+	return header, claims, sig, parts[0] + "." + parts[1], nil
+}
+
+// signRS256 returns a compact JWT with the given header type and claims.
+func signRS256(key *rsa.PrivateKey, kid, typ string, claims any) (string, error) {
+	rawHeader, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid, Typ: typ})
+	if err != nil {
+		return "", err
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// publicJWK describes the public half of key for a JWKS document.
+func publicJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// rsaKeySource finds the RSA public key for a JWT kid: a provider's JWKS or
+// our own tokenKeyring.
+type rsaKeySource interface {
+	rsaKey(kid string) (*rsa.PublicKey, error)
+}
+
+// verifyRS256 checks token against the RSA key in keys matching its kid and
+// decodes the claims into v.
+func verifyRS256(token string, keys rsaKeySource, v any) error {
+	header, claims, sig, signingInput, err := splitJWT(token)
+	if err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return errors.New("unsupported JWT alg " + header.Alg)
+	}
+	pub, err := keys.rsaKey(header.Kid)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return errInvalidJWT
+	}
+	if err := json.Unmarshal(claims, v); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+func (s JWKS) rsaKey(kid string) (*rsa.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.Kty != "RSA" || (kid != "" && k.Kid != kid) {
+			continue
+		}
+		return k.rsaPublicKey()
+	}
+	return nil, errors.New("no RSA key for kid " + kid)
+}
+
+func (k JWK) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
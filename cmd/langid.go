@@ -0,0 +1,181 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"WHOKNOWS_VARIATIONS/util"
+	"github.com/gin-gonic/gin"
+)
+
+// Language identification is a naive Bayes classifier over character 1- to
+// 4-grams of the lower-cased words (util.TextGrams). The profiles in
+// data/langid/profiles.json are trained offline by tools/langidgen from the
+// operating system's gettext translations (nine to thirty thousand messages
+// per language) plus our own pages and query log, and ship inside the
+// binary; testdata/langid holds text left out of training, which the tests
+// measure accuracy on. A language without a profile can still be searched,
+// it is just never detected.
+//
+// Naive Bayes treats every gram as independent evidence, but the grams of a
+// word overlap and are not: each counts as langidGramWeight of one, and a
+// long text as at most maxLangidEvidence grams. That keeps the
+// probabilities of short queries honest.
+//
+//go:generate go run ../tools/langidgen -out data/langid/profiles.json -heldout testdata/langid
+const (
+	maxLangidEvidence = 80
+	langidGramWeight  = 0.3
+	langidSmoothing   = 0.5
+	// defaultLanguagePrior is how much likelier the default language is
+	// up front; it settles queries like "golang" that no profile covers.
+	defaultLanguagePrior = 3.0
+)
+
+// maxLanguageDetectBody bounds POST /api/languages/detect; only the first
+// util.LangidMaxText runes are looked at anyway, which is at most 40 KB of
+// UTF-8 before JSON escaping.
+const maxLanguageDetectBody = 64 << 10
+
+// languageDetectLimiter bounds detection requests per client IP. The
+// endpoint needs no login or CSRF token (the page importer has neither), so
+// this is what keeps it from being used to load the server.
+var languageDetectLimiter = newRateLimiter(120, time.Minute)
+
+//go:embed data/langid/profiles.json
+var langidProfiles []byte
+
+type languageProfile struct {
+	code    string
+	logProb map[string]float64
+	unseen  float64 // log probability of a gram missing from the profile
+}
+
+// languageScore is the probability that a text is in a language.
+type languageScore struct {
+	Language    string  `json:"language"`
+	Probability float64 `json:"probability"`
+}
+
+var languageProfiles = sync.OnceValue(func() []languageProfile {
+	var trained map[string]util.LangidProfile
+	if err := json.Unmarshal(langidProfiles, &trained); err != nil {
+		log.Printf("[LANGID] Failed to load the language profiles: %v", err)
+		return nil
+	}
+	vocabulary := map[string]struct{}{}
+	for _, t := range trained {
+		for g := range t.Grams {
+			vocabulary[g] = struct{}{}
+		}
+	}
+
+	var profiles []languageProfile
+	for _, l := range searchLanguages {
+		t, ok := trained[l.Code]
+		if !ok {
+			continue
+		}
+		denom := float64(t.Total) + langidSmoothing*float64(len(vocabulary))
+		p := languageProfile{code: l.Code, logProb: make(map[string]float64, len(t.Grams)), unseen: math.Log(langidSmoothing / denom)}
+		for g, n := range t.Grams {
+			p.logProb[g] = math.Log((float64(n) + langidSmoothing) / denom)
+		}
+		profiles = append(profiles, p)
+	}
+	log.Printf("[LANGID] Loaded %d language profiles", len(profiles))
+	return profiles
+})
+
+// identifyLanguage returns every language with a profile, most probable
+// first; the probabilities add up to 1. A text without letters gives nil.
+// Ties keep registry order.
+func identifyLanguage(text string) []languageScore {
+	grams := util.TextGrams(text)
+	profiles := languageProfiles()
+	if len(grams) == 0 || len(profiles) == 0 {
+		return nil
+	}
+
+	weight := langidGramWeight
+	if len(grams) > maxLangidEvidence {
+		weight *= maxLangidEvidence / float64(len(grams))
+	}
+	logLik := make([]float64, len(profiles))
+	best := math.Inf(-1)
+	for i, p := range profiles {
+		for _, g := range grams {
+			lp, ok := p.logProb[g]
+			if !ok {
+				lp = p.unseen
+			}
+			logLik[i] += lp
+		}
+		logLik[i] *= weight
+		if p.code == defaultLanguage {
+			logLik[i] += math.Log(defaultLanguagePrior)
+		}
+		best = math.Max(best, logLik[i])
+	}
+
+	// Softmax, shifted by the best score so the exponentials do not underflow.
+	scores := make([]languageScore, len(profiles))
+	sum := 0.0
+	for i, p := range profiles {
+		e := math.Exp(logLik[i] - best)
+		scores[i] = languageScore{Language: p.code, Probability: e}
+		sum += e
+	}
+	for i := range scores {
+		scores[i].Probability /= sum
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Probability > scores[j].Probability })
+	return scores
+}
+
+type LanguageDetectionRequest struct {
+	Text string `json:"text"`
+}
+
+// apiDetectLanguage godoc
+// @Summary Identify the language of a text
+// @Description The same identifier that picks the search language; the page importer uses it to label pages. reliable is false when the text could as well be in another language.
+// @Tags Search
+// @Accept json
+// @Produce json
+// @Param request body LanguageDetectionRequest true "Text to identify, e.g. a page title and content; only the first 10000 characters count"
+// @Success 200 {object} LanguageDetectionResponse
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} AuthResponse
+// @Router /api/languages/detect [post]
+func apiDetectLanguage(c *gin.Context) {
+	if !languageDetectLimiter.Allow(c.ClientIP()) {
+		code := http.StatusTooManyRequests
+		msg := "too many language detection requests, try again later"
+		c.JSON(http.StatusTooManyRequests, AuthResponse{&code, &msg})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxLanguageDetectBody)
+	var req LanguageDetectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendValidationError(c, "text", "text is required and must be at most 64 KiB")
+		return
+	}
+	scores := identifyLanguage(req.Text)
+	if len(scores) == 0 {
+		sendValidationError(c, "text", "text has no letters to identify a language from")
+		return
+	}
+	c.JSON(http.StatusOK, LanguageDetectionResponse{
+		Language:   scores[0].Language,
+		Confidence: scores[0].Probability,
+		Reliable:   scores[0].Probability >= minLanguageConfidence,
+		Scores:     scores,
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifyLanguage(t *testing.T) {
+	tests := []struct{ text, want string }{
+		{"why does my code not work", "en"},
+		{"hvorfor virker min kode ikke", "da"},
+		{"jeg får ikke koden til å fungere", "no"},
+		{"varför fungerar inte min kod", "sv"},
+		{"warum funktioniert mein Code nicht", "de"},
+		{"søgemaskine", "da"},
+		{"søkemotor", "no"},
+		{"golang", "en"},
+		{"Jeg heter Kari og bor i Oslo. Jeg jobber som utvikler og liker å gå på tur i skogen.", "no"},
+		{"Hej med dig, jeg hedder Peter og jeg bor i København. Jeg arbejder som udvikler.", "da"},
+	}
+	for _, tt := range tests {
+		scores := identifyLanguage(tt.text)
+		if assert.NotEmpty(t, scores, tt.text) {
+			assert.Equal(t, tt.want, scores[0].Language, tt.text)
+		}
+	}
+}
+
+// readHeldOut reads text tools/langidgen left out of training, one per line.
+func readHeldOut(t *testing.T, name string) []string {
+	t.Helper()
+	raw, err := os.ReadFile("testdata/langid/" + name + ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(raw)), "\n")
+}
+
+func TestIdentifyLanguageHeldOut(t *testing.T) {
+	right, total := 0, 0
+	var sure, sureRight, sureGroup, sureGroupRight int
+	for _, l := range searchLanguages {
+		lines := readHeldOut(t, l.Code)
+		correct := 0
+		for _, line := range lines {
+			if scores := identifyLanguage(line); len(scores) > 0 && scores[0].Language == l.Code {
+				correct++
+			}
+
+			// The first one to three words stand in for queries, to check
+			// the confidence thresholds against.
+			words := strings.Fields(line)
+			for n := 1; n <= 3; n++ {
+				scores := identifyLanguage(strings.Join(words[:min(n, len(words))], " "))
+				if len(scores) == 0 {
+					continue
+				}
+				best := scores[0]
+				if best.Probability >= minLanguageConfidence {
+					sure++
+					if best.Language == l.Code {
+						sureRight++
+					}
+				}
+				if bl, _ := lookupLanguage(best.Language); bl.Group != "" && best.Probability >= minGroupLanguageConfidence {
+					sureGroup++
+					if best.Language == l.Code {
+						sureGroupRight++
+					}
+				}
+			}
+		}
+		accuracy := float64(correct) / float64(len(lines))
+		t.Logf("%s: %.1f%% of %d held-out sentences", l.Code, 100*accuracy, len(lines))
+		assert.GreaterOrEqual(t, accuracy, 0.92, l.Code)
+		right += correct
+		total += len(lines)
+	}
+	assert.GreaterOrEqual(t, float64(right)/float64(total), 0.95)
+	assert.GreaterOrEqual(t, float64(sureRight)/float64(sure), 0.93, "detections above minLanguageConfidence")
+	assert.GreaterOrEqual(t, float64(sureGroupRight)/float64(sureGroup), 0.97, "group detections above minGroupLanguageConfidence")
+}
+
+func TestPastQueriesSearchEnglish(t *testing.T) {
+	// The query log is English; held-out queries, names and all, should
+	// nearly always search English pages.
+	queries := readHeldOut(t, "queries-en")
+	searched := 0
+	for _, q := range queries {
+		if slices.Contains(resolveLanguages(q, "").Codes, "en") {
+			searched++
+		}
+	}
+	assert.GreaterOrEqual(t, float64(searched)/float64(len(queries)), 0.9)
+}
+
+func TestIdentifyLanguageScores(t *testing.T) {
+	scores := identifyLanguage("Rust is a systems programming language focusing on safety and performance.")
+	assert.Len(t, scores, len(searchLanguages))
+	sum := 0.0
+	for i, s := range scores {
+		sum += s.Probability
+		if i > 0 {
+			assert.LessOrEqual(t, s.Probability, scores[i-1].Probability)
+		}
+	}
+	assert.InDelta(t, 1, sum, 1e-9)
+	assert.Greater(t, scores[0].Probability, 0.99)
+
+	// Evidence is capped: a thousand times an ambiguous word is no proof.
+	long := identifyLanguage(strings.Repeat("og ", 1000))
+	assert.Less(t, long[0].Probability, 0.99)
+
+	assert.Nil(t, identifyLanguage("2024 -- 42"))
+}
+
+func TestDetectLanguageEndpoint(t *testing.T) {
+	router := setupRouter()
+
+	// No CSRF token: the importer calls this without a browser session.
+	req := httptest.NewRequest("POST", "/api/languages/detect", strings.NewReader(`{"text":"Wie installiere ich die neueste Version des Programms?"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[LanguageDetectionResponse](t, w.Body.Bytes())
+	assert.Equal(t, "de", resp.Language)
+	assert.True(t, resp.Reliable)
+	assert.Len(t, resp.Scores, len(searchLanguages))
+
+	resp = decode[LanguageDetectionResponse](t, postJSON(router, "/api/languages/detect", `{"text":"og"}`).Body.Bytes())
+	assert.False(t, resp.Reliable)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, postJSON(router, "/api/languages/detect", `{"text":"1234"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, postJSON(router, "/api/languages/detect", `not json`).Code)
+}
+
+func TestDetectLanguageRateLimit(t *testing.T) {
+	router := setupRouter()
+	for i := 0; i < 120; i++ {
+		assert.Equal(t, http.StatusOK, postJSON(router, "/api/languages/detect", `{"text":"hello"}`).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(router, "/api/languages/detect", `{"text":"hello"}`).Code)
+
+	// The body is capped well below what used to be accepted.
+	router = setupRouter()
+	big := `{"text":"` + strings.Repeat("a", 65<<10) + `"}`
+	assert.Equal(t, http.StatusUnprocessableEntity, postJSON(router, "/api/languages/detect", big).Code)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveLanguages(t *testing.T) {
+	tests := []struct {
+		query, param string
+		want         []string
+	}{
+		{"anything", "Danish", []string{"da"}},
+		{"anything", "sv", []string{"sv"}},
+		{"anything", "GERMAN", []string{"de"}},
+		{"anything", "fr", []string{"fr"}}, // not registered: searched with 'simple'
+		{"hvad er det", "klingon", []string{"da"}},
+		{"how does it work", "", []string{"en"}},
+		{"hur fungerar det", "", []string{"sv"}},
+		{"wie funktioniert das", "", []string{"de"}},
+		{"hva er dette", "", []string{"no"}},
+		{"rødgrød med fløde", "", []string{"da"}},
+		{"straße", "", []string{"de"}},
+		{"12345", "", []string{"en"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, resolveLanguages(tt.query, tt.param).Codes, tt.query+" / "+tt.param)
+	}
+}
+
+func TestResolveLanguagesSearchesGroupWhenUnsure(t *testing.T) {
+	// "og" is as much Norwegian as it is Danish, and Swedish is close enough
+	// to be searched along.
+	choice := resolveLanguages("og", "")
+	assert.True(t, choice.Detected)
+	assert.Less(t, choice.Confidence, minLanguageConfidence)
+	assert.ElementsMatch(t, []string{"da", "no", "sv"}, choice.Codes)
+
+	choice = resolveLanguages("og", "no")
+	assert.False(t, choice.Detected)
+	assert.Equal(t, []string{"no"}, choice.Codes)
+}
+
+func TestResolveLanguagesFindsDanishQueries(t *testing.T) {
+	// Real Danish queries that read as Norwegian (or Swedish) to the
+	// identifier still search Danish pages.
+	for _, q := range []string{
+		"hvordan virker kubernetes",
+		"programmeringssprog",
+		"databaser",
+		"hvordan fungerer det",
+		"hvorfor er himlen blå",
+		"hvordan lærer jeg at programmere",
+	} {
+		assert.Contains(t, resolveLanguages(q, "").Codes, "da", q)
+	}
+
+	// Spelling that gives the language away still searches it alone.
+	assert.Equal(t, []string{"da"}, resolveLanguages("hvad er det", "").Codes)
+	assert.Equal(t, []string{"no"}, resolveLanguages("hva er en database", "").Codes)
+	assert.Equal(t, []string{"sv"}, resolveLanguages("vad är en databas", "").Codes)
+}
+
+func TestResolveAllLanguages(t *testing.T) {
+	choice := resolveLanguages("hvad er det", " All ")
+	assert.True(t, choice.All)
+	assert.False(t, choice.Detected)
+	assert.Equal(t, []string{"en", "da", "no", "sv", "de"}, choice.Codes)
+	assert.Equal(t, "all", choice.key())
+	assert.Equal(t, "no,da,sv", resolveLanguages("og", "").key())
+}
+
+func TestSearchBranches(t *testing.T) {
+	var args []any
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	branches := searchBranches(SearchParams{Languages: []string{"da", "fr"}, AllLanguages: true}, bind)
+	assert.Equal(t, []searchBranch{
+		{filter: "p.language = $1", code: "$1", regConfig: "$2::regconfig"},
+		{filter: "p.language = $3", code: "$3", regConfig: "$4::regconfig"},
+		{filter: "NOT (p.language = ANY($5::text[]))", regConfig: "$6::regconfig"},
+	}, branches)
+	assert.Equal(t, []any{"da", "danish", "fr", fallbackRegConfig, []string{"da", "fr"}, fallbackRegConfig}, args)
+
+	args = nil
+	assert.Len(t, searchBranches(SearchParams{Languages: []string{"en"}}, bind), 1, "no catch-all unless all languages are searched")
+}
+
+func TestSearchAllLanguages(t *testing.T) {
+	var seen []SearchParams
+	mockSearchPagesQuery = func(_ *sql.DB, p SearchParams) (SearchPage, error) {
+		seen = append(seen, p)
+		return SearchPage{Results: []SearchResult{
+			{ID: 1, Title: "Docker på dansk", Language: "da"},
+			{ID: 2, Title: "Docker tutorial", Language: "en"},
+		}, Total: 2}, nil
+	}
+	router := setupRouter()
+
+	w := sendJSON(router, "GET", "/api/search?q=docker&language=all", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[SearchResponse](t, w.Body.Bytes())
+	assert.Equal(t, []string{"en", "da", "no", "sv", "de"}, resp.Languages)
+	assert.Nil(t, resp.LanguageConfidence)
+	assert.Equal(t, "da", resp.Data[0].Language)
+	assert.Equal(t, "en", resp.Data[1].Language)
+	if assert.Len(t, seen, 1) {
+		assert.True(t, seen[0].AllLanguages)
+		assert.Len(t, seen[0].Languages, len(searchLanguages))
+	}
+}
+
+func TestSearchRanksDoNotDependOnOtherHits(t *testing.T) {
+	parsed, err := parseSearchQuery("docker")
+	assert.NoError(t, err)
+	query, _ := searchPagesSQL(parsed, SearchParams{Languages: []string{"da", "en"}}, 0, 11)
+
+	// Each language's ts_rank is scaled to rank/(rank+1), nothing is
+	// relative to the best hit of a language.
+	assert.Equal(t, 2, strings.Count(query, "ts_rank(p.tsv_document, "))
+	assert.Equal(t, 2, strings.Count(query, ", 32)::float8 AS text_rank"))
+	assert.NotContains(t, query, "OVER (")
+	assert.Contains(t, query, "(text_rank + boost)::float8 AS rank")
+
+	// The merged order, with ts_rank values as Postgres would compute them: a
+	// weak English hit stays behind good Danish ones even though it is the
+	// best (and only) English hit, and the fallback tier comes last.
+	type hit struct {
+		id, tier int
+		language string
+		tsRank   float64
+	}
+	hits := []hit{{1, 0, "en", 0.05}, {2, 0, "da", 0.6}, {3, 1, "en", 2.0}, {4, 0, "da", 0.3}}
+	rank := func(h hit) float64 {
+		if h.tier == 1 {
+			return h.tsRank
+		}
+		return h.tsRank / (h.tsRank + 1) // normalization 32
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].tier != hits[j].tier {
+			return hits[i].tier < hits[j].tier
+		}
+		return rank(hits[i]) > rank(hits[j])
+	})
+	var order []int
+	for _, h := range hits {
+		order = append(order, h.id)
+	}
+	assert.Equal(t, []int{2, 4, 1, 3}, order)
+}
+
+func TestRegConfigFor(t *testing.T) {
+	assert.Equal(t, "norwegian", regConfigFor("no"))
+	assert.Equal(t, "english", regConfigFor("en"))
+	assert.Equal(t, fallbackRegConfig, regConfigFor("fr"))
+}
+
+func TestSearchPassesResolvedLanguage(t *testing.T) {
+	var got []string
+	mockSearchPagesQuery = func(_ *sql.DB, p SearchParams) (SearchPage, error) {
+		got = append(got, strings.Join(p.Languages, ","))
+		return SearchPage{}, nil
+	}
+	router := setupRouter()
+	for _, path := range []string{"/api/search?q=hello&language=swedish", "/api/search?q=und+nicht", "/api/search?q=bonjour&language=fr", "/api/search?q=og"} {
+		assert.Equal(t, http.StatusOK, sendJSON(router, "GET", path, "").Code)
+	}
+	assert.Equal(t, []string{"sv", "de", "fr", "no,da,sv"}, got)
+
+	resp := decode[SearchResponse](t, sendJSON(router, "GET", "/api/search?q=og", "").Body.Bytes())
+	assert.Equal(t, []string{"no", "da", "sv"}, resp.Languages)
+	if assert.NotNil(t, resp.LanguageConfidence) {
+		assert.Less(t, *resp.LanguageConfidence, minLanguageConfidence)
+	}
+	resp = decode[SearchResponse](t, sendJSON(router, "GET", "/api/search?q=og&language=da", "").Body.Bytes())
+	assert.Nil(t, resp.LanguageConfidence, "a given language is not detected")
+}
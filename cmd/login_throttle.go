@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// loginThrottle tracks failed logins per key (client IP or username) and
+// locks the key out with exponential backoff once freeAttempts is exceeded:
+// lock = baseDelay * 2^(failures-freeAttempts), capped at maxDelay.
+// Failures are forgotten after resetAfter without new failures.
+//
+// State is kept in-process like rateLimiter; a restart clears all lockouts.
+type loginThrottle struct {
+	freeAttempts int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	resetAfter   time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func newLoginThrottle(freeAttempts int, baseDelay, maxDelay, resetAfter time.Duration) *loginThrottle {
+	return &loginThrottle{
+		freeAttempts: freeAttempts,
+		baseDelay:    baseDelay,
+		maxDelay:     maxDelay,
+		resetAfter:   resetAfter,
+		entries:      make(map[string]*loginFailures),
+	}
+}
+
+var (
+	accountLoginThrottle = newLoginThrottle(5, 30*time.Second, 15*time.Minute, 24*time.Hour)
+	ipLoginThrottle      = newLoginThrottle(20, 30*time.Second, time.Hour, 24*time.Hour)
+)
+
+func accountThrottleKey(username string) string {
+	return identifierKey(username)
+}
+
+// LockedFor returns how long key is still locked out, or 0.
+func (t *loginThrottle) LockedFor(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(e.lastFailure) > t.resetAfter {
+		delete(t.entries, key)
+		return 0
+	}
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// Fail records a failed attempt and reports whether it started a lockout.
+func (t *loginThrottle) Fail(key string, now time.Time) (locked bool, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok || now.Sub(e.lastFailure) > t.resetAfter {
+		e = &loginFailures{}
+		t.entries[key] = e
+	}
+	e.count++
+	e.lastFailure = now
+
+	over := e.count - t.freeAttempts
+	if over <= 0 {
+		return false, time.Time{}
+	}
+	delay := t.maxDelay
+	if over < 32 {
+		delay = time.Duration(math.Min(float64(t.baseDelay)*math.Pow(2, float64(over-1)), float64(t.maxDelay)))
+	}
+	e.lockedUntil = now.Add(delay)
+	return true, e.lockedUntil
+}
+
+// Reset forgets all failures for key (successful login or admin unlock).
+func (t *loginThrottle) Reset(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	return ok
+}
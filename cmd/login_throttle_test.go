@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	throttle := newLoginThrottle(2, time.Second, 4*time.Second, time.Hour)
+	now := time.Now()
+
+	locked, _ := throttle.Fail("k", now)
+	assert.False(t, locked)
+	locked, _ = throttle.Fail("k", now)
+	assert.False(t, locked)
+	assert.Zero(t, throttle.LockedFor("k", now))
+
+	locked, until := throttle.Fail("k", now)
+	assert.True(t, locked)
+	assert.Equal(t, now.Add(time.Second), until)
+
+	_, until = throttle.Fail("k", now)
+	assert.Equal(t, now.Add(2*time.Second), until)
+	_, until = throttle.Fail("k", now)
+	assert.Equal(t, now.Add(4*time.Second), until)
+	_, until = throttle.Fail("k", now)
+	assert.Equal(t, now.Add(4*time.Second), until, "capped at maxDelay")
+
+	assert.Zero(t, throttle.LockedFor("k", now.Add(5*time.Second)))
+	assert.True(t, throttle.Reset("k"))
+	assert.False(t, throttle.Reset("k"))
+}
+
+func TestLoginThrottleForgetsAfterQuietPeriod(t *testing.T) {
+	throttle := newLoginThrottle(1, time.Minute, time.Hour, time.Hour)
+	now := time.Now()
+	throttle.Fail("k", now)
+	throttle.Fail("k", now)
+	assert.NotZero(t, throttle.LockedFor("k", now))
+	assert.Zero(t, throttle.LockedFor("k", now.Add(2*time.Hour)))
+}
+
+func TestLoginLockoutAndAdminUnlock(t *testing.T) {
+	hash, _ := hashPassword("goodpw")
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 31, "victim", "victim@example.com", hash, nil
+	}
+	router := setupRouter()
+
+	for i := 0; i < 6; i++ {
+		w := postJSON(router, "/api/login", `{"username":"victim","password":"guess"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	}
+
+	// Even the right password is refused while locked.
+	w := postJSON(router, "/api/login", `{"username":"Victim","password":"goodpw"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Non-admins cannot unlock.
+	user := loginAs(t, 32, "someone")
+	w = postJSON(router, "/api/admin/unlock", `{"username":"victim"}`, user)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	admin := loginAs(t, 1, "admin")
+	w = postJSON(router, "/api/admin/unlock", `{"username":"victim"}`, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, "lockout cleared", *resp.Message)
+
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 31, "victim", "victim@example.com", hash, nil
+	}
+	w = postJSON(router, "/api/login", `{"username":"victim","password":"goodpw"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email (password resets, verification links).
+type Mailer interface {
+	Send(msg Mail) error
+}
+
+var mailer Mailer = &MemoryMailer{}
+
+// configureMailer picks the SMTP mailer when SMTP_HOST is set and otherwise
+// appends mail to MAIL_FILE (default next to the server log) for local development.
+//
+// Example:
+//
+//	SMTP_HOST=smtp.example.com SMTP_PORT=587 SMTP_USERNAME=... SMTP_PASSWORD=... MAIL_FROM=noreply@example.com
+func configureMailer() {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = &SMTPMailer{
+			Addr:     net.JoinHostPort(host, port),
+			Host:     host,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     mailFrom(),
+		}
+		log.Printf("[MAIL] Using SMTP mailer via %s:%s", host, port)
+		return
+	}
+
+	path := os.Getenv("MAIL_FILE")
+	if path == "" {
+		path = defaultMailPath
+	}
+	mailer = &FileMailer{Path: path, From: mailFrom()}
+	log.Printf("[MAIL] SMTP_HOST is not set, writing mail to %s", path)
+}
+
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "noreply@whoknows.local"
+}
+
+// appBaseURL is used to build links in outgoing mail.
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// sendMailAsync sends in the background so response timing does not reveal
+// whether an email address belongs to an account.
+func sendMailAsync(msg Mail) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("[MAIL] Failed to send %q: %v", msg.Subject, err)
+		}
+	}()
+}
+
+type SMTPMailer struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	body, err := formatMail(m.From, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, body)
+}
+
+// FileMailer appends messages to a file instead of sending them.
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(msg Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	body, err := formatMail(m.From, msg)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s\r\n\r\n", body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MemoryMailer keeps sent messages in memory; used in tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *MemoryMailer) Send(msg Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
+
+// formatMail builds the message. It refuses header values with line breaks,
+// which would otherwise let an address or subject add headers of its own.
+func formatMail(from string, msg Mail) ([]byte, error) {
+	for _, h := range []struct{ name, value string }{{"From", from}, {"To", msg.To}, {"Subject", msg.Subject}} {
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, fmt.Errorf("line break in %s header", h.name)
+		}
+	}
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMailRejectsHeaderInjection(t *testing.T) {
+	for _, msg := range []Mail{
+		{To: "a@b.c\r\nBcc: victim@example.com", Subject: "Hi"},
+		{To: "a@b.c", Subject: "Hi\nBcc: victim@example.com"},
+	} {
+		_, err := formatMail("noreply@example.com", msg)
+		assert.Error(t, err)
+	}
+	_, err := formatMail("noreply@example.com\r\nX: y", Mail{To: "a@b.c", Subject: "Hi"})
+	assert.Error(t, err)
+
+	body, err := formatMail("noreply@example.com", Mail{To: "a@b.c", Subject: "Hi", Body: "line 1\nline 2"})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(body), "\r\n\r\nline 1\r\nline 2"))
+}
@@ -5,7 +5,8 @@ import (
 )
 
 const (
-	defaultLogPath = "/usr/src/app/data/server.log"
+	defaultLogPath  = "/usr/src/app/data/server.log"
+	defaultMailPath = "/usr/src/app/data/mail.log"
 )
 
 // @title WhoKnows Variations API
@@ -25,6 +26,37 @@ func main() {
 		}
 	}()
 
+	if err := configureSessions(); err != nil {
+		log.Fatalf("Failed to configure sessions: %v", err)
+	}
+
+	if err := configureTokens(); err != nil {
+		log.Fatalf("Failed to configure tokens: %v", err)
+	}
+
+	if err := configurePasswordPolicy(); err != nil {
+		log.Fatalf("Failed to configure password policy: %v", err)
+	}
+
+	if err := configureRegistration(); err != nil {
+		log.Fatalf("Failed to configure registration: %v", err)
+	}
+
+	if err := configureSpelling(); err != nil {
+		log.Fatalf("Failed to configure spelling correction: %v", err)
+	}
+
+	if err := configureAuditRetention(); err != nil {
+		log.Fatalf("Failed to configure audit retention: %v", err)
+	}
+
+	configureMailer()
+	configureOIDC()
+	configureAdminBootstrap()
+	if err := configureEmailVerification(); err != nil {
+		log.Fatalf("Failed to configure email verification: %v", err)
+	}
+
 	database, err := openDatabase()
 	if err != nil {
 		log.Fatalf("Failed to open DB: %v", err)
@@ -35,7 +67,16 @@ func main() {
 		log.Fatalf("Failed to initialize DB: %v", err)
 	}
 
+	if err := retireSeededPassword(db); err != nil {
+		log.Fatalf("Failed to retire the seeded password: %v", err)
+	}
+	if err := bootstrapAdmin(db); err != nil {
+		log.Fatalf("Failed to bootstrap the admin account: %v", err)
+	}
+
 	go monitorUserCount(db)
+	go refreshVocabulary(db)
+	go purgeAuditEvents(db)
 
 	router := newRouter()
 	if err := router.Run(":8080"); err != nil {
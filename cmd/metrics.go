@@ -58,10 +58,45 @@ var (
 			Help: "Det nuværende antal brugere i databasen.",
 		},
 	)
+	legacyPasswordHashGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "app_legacy_password_hashes",
+			Help: "Antal brugere hvis adgangskode stadig er gemt med et gammelt (ikke-bcrypt) hash.",
+		},
+	)
+	passwordRehashCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_password_rehashes_total",
+			Help: "Samlet antal adgangskoder der er hashet om ved login, efter tidligere hash-type.",
+		},
+		[]string{"from"},
+	)
+	loginFailureCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_login_failures_total",
+			Help: "Samlet antal afviste loginforsøg, efter årsag (invalid_credentials/locked).",
+		},
+		[]string{"reason"},
+	)
+	loginLockoutCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_login_lockouts_total",
+			Help: "Samlet antal midlertidige loginspærringer, efter omfang (ip/account).",
+		},
+		[]string{"scope"},
+	)
+	apiKeyRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "app_api_key_requests_total",
+			Help: "Samlet antal forespørgsler godkendt med en API-nøgle, efter nøglens præfiks.",
+		},
+		[]string{"key"},
+	)
 )
 
 func init() {
-	prometheus.MustRegister(requestCounter, requestDuration, userSignupCounter, browserCounter, searchQueryCounter, userTotalGauge)
+	prometheus.MustRegister(requestCounter, requestDuration, userSignupCounter, browserCounter, searchQueryCounter, userTotalGauge,
+		legacyPasswordHashGauge, passwordRehashCounter, loginFailureCounter, loginLockoutCounter, apiKeyRequestCounter)
 }
 
 func metricsHandler() gin.HandlerFunc {
@@ -179,5 +214,12 @@ func monitorUserCount(db *sql.DB) {
 			continue
 		}
 		userTotalGauge.Set(count)
+
+		legacy, err := CountLegacyPasswordHashesQuery(db)
+		if err != nil {
+			log.Printf("Fejl ved tælling af legacy password hashes: %v", err)
+			continue
+		}
+		legacyPasswordHashGauge.Set(legacy)
 	}
 }
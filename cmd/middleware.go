@@ -3,11 +3,32 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"time"
 
+	"WHOKNOWS_VARIATIONS/util"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	contextUserKey           = "authUser"
+	contextSessionIDKey      = "sessionID"
+	contextSessionStartedKey = "sessionStarted"
+
+	// sessionTouchInterval throttles last_seen updates to one write per session
+	// per interval; GetSessionUserQuery only writes when last_seen is older.
+	sessionTouchInterval = time.Minute
+)
+
+// AuthUser is the authenticated user loaded by sessionMiddleware.
+type AuthUser struct {
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
+}
+
 func loggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -26,3 +47,103 @@ func loggingMiddleware() gin.HandlerFunc {
 		log.Printf("[REQ] %s %s -> %d (%v)", c.Request.Method, path, status, duration)
 	}
 }
+
+// sessionMiddleware verifies the session cookie and, when valid, stores the
+// user in the context. Requests without a valid session continue anonymously.
+// A user already authenticated by bearerAuth is kept.
+func sessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := currentUser(c); ok {
+			c.Next()
+			return
+		}
+		token, err := c.Cookie(util.AuthCookieName)
+		if err != nil || token == "" {
+			c.Next()
+			return
+		}
+
+		claims, kid, err := sessionKeys.verify(token, time.Now())
+		if err != nil {
+			log.Printf("[SESSION] Rejected session cookie from IP=%s: %v", c.ClientIP(), err)
+			util.RemoveAuthCookie(c)
+			c.Next()
+			return
+		}
+
+		session, user, err := GetSessionUserQuery(db, claims.SessionID)
+		if err != nil || session.UserID != claims.UserID {
+			log.Printf("[SESSION] Session %s for user_id=%d is revoked or unknown", claims.SessionID, claims.UserID)
+			util.RemoveAuthCookie(c)
+			c.Next()
+			return
+		}
+
+		if kid != sessionKeys.active().ID {
+			// Signed with a retired key: reissue with the active key, keeping the expiry.
+			if fresh, err := sessionKeys.sign(claims); err == nil {
+				util.SetAuthCookie(c, fresh, int(time.Until(time.Unix(claims.ExpiresAt, 0)).Seconds()))
+			}
+		}
+
+		if !user.EmailVerified && emailVerificationMode == verificationModeBlock {
+			c.Next()
+			return
+		}
+		if !validRole(user.Role) {
+			user.Role = roleUser
+		}
+
+		c.Set(contextUserKey, user)
+		c.Set(contextSessionIDKey, session.ID)
+		c.Set(contextSessionStartedKey, session.CreatedAt)
+		c.Next()
+	}
+}
+
+// requireAuth aborts with 401 unless sessionMiddleware loaded a user.
+func requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := currentUser(c); !ok {
+			code := http.StatusUnauthorized
+			msg := "not logged in"
+			c.AbortWithStatusJSON(http.StatusUnauthorized, AuthResponse{&code, &msg})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireVerifiedEmail must run after requireAuth. Outside "off" mode it
+// refuses users who have not confirmed their email address yet.
+func requireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := currentUser(c)
+		if !user.EmailVerified && emailVerificationMode != verificationModeOff {
+			code := http.StatusForbidden
+			msg := "email address not verified"
+			c.AbortWithStatusJSON(http.StatusForbidden, AuthResponse{&code, &msg})
+			return
+		}
+		c.Next()
+	}
+}
+
+func currentUser(c *gin.Context) (AuthUser, bool) {
+	v, ok := c.Get(contextUserKey)
+	if !ok {
+		return AuthUser{}, false
+	}
+	user, ok := v.(AuthUser)
+	return user, ok
+}
+
+func currentSessionID(c *gin.Context) string {
+	return c.GetString(contextSessionIDKey)
+}
+
+// currentSessionStarted is when the user logged in to the current session;
+// zero for bearer tokens and anonymous requests.
+func currentSessionStarted(c *gin.Context) time.Time {
+	return c.GetTime(contextSessionStartedKey)
+}
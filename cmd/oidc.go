@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenID Connect relying party (authorization code flow with PKCE).
+// Enabled when OIDC_ISSUER is set.
+//
+// Example:
+//
+//	OIDC_ISSUER=https://login.example.com/realms/company
+//	OIDC_CLIENT_ID=whoknows
+//	OIDC_CLIENT_SECRET=...
+//	OIDC_REDIRECT_URL=https://whoknows.example.com/api/oidc/callback
+
+const (
+	oidcFlowCookie   = "oidc_flow"
+	oidcFlowTTL      = 10 * time.Minute
+	oidcClockLeeway  = time.Minute
+	oidcDiscoveryTTL = time.Hour
+
+	// unusablePassword is stored for accounts created through OIDC. No
+	// passwordScheme recognizes it, so password login is impossible.
+	unusablePassword = "!oidc"
+)
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcIDClaims struct {
+	Issuer            string      `json:"iss"`
+	Subject           string      `json:"sub"`
+	Audience          jwtAudience `json:"aud"`
+	AuthorizedParty   string      `json:"azp"`
+	ExpiresAt         int64       `json:"exp"`
+	IssuedAt          int64       `json:"iat"`
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     bool        `json:"email_verified"`
+	PreferredUsername string      `json:"preferred_username"`
+}
+
+// oidcFlow is sealed into the oidc_flow cookie between login and callback.
+type oidcFlow struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	jwks         JWKS
+}
+
+// oidc is nil when OIDC login is not configured.
+var oidc *oidcProvider
+
+func configureOIDC() {
+	issuer := strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return
+	}
+	redirect := os.Getenv("OIDC_REDIRECT_URL")
+	if redirect == "" {
+		redirect = appBaseURL() + "/api/oidc/callback"
+	}
+	scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	oidc = newOIDCProvider(oidcConfig{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  redirect,
+		Scopes:       scopes,
+	})
+	log.Printf("[OIDC] Enabled for issuer %s", issuer)
+}
+
+func newOIDCProvider(cfg oidcConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			log.Printf("[OIDC] Error closing response body: %v", cerr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return *p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return oidcDiscovery{}, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.cfg.Issuer {
+		return oidcDiscovery{}, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &d
+	p.discoveredAt = time.Now()
+	p.jwks = JWKS{}
+	return d, nil
+}
+
+// keys returns the cached JWKS, refetching when kid is unknown (key rotation at the IdP).
+func (p *oidcProvider) keys(ctx context.Context, d oidcDiscovery, kid string) (JWKS, error) {
+	p.mu.Lock()
+	cached := p.jwks
+	p.mu.Unlock()
+	if _, err := cached.rsaKey(kid); err == nil {
+		return cached, nil
+	}
+
+	var fresh JWKS
+	if err := p.getJSON(ctx, d.JWKSURI, &fresh); err != nil {
+		return JWKS{}, err
+	}
+	p.mu.Lock()
+	p.jwks = fresh
+	p.mu.Unlock()
+	return fresh, nil
+}
+
+func (p *oidcProvider) authURL(d oidcDiscovery, flow oidcFlow) string {
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", flow.State)
+	q.Set("nonce", flow.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// exchange redeems the authorization code and returns the raw ID token.
+func (p *oidcProvider) exchange(ctx context.Context, d oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			log.Printf("[OIDC] Error closing response body: %v", cerr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d oidcDiscovery, raw, nonce string, now time.Time) (oidcIDClaims, error) {
+	var claims oidcIDClaims
+	header, _, _, _, err := splitJWT(raw)
+	if err != nil {
+		return claims, err
+	}
+	keys, err := p.keys(ctx, d, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	if err := verifyRS256(raw, keys, &claims); err != nil {
+		return claims, err
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.cfg.Issuer:
+		return claims, errors.New("unexpected issuer")
+	case !claims.Audience.contains(p.cfg.ClientID):
+		return claims, errors.New("token not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID:
+		return claims, errors.New("unexpected authorized party")
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockLeeway)):
+		return claims, errors.New("token expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockLeeway)):
+		return claims, errors.New("token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, errors.New("nonce mismatch")
+	case claims.Subject == "":
+		return claims, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// apiOIDCStatus godoc
+// @Summary Report whether single sign-on is available
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} OIDCStatusResponse
+// @Router /api/oidc [get]
+func apiOIDCStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, OIDCStatusResponse{Enabled: oidc != nil})
+}
+
+// apiOIDCLogin godoc
+// @Summary Start single sign-on with the configured identity provider
+// @Tags Auth
+// @Success 302 "Redirect to the identity provider"
+// @Failure 404 {object} AuthResponse
+// @Router /api/oidc/login [get]
+func apiOIDCLogin(c *gin.Context) {
+	if oidc == nil {
+		code := http.StatusNotFound
+		msg := "single sign-on is not configured"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	d, err := oidc.discover(c.Request.Context())
+	if err != nil {
+		log.Printf("[OIDC] Discovery failed: %v", err)
+		c.Redirect(http.StatusFound, "/login?oidc=failed")
+		return
+	}
+
+	flow := oidcFlow{ExpiresAt: time.Now().Add(oidcFlowTTL).Unix()}
+	for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *v, err = randomToken(32); err != nil {
+			log.Printf("[OIDC] Failed to create flow state: %v", err)
+			c.Redirect(http.StatusFound, "/login?oidc=failed")
+			return
+		}
+	}
+	sealed, err := sessionKeys.seal(sealPurposeOIDCFlow, flow)
+	if err != nil {
+		log.Printf("[OIDC] Failed to seal flow state: %v", err)
+		c.Redirect(http.StatusFound, "/login?oidc=failed")
+		return
+	}
+
+	// Binds the callback to this browser; the IdP redirect is a top-level GET, so a Lax cookie is sent.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcFlowCookie, sealed, int(oidcFlowTTL.Seconds()), "/api/oidc", "", false, true) //NOSONAR
+	c.Redirect(http.StatusFound, oidc.authURL(d, flow))
+}
+
+// apiOIDCCallback godoc
+// @Summary Finish single sign-on and start a session
+// @Tags Auth
+// @Param code query string true "Authorization code"
+// @Param state query string true "State from /api/oidc/login"
+// @Success 302 "Redirect to the front page, or to /login?oidc=failed"
+// @Router /api/oidc/callback [get]
+func apiOIDCCallback(c *gin.Context) {
+	if oidc == nil {
+		code := http.StatusNotFound
+		msg := "single sign-on is not configured"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	userID, err := completeOIDCLogin(c)
+	if err != nil {
+		log.Printf("[OIDC] Login failed from IP=%s: %v", c.ClientIP(), err)
+		recordAudit(c, AuditEvent{Event: auditLoginFailed, Details: map[string]any{"method": "oidc", "reason": err.Error()}})
+		if errors.Is(err, errOIDCAccountExists) {
+			c.Redirect(http.StatusFound, "/login?oidc=exists")
+			return
+		}
+		if errors.Is(err, errOIDCRegistrationClosed) {
+			c.Redirect(http.StatusFound, "/login?oidc=closed")
+			return
+		}
+		c.Redirect(http.StatusFound, "/login?oidc=failed")
+		return
+	}
+	// Single sign-on replaces the password, not the second factor.
+	twoFactor, _, err := userHasTwoFactor(userID)
+	if err != nil {
+		log.Printf("[OIDC] Failed to load 2FA state for user_id=%d: %v", userID, err)
+		c.Redirect(http.StatusFound, "/login?oidc=failed")
+		return
+	}
+	if twoFactor {
+		_, username, _, _, err := GetUserByIDQuery(db, strconv.Itoa(userID))
+		if err != nil {
+			log.Printf("[OIDC] Failed to load user_id=%d: %v", userID, err)
+			c.Redirect(http.StatusFound, "/login?oidc=failed")
+			return
+		}
+		challenge, err := newTwoFactorChallenge(userID, username, "oidc")
+		if err != nil {
+			log.Printf("[OIDC] Failed to create 2FA challenge for user_id=%d: %v", userID, err)
+			c.Redirect(http.StatusFound, "/login?oidc=failed")
+			return
+		}
+		log.Printf("[OIDC] 2FA required for user_id=%d", userID)
+		// In the fragment the challenge is never sent to a server, not even in a Referer.
+		c.Redirect(http.StatusFound, "/login?oidc=2fa#challenge="+challenge)
+		return
+	}
+
+	if err := startSession(c, userID); err != nil {
+		log.Printf("[OIDC] Failed to issue session for user_id=%d: %v", userID, err)
+		c.Redirect(http.StatusFound, "/login?oidc=failed")
+		return
+	}
+	log.Printf("[OIDC] Login successful for user_id=%d", userID)
+	recordAudit(c, AuditEvent{Event: auditLoginSucceeded, ActorID: userID, Details: map[string]any{"method": "oidc"}})
+	c.Redirect(http.StatusFound, "/")
+}
+
+func completeOIDCLogin(c *gin.Context) (int, error) {
+	sealed, err := c.Cookie(oidcFlowCookie)
+	c.SetCookie(oidcFlowCookie, "", -1, "/api/oidc", "", false, true) //NOSONAR
+	if err != nil {
+		return 0, errors.New("missing flow cookie")
+	}
+	var flow oidcFlow
+	if _, err := sessionKeys.open(sealPurposeOIDCFlow, sealed, &flow); err != nil || time.Now().Unix() > flow.ExpiresAt {
+		return 0, errors.New("invalid or expired flow cookie")
+	}
+	if idpErr := c.Query("error"); idpErr != "" {
+		return 0, fmt.Errorf("identity provider returned %q", idpErr)
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(flow.State)) != 1 {
+		return 0, errors.New("state mismatch")
+	}
+	code := c.Query("code")
+	if code == "" {
+		return 0, errors.New("missing authorization code")
+	}
+
+	ctx := c.Request.Context()
+	d, err := oidc.discover(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rawIDToken, err := oidc.exchange(ctx, d, code, flow.Verifier)
+	if err != nil {
+		return 0, err
+	}
+	claims, err := oidc.verifyIDToken(ctx, d, rawIDToken, flow.Nonce, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return resolveOIDCUser(c, claims)
+}
+
+// errOIDCAccountExists means the IdP's email belongs to an account that is
+// not linked yet. Its owner has to log in first and link from that session.
+var errOIDCAccountExists = errors.New("an account with this email exists but is not linked")
+
+// errOIDCRegistrationClosed means the identity is unknown and signups are
+// not open; single sign-on cannot skip the invitation or a closed signup.
+var errOIDCRegistrationClosed = errors.New("registration is not open")
+
+// resolveOIDCUser maps an external identity to a users row: an existing link,
+// the logged-in user or, in open registration mode, a new account. An existing account is never linked
+// by email alone: the IdP's email_verified says nothing about who controls
+// the account here, which may be an admin's or have 2FA.
+func resolveOIDCUser(c *gin.Context, claims oidcIDClaims) (int, error) {
+	userID, err := GetUserIDByIdentityQuery(db, claims.Issuer, claims.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if user, ok := currentUser(c); ok {
+		return user.ID, LinkIdentityQuery(db, user.ID, claims.Issuer, claims.Subject, claims.Email)
+	}
+
+	if claims.Email == "" {
+		return 0, errors.New("identity provider did not return an email address")
+	}
+	if !emailPattern.MatchString(normalizeIdentifier(claims.Email)) {
+		return 0, errors.New("identity provider returned an invalid email address")
+	}
+	if id, _, _, _, err := GetUserByEmailQuery(db, normalizeIdentifier(claims.Email)); err == nil {
+		log.Printf("[OIDC] Refusing to link %s to user_id=%d by email", claims.Subject, id)
+		return 0, errOIDCAccountExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if registrationMode != registrationModeOpen {
+		log.Printf("[OIDC] Refusing to create an account for %s: registration is %s", claims.Subject, registrationMode)
+		return 0, errOIDCRegistrationClosed
+	}
+	id, err := createOIDCUser(claims)
+	if err != nil {
+		return 0, err
+	}
+	return id, LinkIdentityQuery(db, id, claims.Issuer, claims.Subject, claims.Email)
+}
+
+var oidcUsernameCleanup = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+func createOIDCUser(claims oidcIDClaims) (int, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(oidcUsernameCleanup.ReplaceAllString(strings.ToLower(base), "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			username = fmt.Sprintf("%s-%04d", base, rand.IntN(10000)) //nolint:gosec // only de-duplicates usernames
+		}
+		id, err := InsertUserQuery(db, username, normalizeIdentifier(claims.Email), unusablePassword)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if claims.EmailVerified {
+			if err := MarkEmailVerifiedQuery(db, int(id)); err != nil {
+				log.Printf("[OIDC] Failed to mark email verified for user_id=%d: %v", id, err)
+			}
+		}
+		userSignupCounter.WithLabelValues("success").Inc()
+		log.Printf("[OIDC] Created user %s for subject %s", username, claims.Subject)
+		return int(id), nil
+	}
+	userSignupCounter.WithLabelValues("failed").Inc()
+	return 0, fmt.Errorf("could not create user (email may already be registered): %w", lastErr)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	GetUserIDByIdentityQuery func(db *sql.DB, issuer, subject string) (int, error)
+	LinkIdentityQuery        func(db *sql.DB, userID int, issuer, subject, email string) error
+	ListUserIdentitiesQuery  func(db *sql.DB, userID int) ([]UserIdentity, error)
+)
+
+// ---- Real implementations ----
+
+func realGetUserIDByIdentityQuery(db *sql.DB, issuer, subject string) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, subject).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+func realLinkIdentityQuery(db *sql.DB, userID int, issuer, subject, email string) error {
+	query := "INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(query, userID, issuer, subject, email)
+	return err
+}
+
+func realListUserIdentitiesQuery(db *sql.DB, userID int) ([]UserIdentity, error) {
+	rows, err := db.Query("SELECT issuer, subject, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	identities := []UserIdentity{}
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(&i.Issuer, &i.Subject, &i.Email, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	GetUserIDByIdentityQuery = realGetUserIDByIdentityQuery
+	LinkIdentityQuery = realLinkIdentityQuery
+	ListUserIdentitiesQuery = realListUserIdentitiesQuery
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"WHOKNOWS_VARIATIONS/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// testIssuer is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that returns an RS256 ID token for the pending authorization.
+type testIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any // claims for the next ID token; nonce is filled in from the authorization
+	nonce  string
+	chal   string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	iss := &testIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                iss.URL,
+			AuthorizationEndpoint: iss.URL + "/authorize",
+			TokenEndpoint:         iss.URL + "/token",
+			JWKSURI:               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(JWKS{Keys: []JWK{{
+			Kty: "RSA", Kid: "k1", Alg: "RS256", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != "whoknows" || secret != "s3cret" || r.PostFormValue("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != iss.chal {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims := map[string]any{"nonce": iss.nonce}
+		for k, v := range iss.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": iss.sign(t, claims)})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: "k1", Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (iss *testIssuer) idClaims(sub, email string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss": iss.URL, "sub": sub, "aud": "whoknows",
+		"iat": now.Unix(), "exp": now.Add(time.Minute).Unix(),
+		"email": email, "email_verified": true, "preferred_username": "Jane Doe",
+	}
+}
+
+func withOIDC(t *testing.T, iss *testIssuer) {
+	t.Helper()
+	oidc = newOIDCProvider(oidcConfig{
+		Issuer:       iss.URL,
+		ClientID:     "whoknows",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://localhost:8080/api/oidc/callback",
+		Scopes:       []string{"openid", "email"},
+	})
+	t.Cleanup(func() { oidc = nil })
+}
+
+// runOIDCLogin walks /api/oidc/login -> IdP -> /api/oidc/callback and
+// returns the callback response.
+func runOIDCLogin(t *testing.T, router http.Handler, iss *testIssuer, state string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/oidc/login", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, iss.URL+"/authorize", loc.Scheme+"://"+loc.Host+loc.Path)
+	assert.Equal(t, "S256", loc.Query().Get("code_challenge_method"))
+	iss.nonce, iss.chal = loc.Query().Get("nonce"), loc.Query().Get("code_challenge")
+	if state == "" {
+		state = loc.Query().Get("state")
+	}
+
+	callback := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/oidc/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	router.ServeHTTP(callback, req)
+	return callback
+}
+
+func authCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == util.AuthCookieName && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOIDCStatus(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/oidc", nil)
+	router.ServeHTTP(w, req)
+	assert.False(t, decode[OIDCStatusResponse](t, w.Body.Bytes()).Enabled)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/oidc/login", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestOIDCLoginCreatesAndReusesUser(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+	iss.claims = iss.idClaims("sub-new", "jane@corp.example")
+
+	mockGetUserByEmailQuery = func(_ *sql.DB, _ string) (int, string, string, string, error) {
+		return 0, "", "", "", sql.ErrNoRows
+	}
+	var inserted []string
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) {
+		inserted = append(inserted, u)
+		assert.Equal(t, "jane@corp.example", e)
+		assert.Equal(t, unusablePassword, p)
+		return 71, nil
+	}
+
+	w := runOIDCLogin(t, router, iss, "")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	assert.NotNil(t, authCookie(w))
+	assert.Equal(t, []string{"jane-doe"}, inserted)
+	assert.True(t, fakeEmailVerifications.verified[71])
+
+	// The linked identity is found again; no second account.
+	w = runOIDCLogin(t, router, iss, "")
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	assert.Len(t, inserted, 1)
+
+	// The created account cannot log in with a password.
+	ok, _, _ := verifyPassword(unusablePassword, "!oidc")
+	assert.False(t, ok)
+}
+
+func TestOIDCNeverLinksByEmail(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+	iss.claims = iss.idClaims("sub-existing", "bob@example.com")
+
+	mockGetUserByEmailQuery = func(_ *sql.DB, e string) (int, string, string, string, error) {
+		return 72, "bob", e, "hash", nil
+	}
+	mockInsertUserQuery = func(*sql.DB, string, string, string) (int64, error) {
+		t.Fatal("existing user must not be duplicated")
+		return 0, nil
+	}
+
+	// A verified email at the IdP is not proof of owning the account here.
+	w := runOIDCLogin(t, router, iss, "")
+	assert.Equal(t, "/login?oidc=exists", w.Header().Get("Location"))
+	assert.Nil(t, authCookie(w))
+	_, err := GetUserIDByIdentityQuery(db, iss.URL, "sub-existing")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// Logged in as bob, the same login links the identity.
+	w = runOIDCLogin(t, router, iss, "", loginAs(t, 72, "bob"))
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	userID, err := GetUserIDByIdentityQuery(db, iss.URL, "sub-existing")
+	assert.NoError(t, err)
+	assert.Equal(t, 72, userID)
+}
+
+func TestOIDCLinksLoggedInUser(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+	iss.claims = iss.idClaims("sub-linked", "other@corp.example")
+	iss.claims["email_verified"] = false
+
+	cookie := loginAs(t, 73, "carol")
+	w := runOIDCLogin(t, router, iss, "", cookie)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	userID, err := GetUserIDByIdentityQuery(db, iss.URL, "sub-linked")
+	assert.NoError(t, err)
+	assert.Equal(t, 73, userID)
+}
+
+func TestOIDCCallbackRejectsBadResponses(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+
+	cases := map[string]func(){
+		"state mismatch": func() {},
+		"wrong audience": func() { iss.claims["aud"] = "someone-else" },
+		"expired":        func() { iss.claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"wrong issuer":   func() { iss.claims["iss"] = "https://evil.example" },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			iss.claims = iss.idClaims("sub-bad", "bad@corp.example")
+			mutate()
+			state := ""
+			if name == "state mismatch" {
+				state = "forged"
+			}
+			w := runOIDCLogin(t, router, iss, state)
+			assert.Equal(t, "/login?oidc=failed", w.Header().Get("Location"))
+			assert.Nil(t, authCookie(w))
+		})
+	}
+}
+
+func TestOIDCLoginRequiresTwoFactor(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+	iss.claims = iss.idClaims("sub-2fa", "ssotwofa@corp.example")
+
+	cookie := loginAs(t, 151, "ssotwofa")
+	_, recovery := enrollTwoFactor(t, router, cookie)
+	assert.NoError(t, LinkIdentityQuery(db, 151, iss.URL, "sub-2fa", "ssotwofa@corp.example"))
+
+	// The IdP login alone is only the first factor: no session yet.
+	w := runOIDCLogin(t, router, iss, "")
+	assert.Equal(t, http.StatusFound, w.Code)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/login?oidc=2fa", loc.Path+"?"+loc.RawQuery)
+	assert.Nil(t, authCookie(w))
+	challenge := strings.TrimPrefix(loc.Fragment, "challenge=")
+	assert.NotEmpty(t, challenge)
+
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge+`","code":"000000x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge+`","code":"`+recovery[0]+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotNil(t, authCookie(w))
+}
+
+func TestOIDCCreatesAccountsOnlyWhenRegistrationIsOpen(t *testing.T) {
+	iss := newTestIssuer(t)
+	withOIDC(t, iss)
+	router := setupRouter()
+	mockGetUserByEmailQuery = func(_ *sql.DB, _ string) (int, string, string, string, error) {
+		return 0, "", "", "", sql.ErrNoRows
+	}
+	mockInsertUserQuery = func(*sql.DB, string, string, string) (int64, error) {
+		t.Fatal("no account may be created while registration is not open")
+		return 0, nil
+	}
+
+	for _, mode := range []string{registrationModeInviteOnly, registrationModeClosed} {
+		withRegistrationMode(t, mode)
+		iss.claims = iss.idClaims("sub-stranger", "stranger@corp.example")
+		w := runOIDCLogin(t, router, iss, "")
+		assert.Equal(t, "/login?oidc=closed", w.Header().Get("Location"), mode)
+		assert.Nil(t, authCookie(w))
+	}
+
+	// Identities linked before still log in.
+	assert.NoError(t, LinkIdentityQuery(db, 164, iss.URL, "sub-member", "member@corp.example"))
+	iss.claims = iss.idClaims("sub-member", "member@corp.example")
+	w := runOIDCLogin(t, router, iss, "")
+	assert.Equal(t, "/", w.Header().Get("Location"))
+	assert.NotNil(t, authCookie(w))
+}
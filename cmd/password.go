@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/md5" //nolint:gosec // only used to verify legacy hashes imported from the Python app
+	"crypto/subtle"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordScheme verifies one stored hash format. Schemes are tried in order
+// and the first one that recognizes the hash decides.
+type passwordScheme interface {
+	Name() string
+	Recognizes(hash string) bool
+	Verify(hash, password string) bool
+	// NeedsRehash reports whether a recognized hash should be replaced by the current scheme.
+	NeedsRehash(hash string) bool
+}
+
+var passwordBcryptCost = bcrypt.DefaultCost
+
+var passwordSchemes = []passwordScheme{
+	bcryptScheme{},
+	md5Scheme{},
+}
+
+// hashPassword hashes password with the current scheme (bcrypt at passwordBcryptCost).
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordBcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// verifyPassword checks password against hash. When ok is true, rehash tells
+// the caller to store a fresh hashPassword result; scheme names the matched format.
+func verifyPassword(hash, password string) (ok, rehash bool, scheme string) {
+	for _, s := range passwordSchemes {
+		if !s.Recognizes(hash) {
+			continue
+		}
+		if !s.Verify(hash, password) {
+			return false, false, s.Name()
+		}
+		return true, s.NeedsRehash(hash), s.Name()
+	}
+	return false, false, "unknown"
+}
+
+type bcryptScheme struct{}
+
+func (bcryptScheme) Name() string { return "bcrypt" }
+
+func (bcryptScheme) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (bcryptScheme) Verify(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (bcryptScheme) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != passwordBcryptCost
+}
+
+// md5Scheme handles the unsalted hex MD5 hashes of the legacy user import.
+type md5Scheme struct{}
+
+var md5HexRegex = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+func (md5Scheme) Name() string { return "md5" }
+
+func (md5Scheme) Recognizes(hash string) bool { return md5HexRegex.MatchString(hash) }
+
+func (md5Scheme) Verify(hash, password string) bool {
+	sum := md5.Sum([]byte(password)) //nolint:gosec // legacy verification only
+	computed := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(strings.ToLower(hash))) == 1
+}
+
+func (md5Scheme) NeedsRehash(string) bool { return true }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // matches the Pwned Passwords list format, not used for storage
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// passwordPolicy is checked whenever a password is chosen (register, reset,
+// change). Each failed rule becomes its own ValidationError so the frontend
+// can list all problems at once.
+type passwordPolicy struct {
+	MinLength      int
+	MaxBytes       int
+	MinEntropyBits float64
+}
+
+// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+// instead of being silently truncated.
+var currentPasswordPolicy = passwordPolicy{MinLength: 8, MaxBytes: 72, MinEntropyBits: 36}
+
+//go:embed data/breached_passwords.txt
+var bundledBreachedPasswords string
+
+// breachedPasswords holds SHA-1 hashes split like the Pwned Passwords range
+// API: 5 hex chars of prefix -> set of 35 char suffixes.
+var breachedPasswords = map[string]map[string]struct{}{}
+
+// configurePasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_ENTROPY_BITS
+// and adds BREACHED_PASSWORDS_FILE to the bundled breached-password list.
+func configurePasswordPolicy() error {
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", raw)
+		}
+		currentPasswordPolicy.MinLength = n
+	}
+	if raw := os.Getenv("PASSWORD_MIN_ENTROPY_BITS"); raw != "" {
+		bits, err := strconv.ParseFloat(raw, 64)
+		if err != nil || bits < 0 {
+			return fmt.Errorf("invalid PASSWORD_MIN_ENTROPY_BITS %q", raw)
+		}
+		currentPasswordPolicy.MinEntropyBits = bits
+	}
+
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		f, err := os.Open(path) //nolint:gosec // path comes from the operator
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil {
+				log.Printf("[PASSWORD] Error closing %s: %v", path, cerr)
+			}
+		}()
+		n, err := loadBreachedPasswords(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		log.Printf("[PASSWORD] Loaded %d breached password hashes from %s", n, path)
+	}
+	return nil
+}
+
+func init() {
+	if _, err := loadBreachedPasswords(strings.NewReader(bundledBreachedPasswords)); err != nil {
+		panic("bundled breached password list: " + err.Error())
+	}
+}
+
+// loadBreachedPasswords reads "SHA1HEX" or "SHA1HEX:COUNT" lines; blank lines
+// and lines starting with # are skipped.
+func loadBreachedPasswords(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != 40 {
+			return count, fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return count, fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+		bucket, ok := breachedPasswords[hash[:5]]
+		if !ok {
+			bucket = map[string]struct{}{}
+			breachedPasswords[hash[:5]] = bucket
+		}
+		bucket[hash[5:]] = struct{}{}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func isBreachedPassword(password string) bool {
+	sum := sha1.Sum([]byte(password)) //nolint:gosec // see import
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, found := breachedPasswords[hash[:5]][hash[5:]]
+	return found
+}
+
+// estimateEntropyBits is a rough brute-force estimate: length times the bits
+// per character of the character classes used. Repeated or sequential
+// neighbours ("aaa", "abc", "123") only count a quarter.
+func estimateEntropyBits(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	effective := 0.0
+	var prev rune
+	for i, r := range password {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+		if i > 0 && (r == prev || r == prev+1 || r == prev-1) {
+			effective += 0.25
+		} else {
+			effective++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return effective * math.Log2(float64(pool))
+}
+
+func passwordRuleError(msg, kind string) ValidationError {
+	return ValidationError{Loc: []any{"password", 0}, Msg: msg, Type: kind}
+}
+
+// Check returns one ValidationError per rule the password breaks, or nil.
+func (p passwordPolicy) Check(password, username, email string) []ValidationError {
+	var errs []ValidationError
+	length := len([]rune(password))
+	if length < p.MinLength {
+		errs = append(errs, passwordRuleError(fmt.Sprintf("the password must be at least %d characters long", p.MinLength), "password_too_short"))
+	}
+	if len(password) > p.MaxBytes {
+		errs = append(errs, passwordRuleError(fmt.Sprintf("the password can be at most %d bytes long", p.MaxBytes), "password_too_long"))
+	}
+	if length >= p.MinLength && estimateEntropyBits(password) < p.MinEntropyBits {
+		errs = append(errs, passwordRuleError("the password is too easy to guess, use a longer password or mix letters, digits and symbols", "password_too_weak"))
+	}
+
+	lowered := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	switch {
+	case len(username) >= 3 && strings.Contains(lowered, strings.ToLower(username)):
+		errs = append(errs, passwordRuleError("the password must not contain your username", "password_contains_username"))
+	case len(localPart) >= 3 && strings.Contains(lowered, localPart):
+		errs = append(errs, passwordRuleError("the password must not contain your email address", "password_contains_email"))
+	}
+
+	if isBreachedPassword(password) {
+		errs = append(errs, passwordRuleError("this password has appeared in a data breach, choose another one", "password_breached"))
+	}
+	return errs
+}
+
+// rejectWeakPassword sends a 422 listing every broken rule and reports
+// whether the password was rejected.
+func rejectWeakPassword(c *gin.Context, password, username, email string) bool {
+	errs := currentPasswordPolicy.Check(password, username, email)
+	if len(errs) == 0 {
+		return false
+	}
+	c.JSON(422, HTTPValidationError{Detail: errs})
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ruleTypes(errs []ValidationError) []string {
+	types := make([]string, 0, len(errs))
+	for _, e := range errs {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := passwordPolicy{MinLength: 8, MaxBytes: 72, MinEntropyBits: 36}
+
+	assert.Empty(t, policy.Check("correct horse battery", "alice", "alice@example.com"))
+	assert.Equal(t, []string{"password_too_short"}, ruleTypes(policy.Check("Xy7!", "alice", "alice@example.com")))
+	assert.Equal(t, []string{"password_too_long"}, ruleTypes(policy.Check(strings.Repeat("Ab3$", 20), "alice", "alice@example.com")))
+	assert.Equal(t, []string{"password_too_weak"}, ruleTypes(policy.Check("aaaaaaaaaaaa", "alice", "alice@example.com")))
+	assert.Contains(t, ruleTypes(policy.Check("Alice-Rocks-2024", "alice", "a@example.com")), "password_contains_username")
+	assert.Contains(t, ruleTypes(policy.Check("Wonderland-bob-99", "al", "wonderland@example.com")), "password_contains_email")
+	assert.Contains(t, ruleTypes(policy.Check("password123", "alice", "alice@example.com")), "password_breached")
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	assert.False(t, isBreachedPassword("Tangerine-Submarine-81"))
+	n, err := loadBreachedPasswords(strings.NewReader("# extra\n\n8360de156b3d56c17c25715ee9088d4a3aad8b35:3\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, isBreachedPassword("Tangerine-Submarine-81"))
+
+	_, err = loadBreachedPasswords(strings.NewReader("not-a-hash\n"))
+	assert.Error(t, err)
+}
+
+func TestRegisterRejectsWeakPassword(t *testing.T) {
+	router := setupRouter()
+	w := postJSON(router, "/api/register", `{"username":"weakling","email":"weakling@example.com","password":"weakling","password2":"weakling"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	resp := decode[HTTPValidationError](t, w.Body.Bytes())
+	assert.Contains(t, ruleTypes(resp.Detail), "password_contains_username")
+	assert.Contains(t, ruleTypes(resp.Detail), "password_too_weak")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const passwordResetTTL = time.Hour
+
+var (
+	forgotPasswordEmailLimiter = newRateLimiter(3, time.Hour)
+	forgotPasswordIPLimiter    = newRateLimiter(10, time.Hour)
+)
+
+type ForgotPasswordRequest struct {
+	Email string `form:"email" json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token     string `form:"token" json:"token"`
+	Password  string `form:"password" json:"password"`
+	Password2 string `form:"password2" json:"password2"`
+}
+
+// apiForgotPassword godoc
+// @Summary Request a password reset email
+// @Description Always answers with the same message so it cannot be used to probe for accounts.
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body ForgotPasswordRequest true "Account email"
+// @Success 200 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} AuthResponse
+// @Router /api/password/forgot [post]
+func apiForgotPassword(c *gin.Context) {
+	var form ForgotPasswordRequest
+	if err := c.ShouldBind(&form); err != nil || strings.TrimSpace(form.Email) == "" {
+		sendValidationError(c, "email", "you have to enter an email address")
+		return
+	}
+	email := normalizeIdentifier(form.Email)
+
+	if !forgotPasswordIPLimiter.Allow(c.ClientIP()) || !forgotPasswordEmailLimiter.Allow(identifierKey(email)) {
+		log.Printf("[PASSWORD] Reset rate limit hit from IP=%s", c.ClientIP())
+		code := http.StatusTooManyRequests
+		msg := "too many reset requests, try again later"
+		c.JSON(http.StatusTooManyRequests, AuthResponse{&code, &msg})
+		return
+	}
+
+	if id, username, dbEmail, _, err := GetUserByEmailQuery(db, email); err == nil {
+		if err := sendPasswordReset(id, username, dbEmail); err != nil {
+			log.Printf("[PASSWORD] Failed to create reset token for user_id=%d: %v", id, err)
+		}
+	} else {
+		log.Printf("[PASSWORD] Reset requested for unknown email from IP=%s", c.ClientIP())
+	}
+
+	code := http.StatusOK
+	msg := "if an account exists for that email, a reset link has been sent"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+func sendPasswordReset(userID int, username, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	if err := CreatePasswordResetQuery(db, userID, hashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	link := appBaseURL() + "/reset-password?token=" + url.QueryEscape(token)
+	sendMailAsync(Mail{
+		To:      email,
+		Subject: "Reset your ¿Who Knows? password",
+		Body: "Hi " + username + ",\n\n" +
+			"Someone asked to reset the password for your account. If it was you, open the link below within one hour:\n\n" +
+			link + "\n\n" +
+			"If you did not ask for this, you can ignore this email.\n",
+	})
+	log.Printf("[PASSWORD] Reset link issued for user_id=%d", userID)
+	return nil
+}
+
+// apiResetPassword godoc
+// @Summary Set a new password using a reset token
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/password/reset [post]
+func apiResetPassword(c *gin.Context) {
+	var form ResetPasswordRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	if form.Token == "" {
+		sendValidationError(c, "token", "missing reset token")
+		return
+	}
+	if form.Password == "" {
+		sendValidationError(c, "password", "you have to enter a password")
+		return
+	}
+	if form.Password != form.Password2 {
+		sendValidationError(c, "password2", "the two passwords do not match")
+		return
+	}
+
+	// Check the policy before using up the token, so the user can try another password.
+	peekID, err := PeekPasswordResetQuery(db, hashToken(form.Token))
+	if err != nil {
+		log.Printf("[PASSWORD] Invalid or expired reset token from IP=%s", c.ClientIP())
+		sendValidationError(c, "token", "the reset link is invalid or has expired")
+		return
+	}
+	_, username, email, _, err := GetUserByIDQuery(db, strconv.Itoa(peekID))
+	if err != nil {
+		log.Printf("[PASSWORD] Reset token for unknown user_id=%d: %v", peekID, err)
+		sendValidationError(c, "token", "the reset link is invalid or has expired")
+		return
+	}
+	if rejectWeakPassword(c, form.Password, username, email) {
+		return
+	}
+
+	hash, err := hashPassword(form.Password)
+	if err != nil {
+		log.Printf("[PASSWORD] Failed to hash password: %v", err)
+		sendValidationError(c, "password", "could not process password")
+		return
+	}
+
+	userID, err := ConsumePasswordResetQuery(db, hashToken(form.Token))
+	if err != nil {
+		log.Printf("[PASSWORD] Invalid or expired reset token from IP=%s", c.ClientIP())
+		sendValidationError(c, "token", "the reset link is invalid or has expired")
+		return
+	}
+
+	if err := UpdateUserPasswordQuery(db, userID, hash); err != nil {
+		log.Printf("[PASSWORD] Failed to update password for user_id=%d: %v", userID, err)
+		sendValidationError(c, "password", "could not update password")
+		return
+	}
+	if _, err := RevokeUserSessionsQuery(db, userID); err != nil {
+		log.Printf("[PASSWORD] Failed to revoke sessions for user_id=%d: %v", userID, err)
+	}
+	if _, err := RevokeUserRefreshTokensQuery(db, userID); err != nil {
+		log.Printf("[PASSWORD] Failed to revoke refresh tokens for user_id=%d: %v", userID, err)
+	}
+
+	log.Printf("[PASSWORD] Password reset for user_id=%d", userID)
+	recordAudit(c, AuditEvent{Event: auditPasswordReset, ActorID: userID, ActorName: username, TargetID: userID})
+	code := http.StatusOK
+	msg := "password has been reset, please log in"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
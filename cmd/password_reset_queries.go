@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreatePasswordResetQuery  func(db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error
+	ConsumePasswordResetQuery func(db *sql.DB, tokenHash string) (int, error)
+	PeekPasswordResetQuery    func(db *sql.DB, tokenHash string) (int, error)
+)
+
+// ---- Real implementations ----
+
+func realCreatePasswordResetQuery(db *sql.DB, userID int, tokenHash string, expiresAt time.Time) error {
+	query := "INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+	_, err := db.Exec(query, userID, tokenHash, expiresAt)
+	return err
+}
+
+// realConsumePasswordResetQuery marks the token used and returns its user in a
+// single statement, so a token can never be redeemed twice.
+func realConsumePasswordResetQuery(db *sql.DB, tokenHash string) (int, error) {
+	query := `
+UPDATE password_resets
+SET used_at = NOW()
+WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+RETURNING user_id`
+
+	var userID int
+	if err := db.QueryRow(query, tokenHash).Scan(&userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// realPeekPasswordResetQuery returns the user of a valid token without using it up.
+func realPeekPasswordResetQuery(db *sql.DB, tokenHash string) (int, error) {
+	query := "SELECT user_id FROM password_resets WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()"
+	var userID int
+	if err := db.QueryRow(query, tokenHash).Scan(&userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreatePasswordResetQuery = realCreatePasswordResetQuery
+	ConsumePasswordResetQuery = realConsumePasswordResetQuery
+	PeekPasswordResetQuery = realPeekPasswordResetQuery
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForgotPasswordUnknownEmailLooksTheSame(t *testing.T) {
+	mockGetUserByEmailQuery = func(_ *sql.DB, e string) (int, string, string, string, error) {
+		return 0, "", "", "", errors.New("not found")
+	}
+	router := setupRouter()
+
+	w := postJSON(router, "/api/password/forgot", `{"email":"nobody@example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Contains(t, *resp.Message, "if an account exists")
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	inbox := &MemoryMailer{}
+	mailer = inbox
+	mockGetUserByEmailQuery = func(_ *sql.DB, e string) (int, string, string, string, error) {
+		return 11, "resetter", e, "hash", nil
+	}
+	var updated string
+	mockUpdateUserPassword = func(_ *sql.DB, id int, hash string) error {
+		updated = hash
+		return nil
+	}
+	defer func() { mockUpdateUserPassword = nil }()
+	router := setupRouter()
+
+	w := postJSON(router, "/api/password/forgot", `{"email":"resetter@example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	token := tokenFromMail(t, waitForMail(t, inbox, "resetter@example.com"))
+
+	w = postJSON(router, "/api/password/reset", `{"token":"`+token+`","password":"Quiet-Meadow-17","password2":"Quiet-Meadow-17"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	ok, _, _ := verifyPassword(updated, "Quiet-Meadow-17")
+	assert.True(t, ok)
+
+	// Tokens are single use.
+	w = postJSON(router, "/api/password/reset", `{"token":"`+token+`","password":"Another-Fresh-Pass-9","password2":"Another-Fresh-Pass-9"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	resp := decode[HTTPValidationError](t, w.Body.Bytes())
+	assert.Equal(t, "token", resp.Detail[0].Loc[0])
+}
+
+func TestForgotPasswordRateLimitedPerEmail(t *testing.T) {
+	mockGetUserByEmailQuery = func(_ *sql.DB, e string) (int, string, string, string, error) {
+		return 0, "", "", "", errors.New("not found")
+	}
+	router := setupRouter()
+
+	for i := 0; i < 3; i++ {
+		w := postJSON(router, "/api/password/forgot", `{"email":"spam@example.com"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w := postJSON(router, "/api/password/forgot", `{"email":"SPAM@example.com"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPasswordLegacyMD5(t *testing.T) {
+	// md5("password"), as seeded for the admin user
+	ok, rehash, scheme := verifyPassword("5f4dcc3b5aa765d61d8327deb882cf99", "password")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+	assert.Equal(t, "md5", scheme)
+
+	ok, _, _ = verifyPassword("5f4dcc3b5aa765d61d8327deb882cf99", "wrong")
+	assert.False(t, ok)
+}
+
+func TestVerifyPasswordBcryptCost(t *testing.T) {
+	current, _ := hashPassword("s3cret")
+	ok, rehash, scheme := verifyPassword(current, "s3cret")
+	assert.True(t, ok)
+	assert.False(t, rehash)
+	assert.Equal(t, "bcrypt", scheme)
+
+	weak, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	ok, rehash, _ = verifyPassword(string(weak), "s3cret")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+func TestVerifyPasswordUnknownScheme(t *testing.T) {
+	ok, _, scheme := verifyPassword("plaintext", "plaintext")
+	assert.False(t, ok)
+	assert.Equal(t, "unknown", scheme)
+}
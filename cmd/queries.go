@@ -2,7 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,6 +26,42 @@ type SearchResult struct {
 	LastUpdated *time.Time `json:"last_updated,omitempty"`
 	Snippet     string     `json:"snippet"`
 	Rank        float64    `json:"-"`
+	// ID and Tier (0 = full-text hit, 1 = trigram fallback) locate the
+	// result in the search order, for the pagination cursor.
+	ID   int64 `json:"-"`
+	Tier int   `json:"-"`
+}
+
+// searchPosition is a point in the search order (tier, rank DESC, id).
+type searchPosition struct {
+	Tier int
+	Rank float64
+	ID   int64
+}
+
+// SearchParams describes one page of a search. Languages are searched
+// together, each with its own text search configuration; AllLanguages adds
+// the pages in any other language, with the simple configuration. AsOf is
+// the reference time for the recency boost; it is kept for all pages of a
+// search so ranks, and with them the order, do not drift while paging.
+type SearchParams struct {
+	Query        string
+	Languages    []string
+	AllLanguages bool
+	Limit        int
+	AsOf         time.Time
+	After        *searchPosition
+	CountTotal   bool
+}
+
+// SearchPage is one page of results. Total is the number of hits, only set
+// when CountTotal was; it is exact when everything fit on the page and an
+// estimate otherwise, see TotalEstimated.
+type SearchPage struct {
+	Results        []SearchResult
+	HasMore        bool
+	Total          int
+	TotalEstimated bool
 }
 
 // ---- Function variables (can be replaced in tests) ----
@@ -30,26 +71,65 @@ var (
 	GetUserIDQuery         func(db *sql.DB, username string) (int, error)
 	GetUserByIDQuery       func(db *sql.DB, userID string) (int, string, string, string, error)
 	GetUserByUsernameQuery func(db *sql.DB, username string) (int, string, string, string, error)
-	SearchPagesQuery       func(db *sql.DB, searchTerm, language string, limit int) ([]SearchResult, error)
+	GetUserByEmailQuery    func(db *sql.DB, email string) (int, string, string, string, error)
+	SearchPagesQuery       func(db *sql.DB, p SearchParams) (SearchPage, error)
 	GetUserCountQuery      func(db *sql.DB) (float64, error)
+
+	UpdateUserPasswordQuery        func(db *sql.DB, userID int, hash string) error
+	UpdateUserEmailQuery           func(db *sql.DB, userID int, email string) error
+	DeleteUserQuery                func(db *sql.DB, userID int) error
+	CountLegacyPasswordHashesQuery func(db *sql.DB) (float64, error)
+
+	GetUserRoleQuery func(db *sql.DB, userID int) (string, error)
+	SetUserRoleQuery func(db *sql.DB, userID int, role string) (bool, error)
 )
 
 // ---- Real implementations ----
 
-func realInsertUserQuery(db *sql.DB, username, email, password string) (int64, error) {
+// errIdentifierTaken means another account has the username or email when
+// case and Unicode form are ignored.
+var errIdentifierTaken = errors.New("username or email taken")
+
+// realInsertUserQuery checks for a colliding account itself instead of only
+// relying on the users_*_ci_key indexes. The advisory lock serializes signups,
+// so two concurrent inserts cannot both pass the check.
+func realInsertUserQuery(db *sql.DB, username, email, password string) (id int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('users_identifiers'))"); err != nil {
+		return 0, err
+	}
+
 	// PostgreSQL does not support LastInsertId() reliably via database/sql,
 	// so we use RETURNING.
-	query := "INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id"
-
-	var id int64
-	if err := db.QueryRow(query, username, email, password).Scan(&id); err != nil {
+	query := `
+INSERT INTO users (username, email, password)
+SELECT $1, $2, $3
+WHERE NOT EXISTS (
+  SELECT 1 FROM users
+  WHERE lower(normalize(username, NFKC)) = lower(normalize($1, NFKC))
+     OR lower(normalize(email, NFKC)) = lower(normalize($2, NFKC))
+)
+RETURNING id`
+	err = tx.QueryRow(query, username, email, password).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errIdentifierTaken
+	}
+	if err != nil {
 		return 0, err
 	}
-	return id, nil
+	return id, tx.Commit()
 }
 
 func realGetUserIDQuery(db *sql.DB, username string) (int, error) {
-	query := "SELECT id FROM users WHERE username = $1"
+	query := "SELECT id FROM users WHERE lower(normalize(username, NFKC)) = lower(normalize($1, NFKC)) ORDER BY username = $1 DESC LIMIT 1"
 	var id int
 	err := db.QueryRow(query, username).Scan(&id)
 	if err != nil {
@@ -71,8 +151,15 @@ func realGetUserByIDQuery(db *sql.DB, userID string) (int, string, string, strin
 	return id, username, email, password, nil
 }
 
+// realGetUserByUsernameQuery matches case-insensitively. Accounts that only
+// differ in case from before the unique index existed are still reachable:
+// an exact match wins.
 func realGetUserByUsernameQuery(db *sql.DB, username string) (int, string, string, string, error) {
-	query := "SELECT id, username, email, password FROM users WHERE username = $1"
+	query := `
+SELECT id, username, email, password FROM users
+WHERE lower(normalize(username, NFKC)) = lower(normalize($1, NFKC))
+ORDER BY username = $1 DESC
+LIMIT 1`
 	row := db.QueryRow(query, username)
 
 	var id int
@@ -83,109 +170,253 @@ func realGetUserByUsernameQuery(db *sql.DB, username string) (int, string, strin
 	return id, dbUsername, email, password, nil
 }
 
-func realSearchPagesQuery(db *sql.DB, searchTerm, language string, limit int) ([]SearchResult, error) {
-	cappedLimit := clampLimit(limit)
-	languageCode := "en"
-	regConfig := "english"
-	if language == "da" {
-		languageCode = "da"
-		regConfig = "danish"
+func realGetUserByEmailQuery(db *sql.DB, email string) (int, string, string, string, error) {
+	query := `
+SELECT id, username, email, password FROM users
+WHERE lower(normalize(email, NFKC)) = lower(normalize($1, NFKC))
+ORDER BY email = $1 DESC
+LIMIT 1`
+	row := db.QueryRow(query, email)
+
+	var id int
+	var username, dbEmail, password string
+	if err := row.Scan(&id, &username, &dbEmail, &password); err != nil {
+		return 0, "", "", "", err
 	}
+	return id, username, dbEmail, password, nil
+}
 
-	query := `
-WITH fts AS (
+// searchBranch is the part of a search that runs with one text search
+// configuration: the pages it covers and the regconfig placeholder. code is
+// the language placeholder, empty for the branch covering all unregistered
+// languages.
+type searchBranch struct {
+	filter    string
+	code      string
+	regConfig string
+}
+
+// searchBranches splits a search by language. Every page is in exactly one
+// branch, so merging the branches never repeats a page.
+func searchBranches(p SearchParams, bind func(any) string) []searchBranch {
+	var branches []searchBranch
+	for _, lang := range p.Languages {
+		code := bind(lang)
+		branches = append(branches, searchBranch{filter: "p.language = " + code, code: code, regConfig: bind(regConfigFor(lang)) + "::regconfig"})
+	}
+	if p.AllLanguages {
+		branches = append(branches, searchBranch{
+			filter:    "NOT (p.language = ANY(" + bind(p.Languages) + "::text[]))",
+			regConfig: bind(fallbackRegConfig) + "::regconfig",
+		})
+	}
+	return branches
+}
+
+// realSearchPagesQuery returns full-text hits first and trigram fallback hits
+// (pages that match loosely but not as full text) after them, each ordered
+// by rank. The two tiers never overlap, so a keyset on (tier, rank, id)
+// pages through both without duplicates or gaps. The fallback tier is only
+// queried once the full-text hits run out, so a query with plenty of real
+// matches never pays for the trigram scan.
+func realSearchPagesQuery(db *sql.DB, p SearchParams) (SearchPage, error) {
+	parsed, err := parseSearchQuery(p.Query)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	limit := clampLimit(p.Limit)
+
+	var page SearchPage
+	for tier := 0; tier <= 1 && len(page.Results) <= limit; tier++ {
+		if p.After != nil && p.After.Tier > tier {
+			continue
+		}
+		// One row more than the page, to tell whether there is a next page.
+		query, args := searchPagesSQL(parsed, p, tier, limit+1-len(page.Results))
+		results, err := querySearchResults(db, query, args)
+		if err != nil {
+			return SearchPage{}, err
+		}
+		page.Results = append(page.Results, results...)
+	}
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		page.HasMore = true
+	}
+
+	if p.CountTotal {
+		// A first page that holds every hit is its own exact count; beyond
+		// that the planner's estimate stands in for counting every match.
+		page.Total = len(page.Results)
+		if page.HasMore {
+			estimate, err := estimateSearchHits(db, parsed, p)
+			if err != nil {
+				log.Printf("SearchPagesQuery count estimate error: %v", err)
+			}
+			page.Total = max(estimate, limit+1)
+			page.TotalEstimated = true
+		}
+	}
+	return page, nil
+}
+
+func querySearchResults(db *sql.DB, query string, args []any) ([]SearchResult, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var snippet sql.NullString
+		var lastUpdated sql.NullTime
+
+		if err := rows.Scan(&result.ID, &result.Tier, &result.Title, &result.URL, &result.Language, &lastUpdated, &snippet, &result.Rank); err != nil {
+			log.Printf("SearchPagesQuery row scan error: %v", err)
+			continue
+		}
+		if snippet.Valid {
+			result.Snippet = snippet.String
+		}
+		if lastUpdated.Valid {
+			result.LastUpdated = &lastUpdated.Time
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// searchPagesSQL builds the query for one tier of realSearchPagesQuery: 0
+// for full-text hits, 1 for the trigram fallback.
+//
+// Every rank depends only on the page and the query, never on the other
+// hits, so pages of results stay consistent and hits from several languages
+// merge into one order. ts_rank depends on the configuration (stemming,
+// stopwords) and is unbounded, so it is normalized with flag 32 to
+// rank/(rank+1), between 0 and 1; the recency boost is added after that.
+// Fallback ranks are trigram similarities and need no normalization.
+func searchPagesSQL(parsed searchQuery, p SearchParams, tier, limit int) (string, []any) {
+	// $1-$3 are fixed, the cursor and the per-language terms follow.
+	args := []any{parsed.included(), limit, p.AsOf}
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	after := "TRUE"
+	if p.After != nil && p.After.Tier == tier {
+		rank, id := bind(p.After.Rank)+"::float8", bind(p.After.ID)+"::bigint"
+		after = "(rank < " + rank + " OR (rank = " + rank + " AND id > " + id + "))"
+	}
+
+	// Every branch is searched with its own configuration, since the
+	// tsquery depends on it; the snippet picks the tsquery by page language.
+	hit := `
     SELECT
+        p.id,
         p.title,
         p.url,
         p.language,
         p.last_updated,
-        ts_headline(
-            $2::regconfig,
-            p.content,
-            plainto_tsquery($2::regconfig, $1),
-            'MaxFragments=2, MinWords=5, MaxWords=18, StartSel=<b>, StopSel=</b>'
-        ) AS snippet,
-        ts_rank(p.tsv_document, plainto_tsquery($2::regconfig, $1)) +
-        COALESCE(EXTRACT(EPOCH FROM (p.last_updated - NOW())) * 1e-8, 0) AS rank
+        p.content,
+        ts_rank(p.tsv_document, {{tsquery}}, 32)::float8 AS text_rank,
+        COALESCE(EXTRACT(EPOCH FROM (p.last_updated - $3::timestamptz)) * 1e-8, 0)::float8 AS boost
     FROM pages p
-    WHERE p.language = $4
-      AND p.tsv_document @@ plainto_tsquery($2::regconfig, $1)
-    ORDER BY rank DESC, p.last_updated DESC NULLS LAST
-    LIMIT $3
-),
-fallback AS (
+    WHERE {{filter}}
+      AND p.tsv_document @@ {{tsquery}}`
+	if tier == 1 {
+		hit = `
     SELECT
+        p.id,
         p.title,
         p.url,
         p.language,
         p.last_updated,
-        ts_headline(
-            $2::regconfig,
-            p.content,
-            plainto_tsquery($2::regconfig, $1),
-            'MaxFragments=2, MinWords=5, MaxWords=18, StartSel=<b>, StopSel=</b>'
-        ) AS snippet,
-        similarity(p.title, $1) * 1.5 + similarity(p.content, $1) AS rank
+        p.content,
+        (similarity(p.title, $1) * 1.5 + similarity(p.content, $1))::float8 AS text_rank,
+        0::float8 AS boost
     FROM pages p
-    WHERE p.language = $4
-      AND (
-        p.title ILIKE '%' || $1 || '%'
-        OR p.content ILIKE '%' || $1 || '%'
-        OR p.title % $1
-        OR p.content % $1
-      )
-      AND NOT EXISTS (SELECT 1 FROM fts f WHERE f.url = p.url)
-    ORDER BY rank DESC, p.last_updated DESC NULLS LAST
-    LIMIT $3
+    WHERE {{filter}}
+      AND {{match}}
+      AND NOT COALESCE(p.tsv_document @@ {{tsquery}}, false)`
+	}
+	var hits, headlines []string
+	for _, b := range searchBranches(p, bind) {
+		tsquery, match := parsed.toSQL(b.regConfig, bind)
+		hits = append(hits, strings.NewReplacer("{{filter}}", b.filter, "{{tsquery}}", tsquery, "{{match}}", match).Replace(hit))
+		headline := "ts_headline(" + b.regConfig + ", content, " + tsquery + ", 'MaxFragments=2, MinWords=5, MaxWords=18, StartSel=<b>, StopSel=</b>')"
+		if b.code != "" {
+			headlines = append(headlines, "WHEN "+b.code+" THEN "+headline)
+		} else {
+			headlines = append(headlines, "ELSE "+headline)
+		}
+	}
+
+	query := strings.NewReplacer("{{hits}}", strings.Join(hits, "\n    UNION ALL"), "{{tier}}", strconv.Itoa(tier), "{{headlines}}", strings.Join(headlines, "\n        "), "{{after}}", after).Replace(`
+WITH hits AS ({{hits}}
+),
+ranked AS (
+    SELECT id, title, url, language, last_updated, content, (text_rank + boost)::float8 AS rank
+    FROM hits
+),
+page AS (
+    SELECT * FROM ranked
+    WHERE {{after}}
+    ORDER BY rank DESC, id
+    LIMIT $2
 )
 SELECT
+    id,
+    {{tier}} AS tier,
     title,
     url,
     language,
     last_updated,
-    snippet,
+    CASE language
+        {{headlines}}
+    END AS snippet,
     rank
-FROM (
-    SELECT * FROM fts
-    UNION ALL
-    SELECT * FROM fallback WHERE (SELECT COUNT(*) FROM fts) < $3
-) AS combined
-ORDER BY rank DESC, last_updated DESC NULLS LAST
-LIMIT $3;
-`
-
-	rows, err := db.Query(query, searchTerm, regConfig, cappedLimit, languageCode)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			log.Printf("rows.Close failed: %v", err)
-		}
-	}()
+FROM page
+ORDER BY rank DESC, id;
+`)
 
-	var pages []SearchResult
-	for rows.Next() {
-		var page SearchResult
-		var snippet sql.NullString
-		var lastUpdated sql.NullTime
+	return query, args
+}
 
-		if err := rows.Scan(&page.Title, &page.URL, &page.Language, &lastUpdated, &snippet, &page.Rank); err != nil {
-			log.Printf("SearchPagesQuery row scan error: %v", err)
-			continue
-		}
-		if snippet.Valid {
-			page.Snippet = snippet.String
-		}
-		if lastUpdated.Valid {
-			page.LastUpdated = &lastUpdated.Time
-		}
-		pages = append(pages, page)
+// estimateSearchHits is the planner's estimate of how many pages
+// realSearchPagesQuery can return, read from EXPLAIN instead of counting
+// them.
+func estimateSearchHits(db *sql.DB, parsed searchQuery, p SearchParams) (int, error) {
+	var args []any
+	bind := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	var conds []string
+	for _, b := range searchBranches(p, bind) {
+		tsquery, match := parsed.toSQL(b.regConfig, bind)
+		conds = append(conds, "("+b.filter+" AND (p.tsv_document @@ "+tsquery+" OR "+match+"))")
+	}
+	query := `EXPLAIN (FORMAT JSON) SELECT 1 FROM pages p WHERE ` + strings.Join(conds, "\n   OR ")
+
+	var raw []byte
+	if err := db.QueryRow(query, args...).Scan(&raw); err != nil {
+		return 0, err
 	}
-	return pages, nil
+	var plan []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(raw, &plan); err != nil || len(plan) == 0 {
+		return 0, fmt.Errorf("unexpected EXPLAIN output: %s", raw)
+	}
+	return int(plan[0].Plan.Rows), nil
 }
 
 func clampLimit(limit int) int {
@@ -207,6 +438,81 @@ func realGetUserCountQuery(db *sql.DB) (float64, error) {
 	return count, nil
 }
 
+func realUpdateUserPasswordQuery(db *sql.DB, userID int, hash string) error {
+	_, err := db.Exec("UPDATE users SET password = $1 WHERE id = $2", hash, userID)
+	return err
+}
+
+// realUpdateUserEmailQuery changes the address, marks it unverified again and
+// drops pending verification links that were sent to the old address.
+func realUpdateUserEmailQuery(db *sql.DB, userID int, email string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Safety rollback if Commit is not reached
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.Exec("UPDATE users SET email = $2, email_verified = FALSE WHERE id = $1", userID, email)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// realDeleteUserQuery removes the user; sessions, tokens, 2FA, identities and
+// API keys go with it through ON DELETE CASCADE.
+func realDeleteUserQuery(db *sql.DB, userID int) error {
+	res, err := db.Exec("DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// realCountLegacyPasswordHashesQuery counts users whose hash is not bcrypt yet.
+// Unusable passwords ("!..." for SSO-only accounts) are not hashes and are skipped.
+func realCountLegacyPasswordHashesQuery(db *sql.DB) (float64, error) {
+	var count float64
+	err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE password !~ '^\$2[aby]\$' AND password NOT LIKE '!%'`).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func realGetUserRoleQuery(db *sql.DB, userID int) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+	return role, err
+}
+
+func realSetUserRoleQuery(db *sql.DB, userID int, role string) (bool, error) {
+	res, err := db.Exec("UPDATE users SET role = $2 WHERE id = $1", userID, role)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
 // ---- Assign real implementations ----
 
 func init() {
@@ -214,6 +520,13 @@ func init() {
 	GetUserIDQuery = realGetUserIDQuery
 	GetUserByIDQuery = realGetUserByIDQuery
 	GetUserByUsernameQuery = realGetUserByUsernameQuery
+	GetUserByEmailQuery = realGetUserByEmailQuery
 	SearchPagesQuery = realSearchPagesQuery
 	GetUserCountQuery = realGetUserCountQuery
+	UpdateUserPasswordQuery = realUpdateUserPasswordQuery
+	UpdateUserEmailQuery = realUpdateUserEmailQuery
+	DeleteUserQuery = realDeleteUserQuery
+	CountLegacyPasswordHashesQuery = realCountLegacyPasswordHashesQuery
+	GetUserRoleQuery = realGetUserRoleQuery
+	SetUserRoleQuery = realSetUserRoleQuery
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a small in-process sliding-window limiter keyed by string
+// (email, IP, ...). It is per instance, which is fine for our single-node deploy.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+// Allow records a hit for key and reports whether it is within the limit.
+func (r *rateLimiter) Allow(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-r.window)
+	recent := r.hits[key][:0]
+	for _, t := range r.hits[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= r.limit {
+		r.hits[key] = recent
+		return false
+	}
+	r.hits[key] = append(recent, now)
+
+	// Opportunistic cleanup so idle keys do not accumulate forever.
+	if len(r.hits) > 10000 {
+		for k, ts := range r.hits {
+			if len(ts) == 0 || ts[len(ts)-1].Before(cutoff) {
+				delete(r.hits, k)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RefreshToken is one link in a rotation chain. Every refresh replaces the
+// token with a new one in the same family; presenting an already used token
+// means it was copied, and the whole family is revoked.
+type RefreshToken struct {
+	TokenHash string
+	FamilyID  string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreateRefreshTokenQuery      func(db *sql.DB, t RefreshToken) error
+	GetRefreshTokenQuery         func(db *sql.DB, tokenHash string) (RefreshToken, error)
+	UseRefreshTokenQuery         func(db *sql.DB, tokenHash string) (RefreshToken, error)
+	RevokeRefreshFamilyQuery     func(db *sql.DB, familyID string) (int64, error)
+	RevokeUserRefreshTokensQuery func(db *sql.DB, userID int) (int64, error)
+)
+
+// ---- Real implementations ----
+
+func realCreateRefreshTokenQuery(db *sql.DB, t RefreshToken) error {
+	query := "INSERT INTO refresh_tokens (token_hash, family_id, user_id, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err := db.Exec(query, t.TokenHash, t.FamilyID, t.UserID, t.ExpiresAt)
+	return err
+}
+
+func realGetRefreshTokenQuery(db *sql.DB, tokenHash string) (RefreshToken, error) {
+	query := `
+SELECT token_hash, family_id, user_id, created_at, expires_at, used_at, revoked_at
+FROM refresh_tokens
+WHERE token_hash = $1`
+
+	var t RefreshToken
+	var used, revoked sql.NullTime
+	if err := db.QueryRow(query, tokenHash).Scan(&t.TokenHash, &t.FamilyID, &t.UserID, &t.CreatedAt, &t.ExpiresAt, &used, &revoked); err != nil {
+		return RefreshToken{}, err
+	}
+	if used.Valid {
+		t.UsedAt = &used.Time
+	}
+	if revoked.Valid {
+		t.RevokedAt = &revoked.Time
+	}
+	return t, nil
+}
+
+// realUseRefreshTokenQuery marks a valid token as used in one statement, so
+// two concurrent refreshes cannot both succeed. It returns sql.ErrNoRows for
+// unknown, used, revoked or expired tokens.
+func realUseRefreshTokenQuery(db *sql.DB, tokenHash string) (RefreshToken, error) {
+	query := `
+UPDATE refresh_tokens SET used_at = NOW()
+WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+RETURNING token_hash, family_id, user_id, created_at, expires_at`
+
+	var t RefreshToken
+	err := db.QueryRow(query, tokenHash).Scan(&t.TokenHash, &t.FamilyID, &t.UserID, &t.CreatedAt, &t.ExpiresAt)
+	return t, err
+}
+
+func realRevokeRefreshFamilyQuery(db *sql.DB, familyID string) (int64, error) {
+	res, err := db.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func realRevokeUserRefreshTokensQuery(db *sql.DB, userID int) (int64, error) {
+	res, err := db.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreateRefreshTokenQuery = realCreateRefreshTokenQuery
+	GetRefreshTokenQuery = realGetRefreshTokenQuery
+	UseRefreshTokenQuery = realUseRefreshTokenQuery
+	RevokeRefreshFamilyQuery = realRevokeRefreshFamilyQuery
+	RevokeUserRefreshTokensQuery = realRevokeUserRefreshTokensQuery
+}
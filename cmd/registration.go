@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Registration modes (REGISTRATION_MODE):
+//   - open:        anyone can sign up at /api/register
+//   - invite-only: signing up needs an invitation code issued by an admin
+//   - closed:      /api/register refuses every signup
+//
+// Single sign-on only creates new accounts in open mode; otherwise it logs in
+// and links existing accounts but refuses unknown identities.
+const (
+	registrationModeOpen       = "open"
+	registrationModeInviteOnly = "invite-only"
+	registrationModeClosed     = "closed"
+
+	defaultInvitationTTL = 7 * 24 * time.Hour
+	maxInvitationTTL     = 90 * 24 * time.Hour
+	maxInvitationUses    = 1000
+)
+
+var registrationMode = registrationModeOpen
+
+type CreateInvitationRequest struct {
+	Note           string `form:"note" json:"note"`
+	MaxUses        int    `form:"max_uses" json:"max_uses"`
+	ExpiresInHours int    `form:"expires_in_hours" json:"expires_in_hours"`
+}
+
+func configureRegistration() error {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("REGISTRATION_MODE")))
+	switch mode {
+	case "":
+		return nil
+	case registrationModeOpen, registrationModeInviteOnly, registrationModeClosed:
+		registrationMode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid REGISTRATION_MODE %q (expected open, invite-only or closed)", mode)
+}
+
+// rejectClosedRegistration sends a 403 and reports true when signups are closed.
+func rejectClosedRegistration(c *gin.Context) bool {
+	if registrationMode != registrationModeClosed {
+		return false
+	}
+	c.JSON(http.StatusForbidden, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"body", 0}, Msg: "registration is closed", Type: "registration_closed"}}})
+	return true
+}
+
+// claimInvitation uses up one use of the invitation code in invite-only mode
+// and returns the invitation id (0 in open mode), which has to be released if
+// the signup fails afterwards. On false the error response has been sent.
+func claimInvitation(c *gin.Context, code string) (int64, bool) {
+	if registrationMode != registrationModeInviteOnly {
+		return 0, true
+	}
+
+	code = strings.TrimSpace(code)
+	if code == "" {
+		c.JSON(http.StatusUnprocessableEntity, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"invite_code", 0}, Msg: "you need an invitation code to register", Type: "invite_required"}}})
+		return 0, false
+	}
+	id, err := ClaimInvitationQuery(db, hashToken(code))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[REGISTER] Failed to claim invitation: %v", err)
+		}
+		c.JSON(http.StatusUnprocessableEntity, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"invite_code", 0}, Msg: "the invitation code is invalid, expired or used up", Type: "invite_invalid"}}})
+		return 0, false
+	}
+	return id, true
+}
+
+func releaseInvitation(id int64) {
+	if id == 0 {
+		return
+	}
+	if err := ReleaseInvitationQuery(db, id); err != nil {
+		log.Printf("[REGISTER] Failed to release invitation id=%d: %v", id, err)
+	}
+}
+
+// apiRegistrationStatus godoc
+// @Summary Report how new accounts can be created
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} RegistrationStatusResponse
+// @Router /api/register [get]
+func apiRegistrationStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, RegistrationStatusResponse{Mode: registrationMode})
+}
+
+// apiAdminListInvitations godoc
+// @Summary List invitation codes
+// @Description The codes themselves are only shown once, when they are created.
+// @Tags Admin
+// @Produce json
+// @Success 200 {object} InvitationsResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Router /api/admin/invitations [get]
+func apiAdminListInvitations(c *gin.Context) {
+	invitations, err := ListInvitationsQuery(db)
+	if err != nil {
+		log.Printf("[ADMIN] Failed to list invitations: %v", err)
+		code := http.StatusInternalServerError
+		msg := "could not load invitations"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	c.JSON(http.StatusOK, InvitationsResponse{Data: invitations})
+}
+
+// apiAdminCreateInvitation godoc
+// @Summary Create an invitation code
+// @Description Defaults to a single use that expires after 7 days.
+// @Tags Admin
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body CreateInvitationRequest true "Note, usage limit and lifetime"
+// @Success 201 {object} InvitationCreatedResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/admin/invitations [post]
+func apiAdminCreateInvitation(c *gin.Context) {
+	var form CreateInvitationRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	if form.MaxUses == 0 {
+		form.MaxUses = 1
+	}
+	if form.MaxUses < 0 || form.MaxUses > maxInvitationUses {
+		sendValidationError(c, "max_uses", fmt.Sprintf("max_uses must be between 1 and %d", maxInvitationUses))
+		return
+	}
+	ttl := defaultInvitationTTL
+	if form.ExpiresInHours != 0 {
+		ttl = time.Duration(form.ExpiresInHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > maxInvitationTTL {
+		sendValidationError(c, "expires_in_hours", fmt.Sprintf("expires_in_hours must be between 1 and %d", int(maxInvitationTTL.Hours())))
+		return
+	}
+
+	admin, _ := currentUser(c)
+	inviteCode, err := randomToken(16)
+	var id int64
+	inv := Invitation{
+		Note:      strings.TrimSpace(form.Note),
+		CreatedBy: admin.ID,
+		MaxUses:   form.MaxUses,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err == nil {
+		inv.CodeHash = hashToken(inviteCode)
+		id, err = CreateInvitationQuery(db, inv)
+	}
+	if err != nil {
+		log.Printf("[ADMIN] Failed to create invitation: %v", err)
+		code := http.StatusInternalServerError
+		msg := "could not create invitation"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	inv.ID = id
+
+	log.Printf("[ADMIN] %s created invitation id=%d (max_uses=%d, expires=%s)", admin.Username, id, inv.MaxUses, inv.ExpiresAt.Format(time.RFC3339))
+	recordAudit(c, AuditEvent{Event: auditAdminInviteCreated, ActorID: admin.ID, ActorName: admin.Username, Details: map[string]any{"invitation_id": id, "max_uses": inv.MaxUses, "expires_at": inv.ExpiresAt}})
+	c.JSON(http.StatusCreated, InvitationCreatedResponse{Invitation: inv, Code: inviteCode})
+}
+
+// apiAdminRevokeInvitation godoc
+// @Summary Revoke an invitation code
+// @Tags Admin
+// @Produce json
+// @Param id path int true "Invitation id"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 403 {object} AuthResponse
+// @Failure 404 {object} AuthResponse
+// @Router /api/admin/invitations/{id} [delete]
+func apiAdminRevokeInvitation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		sendValidationError(c, "id", "invalid invitation id")
+		return
+	}
+	revoked, err := RevokeInvitationQuery(db, id)
+	if err != nil {
+		log.Printf("[ADMIN] Failed to revoke invitation id=%d: %v", id, err)
+		code := http.StatusInternalServerError
+		msg := "could not revoke invitation"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	if !revoked {
+		code := http.StatusNotFound
+		msg := "invitation not found"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	admin, _ := currentUser(c)
+	log.Printf("[ADMIN] %s revoked invitation id=%d", admin.Username, id)
+	recordAudit(c, AuditEvent{Event: auditAdminInviteRevoked, ActorID: admin.ID, ActorName: admin.Username, Details: map[string]any{"invitation_id": id}})
+	code := http.StatusOK
+	msg := "invitation revoked"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withRegistrationMode(t *testing.T, mode string) {
+	t.Helper()
+	previous := registrationMode
+	registrationMode = mode
+	t.Cleanup(func() { registrationMode = previous })
+}
+
+func registerBody(username, code string) string {
+	return `{"username":"` + username + `","email":"` + username + `@example.com","password":"correct horse battery","password2":"correct horse battery","invite_code":"` + code + `"}`
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	withRegistrationMode(t, registrationModeClosed)
+	router := setupRouter()
+
+	w := postJSON(router, "/api/register", registerBody("closedout", ""))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	resp := decode[HTTPValidationError](t, w.Body.Bytes())
+	assert.Equal(t, "registration_closed", resp.Detail[0].Type)
+
+	w = sendJSON(router, "GET", "/api/register", "")
+	assert.Equal(t, registrationModeClosed, decode[RegistrationStatusResponse](t, w.Body.Bytes()).Mode)
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	withRegistrationMode(t, registrationModeInviteOnly)
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 111, nil }
+	router := setupRouter()
+	admin := loginAs(t, 1, "admin")
+
+	w := postJSON(router, "/api/register", registerBody("uninvited", ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "invite_required", decode[HTTPValidationError](t, w.Body.Bytes()).Detail[0].Type)
+
+	w = postJSON(router, "/api/register", registerBody("guesser", "made-up-code"))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "invite_code", decode[HTTPValidationError](t, w.Body.Bytes()).Detail[0].Loc[0])
+
+	w = postJSON(router, "/api/admin/invitations", `{"note":"new team","max_uses":1}`, admin)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := decode[InvitationCreatedResponse](t, w.Body.Bytes())
+	assert.NotEmpty(t, created.Code)
+	assert.Equal(t, 1, created.MaxUses)
+
+	w = postJSON(router, "/api/register", registerBody("invited", created.Code))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The only use is gone.
+	w = postJSON(router, "/api/register", registerBody("latecomer", created.Code))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestInvitationReleasedWhenSignupFails(t *testing.T) {
+	withRegistrationMode(t, registrationModeInviteOnly)
+	router := setupRouter()
+	admin := loginAs(t, 1, "admin")
+	w := postJSON(router, "/api/admin/invitations", `{}`, admin)
+	created := decode[InvitationCreatedResponse](t, w.Body.Bytes())
+
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 0, errors.New("duplicate") }
+	w = postJSON(router, "/api/register", registerBody("taken", created.Code))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "database", decode[HTTPValidationError](t, w.Body.Bytes()).Detail[0].Loc[0])
+
+	mockInsertUserQuery = func(_ *sql.DB, u, e, p string) (int64, error) { return 112, nil }
+	w = postJSON(router, "/api/register", registerBody("second-try", created.Code))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestInvitationAdminEndpoints(t *testing.T) {
+	withRegistrationMode(t, registrationModeInviteOnly)
+	router := setupRouter()
+
+	user := loginAs(t, 113, "regular")
+	w := postJSON(router, "/api/admin/invitations", `{}`, user)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	admin := loginAs(t, 1, "admin")
+	w = postJSON(router, "/api/admin/invitations", `{"max_uses":0,"expires_in_hours":100000}`, admin)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = postJSON(router, "/api/admin/invitations", `{"max_uses":5,"expires_in_hours":24}`, admin)
+	created := decode[InvitationCreatedResponse](t, w.Body.Bytes())
+
+	w = sendJSON(router, "GET", "/api/admin/invitations", "", admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Code)
+
+	id := strconv.FormatInt(created.ID, 10)
+	assert.Equal(t, http.StatusOK, httpDelete(router, "/api/admin/invitations/"+id, "", admin).Code)
+	assert.Equal(t, http.StatusNotFound, httpDelete(router, "/api/admin/invitations/"+id, "", admin).Code)
+
+	w = postJSON(router, "/api/register", registerBody("too-late", created.Code))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
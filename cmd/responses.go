@@ -9,8 +9,34 @@ type WeatherResponse struct {
 	Data WeatherData `json:"data"`
 }
 
+// SearchResponse is one page of results. Pass next_cursor as cursor, with
+// the same q and language, to get the next page; it is absent on the last
+// page. total is exact when all results fit on the first page and an
+// estimate, flagged by total_estimated, otherwise. did_you_mean is a
+// spelling correction for q; corrected means data holds its results because
+// q itself found nothing.
 type SearchResponse struct {
-	Data []SearchResult `json:"data"`
+	Data           []SearchResult `json:"data"`
+	Total          int            `json:"total"`
+	TotalEstimated bool           `json:"total_estimated,omitempty"`
+	NextCursor     *string        `json:"next_cursor,omitempty"`
+	DidYouMean     *string        `json:"did_you_mean,omitempty"`
+	Corrected      bool           `json:"corrected,omitempty"`
+	// Languages are the languages searched; LanguageConfidence is set when
+	// they were detected from q rather than given.
+	Languages          []string `json:"languages"`
+	LanguageConfidence *float64 `json:"language_confidence,omitempty"`
+}
+
+type LanguageDetectionResponse struct {
+	Language   string          `json:"language"`
+	Confidence float64         `json:"confidence"`
+	Reliable   bool            `json:"reliable"`
+	Scores     []languageScore `json:"scores"`
+}
+
+type SuggestResponse struct {
+	Data []Suggestion `json:"data"`
 }
 
 type AuthResponse struct {
@@ -18,6 +44,68 @@ type AuthResponse struct {
 	Message    *string `json:"message"`
 }
 
+// TwoFactorChallengeResponse is returned by /api/login when a second factor is required.
+type TwoFactorChallengeResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+	Challenge  string `json:"challenge"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type OIDCStatusResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+type APIKeysResponse struct {
+	Data []APIKey `json:"data"`
+}
+
+// APIKeyCreatedResponse is the only time the full key is returned.
+type APIKeyCreatedResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type RegistrationStatusResponse struct {
+	Mode string `json:"mode"`
+}
+
+type InvitationsResponse struct {
+	Data []Invitation `json:"data"`
+}
+
+// InvitationCreatedResponse is the only time the invitation code is returned.
+type InvitationCreatedResponse struct {
+	Invitation
+	Code string `json:"code"`
+}
+
+type AuditEventsResponse struct {
+	Data []AuditEvent `json:"data"`
+	// NextBefore is set when there may be more events; pass it as ?before=.
+	NextBefore *int64 `json:"next_before,omitempty"`
+}
+
+// TokenResponse uses the OAuth 2.0 field names so standard clients can read it.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type SessionsResponse struct {
+	Data []Session `json:"data"`
+}
+
 type ValidationError struct {
 	Loc  []any  `json:"loc"`
 	Msg  string `json:"msg"`
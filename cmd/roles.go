@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles are stored on users.role. What a role may do is defined here in code,
+// so adding an admin endpoint only needs a permission and a requirePermission guard.
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+type permission string
+
+const (
+	permUnlockLogins      permission = "logins:unlock"
+	permManageUsers       permission = "users:manage"
+	permManagePages       permission = "pages:manage"
+	permReadStats         permission = "stats:read"
+	permManageInvitations permission = "invitations:manage"
+	permReadAudit         permission = "audit:read"
+)
+
+var rolePermissions = map[string][]permission{
+	roleUser:  {},
+	roleAdmin: {permUnlockLogins, permManageUsers, permManagePages, permReadStats, permManageInvitations, permReadAudit},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func hasPermission(role string, p permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// loadUserRole falls back to the least privileged role when the lookup fails.
+func loadUserRole(userID int) string {
+	role, err := GetUserRoleQuery(db, userID)
+	if err != nil || !validRole(role) {
+		if err != nil {
+			log.Printf("[ROLES] Failed to load role for user_id=%d: %v", userID, err)
+		}
+		return roleUser
+	}
+	return role
+}
+
+// requireRole must run after requireAuth and only lets the given roles through.
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := currentUser(c)
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+		forbid(c, user)
+	}
+}
+
+// requirePermission must run after requireAuth and checks the user's role grants p.
+func requirePermission(p permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := currentUser(c)
+		if !hasPermission(user.Role, p) {
+			forbid(c, user)
+			return
+		}
+		c.Next()
+	}
+}
+
+func forbid(c *gin.Context, user AuthUser) {
+	log.Printf("[ROLES] Refused user_id=%d (role=%s) on %s", user.ID, user.Role, c.Request.URL.Path)
+	code := http.StatusForbidden
+	msg := "you do not have permission to do that"
+	c.AbortWithStatusJSON(http.StatusForbidden, AuthResponse{&code, &msg})
+}
+
+// seededAdminPassword is the well-known password of the "admin" account that
+// earlier versions of InitDB seeded, stored as legacySeededAdminHash (MD5).
+// An account that still has it never holds the admin role.
+const (
+	seededAdminUsername   = "admin"
+	seededAdminPassword   = "password"
+	legacySeededAdminHash = "5f4dcc3b5aa765d61d8327deb882cf99"
+)
+
+// passwordResetRequired is stored for accounts that must choose a new
+// password through the password reset flow before they can log in; InitDB
+// seeds "admin" with it. Like unusablePassword, no passwordScheme
+// recognizes it.
+const passwordResetRequired = "!reset"
+
+// retireSeededPassword runs after InitDB and locks out accounts that still
+// have the seeded password until they reset it. Older databases hold its
+// public MD5 hash, or for "admin", the bcrypt hash a login upgraded it to.
+func retireSeededPassword(db *sql.DB) error {
+	var ids []int
+	rows, err := db.Query("SELECT id FROM users WHERE password = $1", legacySeededAdminHash)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	var id int
+	var hash string
+	err = db.QueryRow("SELECT id, password FROM users WHERE lower(normalize(username, NFKC)) = lower(normalize($1, NFKC))", seededAdminUsername).Scan(&id, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && hash != legacySeededAdminHash {
+		if ok, _, _ := verifyPassword(hash, seededAdminPassword); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		if _, err := db.Exec("UPDATE users SET password = $2 WHERE id = $1", id, passwordResetRequired); err != nil {
+			return err
+		}
+		if _, err := RevokeUserSessionsQuery(db, id); err != nil {
+			return err
+		}
+		if _, err := RevokeUserRefreshTokensQuery(db, id); err != nil {
+			return err
+		}
+		log.Printf("[ROLES] Locked user_id=%d until its password is reset: it had the seeded password", id)
+	}
+	return nil
+}
+
+// adminBootstrapUser is ADMIN_BOOTSTRAP_USER: the username that becomes the
+// first admin. It only takes effect while there is no admin at all, so it
+// can stay set; changing roles after that is up to the admins.
+var adminBootstrapUser string
+
+func configureAdminBootstrap() {
+	adminBootstrapUser = normalizeIdentifier(os.Getenv("ADMIN_BOOTSTRAP_USER"))
+}
+
+// bootstrapAdmin runs after InitDB. It demotes admins that still have the
+// seeded password (earlier versions promoted the seeded account on every
+// start) and then promotes adminBootstrapUser if no admin is left.
+func bootstrapAdmin(db *sql.DB) error {
+	admins, err := loadAdmins(db)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, a := range admins {
+		if ok, _, _ := verifyPassword(a.hash, seededAdminPassword); !ok {
+			remaining++
+			continue
+		}
+		if _, err := db.Exec("UPDATE users SET role = $2 WHERE id = $1", a.id, roleUser); err != nil {
+			return err
+		}
+		log.Printf("[ROLES] Demoted user_id=%d (%s): it still has the seeded password", a.id, a.username)
+	}
+
+	if adminBootstrapUser == "" || remaining > 0 {
+		return nil
+	}
+	var id int
+	var hash string
+	err = db.QueryRow("SELECT id, password FROM users WHERE lower(normalize(username, NFKC)) = lower(normalize($1, NFKC))", adminBootstrapUser).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		log.Printf("[ROLES] ADMIN_BOOTSTRAP_USER %q does not exist yet; register it and restart", adminBootstrapUser)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ok, _, _ := verifyPassword(hash, seededAdminPassword); ok || hash == passwordResetRequired {
+		log.Printf("[ROLES] Not promoting %q: change its password first", adminBootstrapUser)
+		return nil
+	}
+	if _, err := db.Exec("UPDATE users SET role = $2 WHERE id = $1", id, roleAdmin); err != nil {
+		return err
+	}
+	log.Printf("[ROLES] Promoted user_id=%d (%s) to admin from ADMIN_BOOTSTRAP_USER", id, adminBootstrapUser)
+	return nil
+}
+
+type adminAccount struct {
+	id       int
+	username string
+	hash     string
+}
+
+func loadAdmins(db *sql.DB) ([]adminAccount, error) {
+	rows, err := db.Query("SELECT id, username, password FROM users WHERE role = $1", roleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+	var admins []adminAccount
+	for rows.Next() {
+		var a adminAccount
+		if err := rows.Scan(&a.id, &a.username, &a.hash); err != nil {
+			return nil, err
+		}
+		admins = append(admins, a)
+	}
+	return admins, rows.Err()
+}
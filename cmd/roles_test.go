@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, hasPermission(roleAdmin, permManageUsers))
+	assert.False(t, hasPermission(roleUser, permManageUsers))
+	assert.False(t, hasPermission("superuser", permReadStats))
+	assert.False(t, validRole("superuser"))
+}
+
+func TestAdminSetRole(t *testing.T) {
+	router := setupRouter()
+
+	user := loginAs(t, 61, "promotee")
+	assert.Equal(t, roleUser, loadUserRole(61))
+	w := sendJSON(router, "PUT", "/api/admin/users/61/role", `{"role":"admin"}`, user)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	admin := loginAs(t, 1, "admin")
+	w = sendJSON(router, "PUT", "/api/admin/users/61/role", `{"role":"root"}`, admin)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = sendJSON(router, "PUT", "/api/admin/users/1/role", `{"role":"user"}`, admin)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = sendJSON(router, "PUT", "/api/admin/users/61/role", `{"role":"admin"}`, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, roleAdmin, loadUserRole(61))
+
+	// The new role applies on the next request of the existing session.
+	loginAs(t, 61, "promotee")
+	w = postJSON(router, "/api/admin/unlock", `{"username":"nobody"}`, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
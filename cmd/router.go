@@ -4,18 +4,83 @@ import "github.com/gin-gonic/gin"
 
 func newRouter() *gin.Engine {
 	router := gin.New()
-	router.Use(gin.Recovery(), loggingMiddleware(), BrowserMiddleware())
+	router.Use(gin.Recovery(), loggingMiddleware(), BrowserMiddleware(), csrfCookieMiddleware())
 
 	router.GET("/metrics", metricsEndpoint)
+	router.GET("/.well-known/jwks.json", serveJWKS)
+
+	// The token endpoints sit outside the /api group middleware: a client
+	// whose access token expired may still send it while refreshing. They
+	// never read the session cookie, so they need no CSRF check either.
+	router.POST("/api/token", apiToken)
+	router.POST("/api/token/revoke", apiRevokeToken)
 
 	api := router.Group("/api")
+	api.Use(bearerAuth(), sessionMiddleware(), csrfMiddleware())
 	{
 		api.GET("/weather", apiWeather)
-		api.GET("/search", apiSearch)
+		api.GET("/search", apiKeyAuth(), apiSearch)
+		api.GET("/suggest", apiSuggest)
+		api.POST("/languages/detect", apiDetectLanguage)
 		api.POST("/login", apiLogin)
+		api.POST("/login/2fa", apiLoginTwoFactor)
+		api.GET("/register", apiRegistrationStatus)
 		api.POST("/register", apiRegister)
-		api.GET("/logout", apiLogout)
+		api.POST("/logout", apiLogout)
+		api.GET("/logout", apiLogoutCompat)
 		api.GET("/session", apiSession)
+		api.POST("/password/forgot", apiForgotPassword)
+		api.POST("/password/reset", apiResetPassword)
+		api.GET("/verify", apiVerifyEmail)
+		api.POST("/verify", apiVerifyEmail)
+		api.POST("/verify/resend", apiResendVerification)
+		api.GET("/oidc", apiOIDCStatus)
+		api.GET("/oidc/login", apiOIDCLogin)
+		api.GET("/oidc/callback", apiOIDCCallback)
+	}
+
+	account := api.Group("/account", requireAuth())
+	{
+		account.POST("/password", apiChangePassword)
+		account.POST("/email", apiChangeEmail)
+		account.DELETE("", apiDeleteAccount)
+	}
+
+	me := api.Group("/me", requireAuth())
+	{
+		me.GET("/export", apiExportMyData)
+		me.GET("/export/:id", apiExportJob)
+	}
+
+	sessions := api.Group("/sessions", requireAuth(), requireVerifiedEmail())
+	{
+		sessions.GET("", apiListSessions)
+		sessions.DELETE("", apiRevokeAllSessions)
+		sessions.DELETE("/:id", apiRevokeSession)
+	}
+
+	twoFactor := api.Group("/2fa", requireAuth(), requireVerifiedEmail())
+	{
+		twoFactor.POST("/enroll", apiTwoFactorEnroll)
+		twoFactor.POST("/confirm", apiTwoFactorConfirm)
+		twoFactor.DELETE("", apiTwoFactorDisable)
+	}
+
+	keys := api.Group("/keys", requireAuth(), requireVerifiedEmail())
+	{
+		keys.GET("", apiListAPIKeys)
+		keys.POST("", apiCreateAPIKey)
+		keys.DELETE("/:id", apiRevokeAPIKey)
+	}
+
+	admin := api.Group("/admin", requireAuth(), requireRole(roleAdmin))
+	{
+		admin.POST("/unlock", requirePermission(permUnlockLogins), apiAdminUnlock)
+		admin.PUT("/users/:id/role", requirePermission(permManageUsers), apiAdminSetRole)
+		admin.GET("/invitations", requirePermission(permManageInvitations), apiAdminListInvitations)
+		admin.POST("/invitations", requirePermission(permManageInvitations), apiAdminCreateInvitation)
+		admin.DELETE("/invitations/:id", requirePermission(permManageInvitations), apiAdminRevokeInvitation)
+		admin.GET("/audit", requirePermission(permReadAudit), apiAdminAuditEvents)
 	}
 
 	router.GET("/docs", serveSwaggerUI)
@@ -24,6 +89,7 @@ func newRouter() *gin.Engine {
 	router.GET("/", serveIndexFile)
 	router.GET("/login", serveLoginFile)
 	router.GET("/register", serveRegisterFile)
+	router.GET("/reset-password", serveResetPasswordFile)
 	router.GET("/weather", serverWeatherFile)
 	router.GET("/about", serveAboutFile)
 	router.Static("/public", "./public")
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -13,11 +14,14 @@ import (
 // @Summary Search indexed pages
 // @Tags Search
 // @Produce json
+// @Description q supports "exact phrases", OR between terms and -term to exclude a term. With language=all every language is searched with its own stemming and the ranks are normalized per language before the results are merged; each result carries its language.
 // @Param q query string true "Search query"
-// @Param language query string false "Preferred language code" Enums(da,en)
+// @Param language query string false "Language code or name, e.g. da or danish, or all for every language (default: detected from q; when unsure, the two likeliest languages, or Danish, Norwegian and Swedish together)"
 // @Param limit query int false "Maximum results (1-50)" minimum(1) maximum(50) default(10)
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param autocorrect query bool false "Search the did_you_mean correction when q finds nothing" default(true)
 // @Success 200 {object} SearchResponse
-// @Failure 422 {object} RequestValidationError
+// @Failure 422 {object} RequestValidationError "Missing q, query syntax error, invalid cursor or search failure"
 // @Router /api/search [get]
 func apiSearch(c *gin.Context) {
 	q := strings.TrimSpace(c.Query("q"))
@@ -28,10 +32,36 @@ func apiSearch(c *gin.Context) {
 		return
 	}
 
-	lang := resolveLanguage(q, c.Query("language"))
+	parsed, err := parseSearchQuery(q)
+	if err != nil {
+		msg := "Invalid query: " + err.Error()
+		log.Printf("[SEARCH] Invalid query syntax: %v", err)
+		c.JSON(http.StatusUnprocessableEntity, RequestValidationError{StatusCode: 422, Message: &msg})
+		return
+	}
+
+	langs := resolveLanguages(parsed.included(), c.Query("language"))
 	limit := parseLimit(c.DefaultQuery("limit", "10"))
 
-	results, err := SearchPagesQuery(db, q, lang, limit)
+	params := SearchParams{Query: q, Languages: langs.Codes, AllLanguages: langs.All, Limit: limit, AsOf: time.Now().UTC().Truncate(time.Microsecond), CountTotal: true}
+	fingerprint := searchFingerprint(q, langs.key())
+	var cursor searchCursor
+	if raw := c.Query("cursor"); raw != "" {
+		if _, err = sessionKeys.open(sealPurposeSearchCursor, raw, &cursor); err != nil || cursor.Fingerprint != fingerprint {
+			msg := "Invalid cursor: it has to come from a search with the same q and language"
+			log.Printf("[SEARCH] Invalid cursor: %v", err)
+			c.JSON(http.StatusUnprocessableEntity, RequestValidationError{StatusCode: 422, Message: &msg})
+			return
+		}
+		params.AsOf = cursor.AsOf
+		params.After = &searchPosition{Tier: cursor.Tier, Rank: cursor.Rank, ID: cursor.ID}
+		params.CountTotal = false
+		if cursor.Corrected != "" {
+			params.Query = cursor.Corrected
+		}
+	}
+
+	page, err := SearchPagesQuery(db, params)
 	if err != nil {
 		msg := "Search failed: " + err.Error()
 		log.Printf("[SEARCH] Search failed: %v", msg)
@@ -39,42 +69,101 @@ func apiSearch(c *gin.Context) {
 		return
 	}
 
-	normalizedQuery := strings.ToLower(strings.TrimSpace(q))
-	searchQueryCounter.WithLabelValues(normalizedQuery).Inc()
+	var didYouMean string
+	if params.After == nil && page.Total < lowResultThreshold {
+		corrected, ok, err := correctSearchQuery(parsed, langs.Codes)
+		if err != nil {
+			log.Printf("[SEARCH] Spelling correction failed: %v", err)
+		}
+		if ok {
+			didYouMean = corrected.String()
+		}
+		// Nothing found at all: show what the correction finds instead.
+		if didYouMean != "" && page.Total == 0 && c.Query("autocorrect") != "false" {
+			retry := params
+			retry.Query = didYouMean
+			if retried, err := SearchPagesQuery(db, retry); err != nil {
+				log.Printf("[SEARCH] Corrected search failed: %v", err)
+			} else if retried.Total > 0 {
+				page, params = retried, retry
+			}
+		}
+	}
+
+	resp := SearchResponse{Data: page.Results, Total: page.Total, TotalEstimated: page.TotalEstimated, Corrected: params.Query != q, Languages: langs.Codes}
+	if langs.Detected {
+		resp.LanguageConfidence = &langs.Confidence
+	}
+	if didYouMean != "" {
+		resp.DidYouMean = &didYouMean
+	}
+	if params.After != nil {
+		// The total is counted once, on the first page.
+		resp.Total, resp.TotalEstimated = cursor.Total, cursor.TotalEstimated
+		if resp.Corrected {
+			resp.DidYouMean = &cursor.Corrected
+		}
+	} else {
+		normalizedQuery := strings.ToLower(strings.TrimSpace(q))
+		searchQueryCounter.WithLabelValues(normalizedQuery).Inc()
+		// Filed under the language of the best hit, which settles an
+		// uncertain detection.
+		if len(page.Results) > 0 {
+			lang := langs.primary()
+			if hit := page.Results[0].Language; hit != "" {
+				lang = hit
+			}
+			recordSearchQuery(lang, strings.ToLower(params.Query), c.ClientIP())
+		}
+	}
+	if page.HasMore && len(page.Results) > 0 {
+		last := page.Results[len(page.Results)-1]
+		next := searchCursor{
+			Fingerprint:    fingerprint,
+			AsOf:           params.AsOf,
+			Tier:           last.Tier,
+			Rank:           last.Rank,
+			ID:             last.ID,
+			Total:          resp.Total,
+			TotalEstimated: resp.TotalEstimated,
+		}
+		if resp.Corrected {
+			next.Corrected = params.Query
+		}
+		if encoded, err := sessionKeys.seal(sealPurposeSearchCursor, next); err != nil {
+			log.Printf("[SEARCH] Failed to seal cursor: %v", err)
+		} else {
+			resp.NextCursor = &encoded
+		}
+	}
 
 	safeQ := strings.ReplaceAll(strings.ReplaceAll(q, "\n", "_"), "\r", "_")
-	safeLang := strings.ReplaceAll(strings.ReplaceAll(lang, "\n", "_"), "\r", "_")
+	safeLang := strings.ReplaceAll(strings.ReplaceAll(langs.key(), "\n", "_"), "\r", "_")
 	safeLimit := strings.ReplaceAll(strings.ReplaceAll(strconv.Itoa(limit), "\n", "_"), "\r", "_")
 
 	log.Printf("[SEARCH] Search successful: q=%q, lang=%q, limit=%s", safeQ, safeLang, safeLimit)
-	c.JSON(http.StatusOK, SearchResponse{Data: results})
+	c.JSON(http.StatusOK, resp)
 }
 
-func resolveLanguage(query, langParam string) string {
-	normalized := strings.ToLower(strings.TrimSpace(langParam))
-	switch normalized {
-	case "da", "danish":
-		return "da"
-	case "en", "english":
-		return "en"
-	}
-
-	lower := strings.ToLower(query)
-	if strings.ContainsAny(lower, "\u00e6\u00f8\u00e5") {
-		return "da"
-	}
+// searchCursor is the opaque next_cursor: where the previous page ended,
+// plus what has to stay fixed while paging. It is sealed with the session
+// keys, since it carries the query to run (Corrected) and the reported
+// total, which a client must not be able to choose.
+type searchCursor struct {
+	Fingerprint    string    `json:"f"`
+	AsOf           time.Time `json:"t"`
+	Tier           int       `json:"k"`
+	Rank           float64   `json:"r"`
+	ID             int64     `json:"i"`
+	Total          int       `json:"n"`
+	TotalEstimated bool      `json:"e,omitempty"`
+	// Corrected is the query actually searched when q was autocorrected.
+	Corrected string `json:"q,omitempty"`
+}
 
-	danishHints := map[string]struct{}{
-		"og": {}, "ikke": {}, "det": {}, "der": {}, "som": {},
-		"jeg": {}, "du": {}, "vi": {}, "jer": {}, "for": {},
-		"med": {}, "uden": {}, "hvor": {}, "hvordan": {},
-	}
-	for _, token := range strings.Fields(lower) {
-		if _, ok := danishHints[token]; ok {
-			return "da"
-		}
-	}
-	return "en"
+// searchFingerprint ties a cursor to the search it was issued for.
+func searchFingerprint(q, lang string) string {
+	return hashToken(lang + "\x00" + q)[:16]
 }
 
 func parseLimit(raw string) int {
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search query syntax:
+//
+//	solar panels         both words (AND is implicit)
+//	"solar panel"        the exact phrase
+//	solar OR wind        either word; OR binds tighter than AND, so
+//	                     "cheap solar OR wind" is cheap AND (solar OR wind)
+//	-nuclear, -"x y"     leave out pages containing the word or phrase
+//
+// OR has to be upper case; a lower-case "or" is an ordinary word.
+const maxSearchTerms = 32
+
+type searchTerm struct {
+	Text   string
+	Phrase bool
+}
+
+// searchQuery is the parsed form of a query: every clause has to match (a
+// clause matches if any of its terms do) and no excluded term may match.
+type searchQuery struct {
+	Clauses [][]searchTerm
+	Exclude []searchTerm
+}
+
+// searchQueryError is a syntax error in q; Pos is the 1-based character offset.
+type searchQueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *searchQueryError) Error() string {
+	return fmt.Sprintf("%s (at character %d)", e.Msg, e.Pos)
+}
+
+type searchToken struct {
+	term    searchTerm
+	or      bool
+	negated bool
+	pos     int
+}
+
+func parseSearchQuery(q string) (searchQuery, error) {
+	tokens, err := tokenizeSearchQuery(q)
+	if err != nil {
+		return searchQuery{}, err
+	}
+	if len(tokens) > maxSearchTerms {
+		return searchQuery{}, &searchQueryError{Pos: tokens[maxSearchTerms].pos, Msg: "too many search terms, at most " + strconv.Itoa(maxSearchTerms) + " are allowed"}
+	}
+
+	var parsed searchQuery
+	joinNext := false
+	for i, tok := range tokens {
+		switch {
+		case tok.or:
+			if i == 0 || i == len(tokens)-1 {
+				return searchQuery{}, &searchQueryError{Pos: tok.pos, Msg: "OR needs a term on both sides"}
+			}
+			prev, next := tokens[i-1], tokens[i+1]
+			if prev.or || next.or || prev.negated || next.negated {
+				return searchQuery{}, &searchQueryError{Pos: tok.pos, Msg: "OR can only join terms to include, not OR or excluded terms"}
+			}
+			joinNext = true
+		case tok.negated:
+			parsed.Exclude = append(parsed.Exclude, tok.term)
+		case joinNext:
+			last := len(parsed.Clauses) - 1
+			parsed.Clauses[last] = append(parsed.Clauses[last], tok.term)
+			joinNext = false
+		default:
+			parsed.Clauses = append(parsed.Clauses, []searchTerm{tok.term})
+		}
+	}
+
+	if len(parsed.Clauses) == 0 {
+		return searchQuery{}, &searchQueryError{Pos: 1, Msg: "the query needs at least one term that is not excluded"}
+	}
+	return parsed, nil
+}
+
+func tokenizeSearchQuery(q string) ([]searchToken, error) {
+	runes := []rune(q)
+	var tokens []searchToken
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		tok := searchToken{pos: i + 1}
+		if runes[i] == '-' {
+			tok.negated = true
+			i++
+			if i == len(runes) || unicode.IsSpace(runes[i]) {
+				return nil, &searchQueryError{Pos: tok.pos, Msg: "'-' must be followed by the term to exclude"}
+			}
+		}
+
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &searchQueryError{Pos: i + 1, Msg: "unterminated quote"}
+			}
+			words := strings.Fields(string(runes[i+1 : end]))
+			if len(words) == 0 {
+				return nil, &searchQueryError{Pos: i + 1, Msg: "empty phrase"}
+			}
+			tok.term = searchTerm{Text: strings.Join(words, " "), Phrase: true}
+			i = end + 1
+		} else {
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '"' {
+				i++
+			}
+			word := string(runes[start:i])
+			tok.term = searchTerm{Text: word}
+			tok.or = word == "OR" && !tok.negated
+		}
+		tokens = append(tokens, tok)
+	}
+	if len(tokens) == 0 {
+		return nil, &searchQueryError{Pos: 1, Msg: "empty query"}
+	}
+	return tokens, nil
+}
+
+// included returns the terms to include, space separated, for ranking by
+// similarity and language detection.
+func (q searchQuery) included() string {
+	var words []string
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			words = append(words, term.Text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// String renders q back in the query syntax; parsing the result gives q again.
+func (q searchQuery) String() string {
+	render := func(t searchTerm) string {
+		if t.Phrase {
+			return `"` + t.Text + `"`
+		}
+		return t.Text
+	}
+	var parts []string
+	for _, clause := range q.Clauses {
+		var terms []string
+		for _, term := range clause {
+			terms = append(terms, render(term))
+		}
+		parts = append(parts, strings.Join(terms, " OR "))
+	}
+	for _, term := range q.Exclude {
+		parts = append(parts, "-"+render(term))
+	}
+	return strings.Join(parts, " ")
+}
+
+// toSQL renders q as a tsquery expression for full-text search and as a
+// boolean condition on p.title/p.content for the trigram fallback, so both
+// paths agree on phrases, OR and exclusions. User text never ends up in the
+// SQL itself: arg binds a value and returns its placeholder.
+func (q searchQuery) toSQL(regConfig string, arg func(any) string) (tsquery, match string) {
+	tsTerm := func(t searchTerm) string {
+		fn := "plainto_tsquery"
+		if t.Phrase {
+			fn = "phraseto_tsquery"
+		}
+		return fn + "(" + regConfig + ", " + arg(t.Text) + ")"
+	}
+	// Phrases fall back to a substring match; single words may also be
+	// misspelled, which the trigram operator catches.
+	likeTerm := func(t searchTerm) string {
+		pattern := arg("%" + escapeLike(t.Text) + "%")
+		cond := "p.title ILIKE " + pattern + " OR p.content ILIKE " + pattern
+		if !t.Phrase {
+			text := arg(t.Text)
+			cond += " OR p.title % " + text + " OR p.content % " + text
+		}
+		return "(" + cond + ")"
+	}
+
+	var tsParts, matchParts []string
+	for _, clause := range q.Clauses {
+		var tsAny, matchAny []string
+		for _, term := range clause {
+			tsAny = append(tsAny, tsTerm(term))
+			matchAny = append(matchAny, likeTerm(term))
+		}
+		tsParts = append(tsParts, "("+strings.Join(tsAny, " || ")+")")
+		matchParts = append(matchParts, "("+strings.Join(matchAny, " OR ")+")")
+	}
+	// Full text excludes whole words, so the fallback does too: "-cat" must
+	// not drop a page about categories.
+	for _, term := range q.Exclude {
+		tsParts = append(tsParts, "!!"+tsTerm(term))
+		pattern := arg(wordPattern(term.Text))
+		matchParts = append(matchParts, "NOT (p.title ~* "+pattern+" OR p.content ~* "+pattern+")")
+	}
+	return "(" + strings.Join(tsParts, " && ") + ")", strings.Join(matchParts, " AND ")
+}
+
+// wordPattern is a Postgres regular expression matching text as whole words;
+// the words of a phrase may be separated by any non-word characters, as
+// they may be for phraseto_tsquery. \m and \M only anchor at word
+// characters, so they are left off where the text starts or ends otherwise.
+func wordPattern(text string) string {
+	text = strings.TrimSpace(text)
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = regexp.QuoteMeta(w)
+	}
+	pattern := strings.Join(words, `\W+`)
+	isWord := func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+	if r, _ := utf8.DecodeRuneInString(text); isWord(r) {
+		pattern = `\m` + pattern
+	}
+	if r, _ := utf8.DecodeLastRuneInString(text); isWord(r) {
+		pattern += `\M`
+	}
+	return pattern
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	word := func(s string) searchTerm { return searchTerm{Text: s} }
+	phrase := func(s string) searchTerm { return searchTerm{Text: s, Phrase: true} }
+
+	tests := []struct {
+		in   string
+		want searchQuery
+	}{
+		{"solar panels", searchQuery{Clauses: [][]searchTerm{{word("solar")}, {word("panels")}}}},
+		{`"solar  panel" cost`, searchQuery{Clauses: [][]searchTerm{{phrase("solar panel")}, {word("cost")}}}},
+		{"cheap solar OR wind OR hydro", searchQuery{Clauses: [][]searchTerm{{word("cheap")}, {word("solar"), word("wind"), word("hydro")}}}},
+		{`energy -nuclear -"coal plant"`, searchQuery{Clauses: [][]searchTerm{{word("energy")}}, Exclude: []searchTerm{word("nuclear"), phrase("coal plant")}}},
+		{"rock or roll", searchQuery{Clauses: [][]searchTerm{{word("rock")}, {word("or")}, {word("roll")}}}},
+		{"e-mail", searchQuery{Clauses: [][]searchTerm{{word("e-mail")}}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSearchQuery(tt.in)
+		if assert.NoError(t, err, tt.in) {
+			assert.Equal(t, tt.want, got, tt.in)
+			again, err := parseSearchQuery(got.String())
+			assert.NoError(t, err, tt.in)
+			assert.Equal(t, got, again, "String round-trips "+tt.in)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := map[string]int{
+		`"open phrase`: 1,
+		`a ""`:         3,
+		"OR a":         1,
+		"a OR":         3,
+		"a OR OR b":    3,
+		"a OR -b":      3,
+		"a -":          3,
+		"-only -these": 1,
+		"a " + `-"x`:   4,
+	}
+	for in, pos := range tests {
+		_, err := parseSearchQuery(in)
+		var qerr *searchQueryError
+		if assert.ErrorAs(t, err, &qerr, in) {
+			assert.Equal(t, pos, qerr.Pos, in)
+		}
+	}
+}
+
+func TestSearchQueryToSQLBindsAllUserText(t *testing.T) {
+	q, err := parseSearchQuery(`"50% off" sale OR deal -x_y`)
+	assert.NoError(t, err)
+
+	var args []any
+	tsquery, match := q.toSQL("$2::regconfig", func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+	assert.Equal(t, "((phraseto_tsquery($2::regconfig, $1)) && (plainto_tsquery($2::regconfig, $3) || plainto_tsquery($2::regconfig, $6)) && !!plainto_tsquery($2::regconfig, $9))", tsquery)
+	assert.Equal(t, "((p.title ILIKE $2 OR p.content ILIKE $2)) AND "+
+		"((p.title ILIKE $4 OR p.content ILIKE $4 OR p.title % $5 OR p.content % $5) OR (p.title ILIKE $7 OR p.content ILIKE $7 OR p.title % $8 OR p.content % $8)) AND "+
+		"NOT (p.title ~* $10 OR p.content ~* $10)", match)
+	assert.Contains(t, args, `%50\% off%`)
+	assert.Contains(t, args, `\mx_y\M`)
+	assert.Equal(t, "50% off sale deal", q.included())
+}
+
+func TestSearchPagesSQLSplitsTiers(t *testing.T) {
+	parsed, err := parseSearchQuery("docker")
+	assert.NoError(t, err)
+	p := SearchParams{Languages: []string{"en"}, After: &searchPosition{Tier: 0, Rank: 0.5, ID: 7}}
+
+	fullText, args := searchPagesSQL(parsed, p, 0, 11)
+	assert.NotContains(t, fullText, "similarity(")
+	assert.Contains(t, fullText, "rank < $")
+	assert.Contains(t, args, 0.5)
+	assert.Equal(t, 11, args[1])
+
+	// The fallback tier starts from the top once the cursor is past the
+	// full-text hits, and only the fallback scans with trigrams.
+	fallback, args := searchPagesSQL(parsed, p, 1, 3)
+	assert.NotContains(t, fallback, "ts_rank(")
+	assert.Contains(t, fallback, "similarity(p.title, $1)")
+	assert.Contains(t, fallback, "WHERE TRUE")
+	assert.NotContains(t, args, 0.5)
+	assert.Equal(t, 3, args[1])
+}
+
+func TestWordPattern(t *testing.T) {
+	for in, want := range map[string]string{
+		"cat":        `\mcat\M`,
+		"kæmpe":      `\mkæmpe\M`,
+		"c++":        `\mc\+\+`,
+		".net":       `\.net\M`,
+		"50% off":    `\m50%\W+off\M`,
+		"a.b (x)|y*": `\ma\.b\W+\(x\)\|y\*`,
+	} {
+		assert.Equal(t, want, wordPattern(in), in)
+	}
+
+	// Postgres' \m and \M match where Go's \b does; enough to check that
+	// only whole words are excluded.
+	re := regexp.MustCompile(`(?i)` + strings.NewReplacer(`\m`, `\b`, `\M`, `\b`).Replace(wordPattern("cat")))
+	assert.True(t, re.MatchString("The Cat sat"))
+	assert.False(t, re.MatchString("categories and concatenation"))
+}
+
+func TestSearchRejectsInvalidQuerySyntax(t *testing.T) {
+	called := false
+	mockSearchPagesQuery = func(_ *sql.DB, _ SearchParams) (SearchPage, error) {
+		called = true
+		return SearchPage{}, nil
+	}
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/search?q="+url.QueryEscape(`"unfinished`), nil)
+
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	resp := decode[RequestValidationError](t, w.Body.Bytes())
+	assert.Contains(t, *resp.Message, "unterminated quote")
+	assert.False(t, called)
+}
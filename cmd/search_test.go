@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,8 +27,8 @@ func TestSearchMissingQuery(t *testing.T) {
 }
 
 func TestSearchDBError(t *testing.T) {
-	mockSearchPagesQuery = func(_ *sql.DB, q, l string, limit int) ([]SearchResult, error) {
-		return nil, errors.New("boom")
+	mockSearchPagesQuery = func(_ *sql.DB, _ SearchParams) (SearchPage, error) {
+		return SearchPage{}, errors.New("boom")
 	}
 	router := setupRouter()
 	w := httptest.NewRecorder()
@@ -40,9 +41,9 @@ func TestSearchDBError(t *testing.T) {
 }
 
 func TestSearchSuccess(t *testing.T) {
-	mockSearchPagesQuery = func(_ *sql.DB, q, l string, limit int) ([]SearchResult, error) {
+	mockSearchPagesQuery = func(_ *sql.DB, _ SearchParams) (SearchPage, error) {
 		now := time.Now()
-		return []SearchResult{
+		return SearchPage{Results: []SearchResult{
 			{
 				Title:       "hi",
 				URL:         "https://example.com",
@@ -50,7 +51,7 @@ func TestSearchSuccess(t *testing.T) {
 				LastUpdated: &now,
 				Snippet:     "hello world",
 			},
-		}, nil
+		}}, nil
 	}
 	router := setupRouter()
 	w := httptest.NewRecorder()
@@ -61,3 +62,88 @@ func TestSearchSuccess(t *testing.T) {
 	resp := decode[SearchResponse](t, w.Body.Bytes())
 	assert.Len(t, resp.Data, 1)
 }
+
+// pagedSearchMock pages through hits like realSearchPagesQuery: ordered by
+// (tier, rank DESC, id), continuing after p.After.
+func pagedSearchMock(hits []SearchResult, seen *[]SearchParams) func(*sql.DB, SearchParams) (SearchPage, error) {
+	return func(_ *sql.DB, p SearchParams) (SearchPage, error) {
+		*seen = append(*seen, p)
+		var page SearchPage
+		if p.CountTotal {
+			page.Total = len(hits)
+		}
+		for _, h := range hits {
+			if a := p.After; a != nil && (h.Tier < a.Tier || h.Tier == a.Tier && (h.Rank > a.Rank || h.Rank == a.Rank && h.ID <= a.ID)) {
+				continue
+			}
+			if len(page.Results) == p.Limit {
+				page.HasMore = true
+				break
+			}
+			page.Results = append(page.Results, h)
+		}
+		return page, nil
+	}
+}
+
+func TestSearchPaginatesWithCursor(t *testing.T) {
+	hits := []SearchResult{
+		{ID: 7, Tier: 0, Rank: 0.9, Title: "a"},
+		{ID: 3, Tier: 0, Rank: 0.5, Title: "b"},
+		{ID: 5, Tier: 0, Rank: 0.5, Title: "c"},
+		{ID: 2, Tier: 1, Rank: 0.8, Title: "d"},
+		{ID: 9, Tier: 1, Rank: 0.1, Title: "e"},
+	}
+	var seen []SearchParams
+	mockSearchPagesQuery = pagedSearchMock(hits, &seen)
+	router := setupRouter()
+
+	var titles []string
+	path := "/api/search?q=solar&limit=2"
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, len(hits), "pagination does not terminate")
+		w := sendJSON(router, "GET", path, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		resp := decode[SearchResponse](t, w.Body.Bytes())
+		assert.Equal(t, len(hits), resp.Total, "the first page's total is kept")
+		for _, r := range resp.Data {
+			titles = append(titles, r.Title)
+		}
+		if resp.NextCursor == nil {
+			break
+		}
+		path = "/api/search?q=solar&limit=2&cursor=" + *resp.NextCursor
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, titles)
+
+	if assert.Len(t, seen, 3) {
+		assert.True(t, seen[0].CountTotal)
+		assert.False(t, seen[1].CountTotal)
+		assert.Equal(t, seen[0].AsOf, seen[2].AsOf, "the recency reference stays fixed")
+	}
+}
+
+func TestSearchRejectsForeignCursor(t *testing.T) {
+	var seen []SearchParams
+	mockSearchPagesQuery = pagedSearchMock([]SearchResult{{ID: 1}, {ID: 2}}, &seen)
+	router := setupRouter()
+
+	w := sendJSON(router, "GET", "/api/search?q=solar&limit=1", "")
+	resp := decode[SearchResponse](t, w.Body.Bytes())
+	if !assert.NotNil(t, resp.NextCursor) {
+		return
+	}
+	// A cursor for this very search, but not sealed by the server, cannot
+	// swap in a query of its own.
+	forged, err := newEphemeralKeyring().seal(sealPurposeSearchCursor, searchCursor{Fingerprint: searchFingerprint("solar", strings.Join(resp.Languages, ",")), Corrected: "anything else"})
+	assert.NoError(t, err)
+	for _, path := range []string{
+		"/api/search?q=wind&limit=1&cursor=" + *resp.NextCursor,
+		"/api/search?q=solar&language=da&limit=1&cursor=" + *resp.NextCursor,
+		"/api/search?q=solar&cursor=not-a-cursor",
+		"/api/search?q=solar&limit=1&cursor=" + forged,
+	} {
+		w = sendJSON(router, "GET", path, "")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, path)
+	}
+}
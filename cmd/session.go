@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Session tokens have the form "<kid>.<payload>.<signature>" where payload is
+// base64url-encoded JSON claims and signature is HMAC-SHA256 over "<kid>.<payload>".
+// The kid lets us rotate keys: the first configured key signs new tokens, while
+// the remaining keys are still accepted for verification until they are removed.
+//
+// Example:
+//
+//	SESSION_KEYS=2025-11:c2VjcmV0LW5ldw==,2025-10:c2VjcmV0LW9sZA==
+//	SESSION_TTL=24h
+
+const defaultSessionTTL = 24 * time.Hour
+
+var (
+	errInvalidSessionToken = errors.New("invalid session token")
+	errExpiredSessionToken = errors.New("session token expired")
+)
+
+type sessionClaims struct {
+	SessionID string `json:"sid"`
+	UserID    int    `json:"uid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type sessionKey struct {
+	ID     string
+	Secret []byte
+}
+
+// sessionKeyring holds the signing keys. keys[0] is the active key.
+type sessionKeyring struct {
+	keys []sessionKey
+}
+
+var (
+	sessionKeys = newEphemeralKeyring()
+	sessionTTL  = defaultSessionTTL
+)
+
+// configureSessions loads SESSION_KEYS and SESSION_TTL from the environment.
+// Without SESSION_KEYS a random key is used, so sessions do not survive restarts.
+func configureSessions() error {
+	if raw := os.Getenv("SESSION_KEYS"); raw != "" {
+		keyring, err := parseSessionKeys(raw)
+		if err != nil {
+			return err
+		}
+		sessionKeys = keyring
+	} else {
+		log.Printf("[SESSION] SESSION_KEYS is not set, using an ephemeral signing key")
+	}
+
+	if raw := os.Getenv("SESSION_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid SESSION_TTL %q", raw)
+		}
+		sessionTTL = ttl
+	}
+	return nil
+}
+
+func parseSessionKeys(raw string) (*sessionKeyring, error) {
+	keyring := &sessionKeyring{}
+	seen := map[string]struct{}{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid SESSION_KEYS entry %q (expected kid:base64secret)", id)
+		}
+		if _, dup := seen[id]; dup {
+			return nil, fmt.Errorf("duplicate SESSION_KEYS kid %q", id)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_KEYS kid %q: %w", id, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("SESSION_KEYS kid %q: secret must be at least 32 bytes", id)
+		}
+		seen[id] = struct{}{}
+		keyring.keys = append(keyring.keys, sessionKey{ID: id, Secret: secret})
+	}
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("SESSION_KEYS contains no keys")
+	}
+	return keyring, nil
+}
+
+func newEphemeralKeyring() *sessionKeyring {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &sessionKeyring{keys: []sessionKey{{ID: "ephemeral", Secret: secret}}}
+}
+
+func (k *sessionKeyring) active() sessionKey {
+	return k.keys[0]
+}
+
+func (k *sessionKeyring) lookup(id string) (sessionKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return sessionKey{}, false
+}
+
+// Purposes of sealed tokens. Every use has its own, so a token sealed for
+// one (say the OIDC flow cookie) is never accepted as another (a session).
+const (
+	sealPurposeSession      = "session"
+	sealPurposeOIDCFlow     = "oidc_flow"
+	sealPurposeSearchCursor = "search_cursor"
+)
+
+// sealedPayload is what a sealed token carries: the purpose next to the value.
+type sealedPayload struct {
+	Purpose string          `json:"pur"`
+	Value   json.RawMessage `json:"val"`
+}
+
+// seal signs v as JSON with the active key. Besides session cookies it is
+// used for other short-lived browser state that must not be tampered with.
+func (k *sessionKeyring) seal(purpose string, v any) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(sealedPayload{Purpose: purpose, Value: value})
+	if err != nil {
+		return "", err
+	}
+	key := k.active()
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signSessionPart(key.Secret, signed), nil
+}
+
+// open verifies a sealed token, checks that it was sealed for purpose and
+// decodes it into v, returning the kid that signed it.
+func (k *sessionKeyring) open(purpose, token string, v any) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidSessionToken
+	}
+	key, ok := k.lookup(parts[0])
+	if !ok {
+		return "", errInvalidSessionToken
+	}
+	expected := signSessionPart(key.Secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", errInvalidSessionToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errInvalidSessionToken
+	}
+	var sealed sealedPayload
+	if err := json.Unmarshal(payload, &sealed); err != nil || sealed.Purpose != purpose {
+		return "", errInvalidSessionToken
+	}
+	if err := json.Unmarshal(sealed.Value, v); err != nil {
+		return "", errInvalidSessionToken
+	}
+	return key.ID, nil
+}
+
+func (k *sessionKeyring) sign(claims sessionClaims) (string, error) {
+	return k.seal(sealPurposeSession, claims)
+}
+
+// verify checks the signature and expiry of token. The returned kid tells the
+// caller whether the token was signed with a retired key and should be reissued.
+func (k *sessionKeyring) verify(token string, now time.Time) (sessionClaims, string, error) {
+	var claims sessionClaims
+	kid, err := k.open(sealPurposeSession, token, &claims)
+	if err != nil || claims.UserID <= 0 || claims.SessionID == "" {
+		return sessionClaims{}, "", errInvalidSessionToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return sessionClaims{}, "", errExpiredSessionToken
+	}
+	return claims, kid, nil
+}
+
+func signSessionPart(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueSessionToken creates a signed token for the stored session sessionID.
+func issueSessionToken(sessionID string, userID int, expiresAt time.Time) (string, error) {
+	return sessionKeys.sign(sessionClaims{
+		SessionID: sessionID,
+		UserID:    userID,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken returns the hex SHA-256 of a random token. High-entropy tokens do
+// not need a slow hash, and a fixed digest lets us look them up by value.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
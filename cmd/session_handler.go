@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"WHOKNOWS_VARIATIONS/util"
+	"github.com/gin-gonic/gin"
+)
+
+// apiListSessions godoc
+// @Summary List the active sessions of the logged-in user
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} SessionsResponse
+// @Failure 401 {object} AuthResponse
+// @Router /api/sessions [get]
+func apiListSessions(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	sessions, err := ListSessionsQuery(db, user.ID)
+	if err != nil {
+		log.Printf("[SESSIONS] Failed to list sessions for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not list sessions"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+
+	current := currentSessionID(c)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(http.StatusOK, SessionsResponse{Data: sessions})
+}
+
+// apiRevokeSession godoc
+// @Summary Revoke one of the logged-in user's sessions
+// @Tags Auth
+// @Produce json
+// @Param id path string true "Session id"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 404 {object} AuthResponse
+// @Router /api/sessions/{id} [delete]
+func apiRevokeSession(c *gin.Context) {
+	user, _ := currentUser(c)
+	sessionID := c.Param("id")
+
+	revoked, err := RevokeSessionQuery(db, user.ID, sessionID)
+	if err != nil {
+		log.Printf("[SESSIONS] Failed to revoke session for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not revoke session"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	if !revoked {
+		code := http.StatusNotFound
+		msg := "session not found"
+		c.JSON(http.StatusNotFound, AuthResponse{&code, &msg})
+		return
+	}
+
+	if sessionID == currentSessionID(c) {
+		util.RemoveAuthCookie(c)
+	}
+	log.Printf("[SESSIONS] user_id=%d revoked a session from IP=%s", user.ID, c.ClientIP())
+	auditSelf(c, auditSessionsRevoked, map[string]any{"count": 1})
+	code := http.StatusOK
+	msg := "session revoked"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiRevokeAllSessions godoc
+// @Summary Log out everywhere by revoking all of the user's sessions
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Router /api/sessions [delete]
+func apiRevokeAllSessions(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	n, err := RevokeUserSessionsQuery(db, user.ID)
+	if err != nil {
+		log.Printf("[SESSIONS] Failed to revoke sessions for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not revoke sessions"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+
+	if _, err := RevokeUserRefreshTokensQuery(db, user.ID); err != nil {
+		log.Printf("[SESSIONS] Failed to revoke refresh tokens for user_id=%d: %v", user.ID, err)
+	}
+
+	util.RemoveAuthCookie(c)
+	log.Printf("[SESSIONS] user_id=%d logged out everywhere (%d sessions)", user.ID, n)
+	auditSelf(c, auditSessionsRevoked, map[string]any{"count": n, "all": true})
+	code := http.StatusOK
+	msg := "logged out everywhere"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"WHOKNOWS_VARIATIONS/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,13 +24,148 @@ func TestSessionNotLoggedIn(t *testing.T) {
 }
 
 func TestSessionLoggedIn(t *testing.T) {
+	cookie := loginAs(t, 1, "admin")
+
 	router := setupRouter()
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/api/session", nil)
-	req.AddCookie(&http.Cookie{Name: "user_id", Value: "1"})
+	req.AddCookie(cookie)
 
 	router.ServeHTTP(w, req)
 	resp := decode[AuthResponse](t, w.Body.Bytes())
 	assert.Equal(t, 200, *resp.StatusCode)
 	assert.Equal(t, "logged in", *resp.Message)
 }
+
+func TestSessionForgedCookieRejected(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/session", nil)
+	req.AddCookie(&http.Cookie{Name: util.AuthCookieName, Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "user_id", Value: "1"})
+
+	router.ServeHTTP(w, req)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, 401, *resp.StatusCode)
+}
+
+func TestSessionUnknownToStoreRejected(t *testing.T) {
+	// Correctly signed, but never recorded in the session store.
+	token, _ := issueSessionToken("not-stored", 1, time.Now().Add(time.Hour))
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/session", nil)
+	req.AddCookie(&http.Cookie{Name: util.AuthCookieName, Value: token})
+
+	router.ServeHTTP(w, req)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, 401, *resp.StatusCode)
+}
+
+func TestSessionDeletedUserRejected(t *testing.T) {
+	cookie := loginAs(t, 42, "gone")
+	mockGetUserByIDQuery = func(_ *sql.DB, id string) (int, string, string, string, error) {
+		return 0, "", "", "", errors.New("not found")
+	}
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/session", nil)
+	req.AddCookie(cookie)
+
+	router.ServeHTTP(w, req)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, 401, *resp.StatusCode)
+}
+
+// --- /api/sessions ---
+
+func TestListSessionsRequiresLogin(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/sessions", nil)
+
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestListSessionsMarksCurrent(t *testing.T) {
+	loginAs(t, 5, "lister")
+	cookie := loginAs(t, 5, "lister")
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/sessions", nil)
+	req.AddCookie(cookie)
+
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[SessionsResponse](t, w.Body.Bytes())
+	assert.Len(t, resp.Data, 2)
+
+	current := 0
+	for _, s := range resp.Data {
+		if s.Current {
+			current++
+		}
+	}
+	assert.Equal(t, 1, current)
+}
+
+func TestRevokeSessionInvalidatesCookie(t *testing.T) {
+	other := loginAs(t, 6, "revoker")
+	cookie := loginAs(t, 6, "revoker")
+	claims, _, _ := sessionKeys.verify(other.Value, time.Now())
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/sessions/"+claims.SessionID, nil)
+	withCSRF(req)
+	req.AddCookie(cookie)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/session", nil)
+	req.AddCookie(other)
+	router.ServeHTTP(w, req)
+	resp := decode[AuthResponse](t, w.Body.Bytes())
+	assert.Equal(t, 401, *resp.StatusCode)
+}
+
+func TestRevokeSessionOfOtherUserNotFound(t *testing.T) {
+	victim := loginAs(t, 7, "victim")
+	claims, _, _ := sessionKeys.verify(victim.Value, time.Now())
+	attacker := loginAs(t, 8, "attacker")
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/sessions/"+claims.SessionID, nil)
+	withCSRF(req)
+	req.AddCookie(attacker)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLogoutEverywhere(t *testing.T) {
+	first := loginAs(t, 9, "everywhere")
+	second := loginAs(t, 9, "everywhere")
+
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/sessions", nil)
+	withCSRF(req)
+	req.AddCookie(second)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for _, cookie := range []*http.Cookie{first, second} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/api/session", nil)
+		req.AddCookie(cookie)
+		router.ServeHTTP(w, req)
+		resp := decode[AuthResponse](t, w.Body.Bytes())
+		assert.Equal(t, 401, *resp.StatusCode)
+	}
+}
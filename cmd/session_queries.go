@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+type Session struct {
+	ID             string    `json:"id"`
+	UserID         int       `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastSeen       time.Time `json:"last_seen"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	Browser        string    `json:"browser"`
+	BrowserVersion string    `json:"browser_version"`
+	Current        bool      `json:"current"`
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	CreateSessionQuery      func(db *sql.DB, s Session) error
+	GetSessionUserQuery     func(db *sql.DB, sessionID string) (Session, AuthUser, error)
+	ListSessionsQuery       func(db *sql.DB, userID int) ([]Session, error)
+	RevokeSessionQuery      func(db *sql.DB, userID int, sessionID string) (bool, error)
+	RevokeUserSessionsQuery func(db *sql.DB, userID int) (int64, error)
+)
+
+// ---- Real implementations ----
+
+func realCreateSessionQuery(db *sql.DB, s Session) error {
+	query := `
+INSERT INTO sessions (id, user_id, expires_at, ip, user_agent, browser, browser_version)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := db.Exec(query, s.ID, s.UserID, s.ExpiresAt, s.IP, s.UserAgent, s.Browser, s.BrowserVersion)
+	return err
+}
+
+// realGetSessionUserQuery loads an active session together with its user in
+// one round trip, and bumps last_seen when it is older than
+// sessionTouchInterval. The SELECT sees the row from before the update. It
+// returns sql.ErrNoRows for unknown, revoked or expired sessions.
+func realGetSessionUserQuery(db *sql.DB, sessionID string) (Session, AuthUser, error) {
+	query := `
+WITH touched AS (
+  UPDATE sessions SET last_seen = NOW()
+  WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+    AND last_seen < NOW() - make_interval(secs => $2)
+)
+SELECT s.id, s.user_id, s.created_at, s.last_seen, s.expires_at,
+       u.username, u.email, u.email_verified, u.role
+FROM sessions s
+JOIN users u ON u.id = s.user_id
+WHERE s.id = $1 AND s.revoked_at IS NULL AND s.expires_at > NOW()`
+
+	var s Session
+	var u AuthUser
+	err := db.QueryRow(query, sessionID, sessionTouchInterval.Seconds()).Scan(
+		&s.ID, &s.UserID, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt,
+		&u.Username, &u.Email, &u.EmailVerified, &u.Role)
+	if err != nil {
+		return Session{}, AuthUser{}, err
+	}
+	u.ID = s.UserID
+	return s, u, nil
+}
+
+func realListSessionsQuery(db *sql.DB, userID int) ([]Session, error) {
+	query := `
+SELECT id, user_id, created_at, last_seen, expires_at, ip, user_agent, browser, browser_version
+FROM sessions
+WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+ORDER BY last_seen DESC`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.LastSeen, &s.ExpiresAt, &s.IP, &s.UserAgent, &s.Browser, &s.BrowserVersion); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// realRevokeSessionQuery only revokes sessions owned by userID, so users cannot
+// end each other's sessions by guessing ids.
+func realRevokeSessionQuery(db *sql.DB, userID int, sessionID string) (bool, error) {
+	res, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func realRevokeUserSessionsQuery(db *sql.DB, userID int) (int64, error) {
+	res, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	CreateSessionQuery = realCreateSessionQuery
+	GetSessionUserQuery = realGetSessionUserQuery
+	ListSessionsQuery = realListSessionsQuery
+	RevokeSessionQuery = realRevokeSessionQuery
+	RevokeUserSessionsQuery = realRevokeUserSessionsQuery
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(t *testing.T, spec string) *sessionKeyring {
+	t.Helper()
+	keyring, err := parseSessionKeys(spec)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func testSecret(fill string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(fill, 32)))
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	keyring := testKeyring(t, "k1:"+testSecret("a"))
+	now := time.Now()
+	token, err := keyring.sign(sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	claims, kid, err := keyring.verify(token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, claims.UserID)
+	assert.Equal(t, "k1", kid)
+}
+
+func TestSessionTokenExpired(t *testing.T) {
+	keyring := testKeyring(t, "k1:"+testSecret("a"))
+	now := time.Now()
+	token, _ := keyring.sign(sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+
+	_, _, err := keyring.verify(token, now.Add(2*time.Minute))
+	assert.ErrorIs(t, err, errExpiredSessionToken)
+}
+
+func TestSessionTokenTampered(t *testing.T) {
+	keyring := testKeyring(t, "k1:"+testSecret("a"))
+	now := time.Now()
+	token, _ := keyring.sign(sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+
+	parts := strings.Split(token, ".")
+	forged, _ := keyring.sign(sessionClaims{SessionID: "s1", UserID: 1, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	parts[1] = strings.Split(forged, ".")[1]
+
+	_, _, err := keyring.verify(strings.Join(parts, "."), now)
+	assert.ErrorIs(t, err, errInvalidSessionToken)
+}
+
+func TestSealedTokenPurposeIsChecked(t *testing.T) {
+	keyring := testKeyring(t, "k1:"+testSecret("a"))
+	now := time.Now()
+	// A flow cookie carrying session-shaped fields is still not a session.
+	flow, err := keyring.seal(sealPurposeOIDCFlow, sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	_, _, err = keyring.verify(flow, now)
+	assert.ErrorIs(t, err, errInvalidSessionToken)
+
+	session, _ := keyring.sign(sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	var f oidcFlow
+	_, err = keyring.open(sealPurposeOIDCFlow, session, &f)
+	assert.ErrorIs(t, err, errInvalidSessionToken)
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	oldRing := testKeyring(t, "old:"+testSecret("a"))
+	now := time.Now()
+	token, _ := oldRing.sign(sessionClaims{SessionID: "s1", UserID: 7, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+
+	rotated := testKeyring(t, "new:"+testSecret("b")+",old:"+testSecret("a"))
+	claims, kid, err := rotated.verify(token, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", kid)
+	assert.Equal(t, 7, claims.UserID)
+
+	retired := testKeyring(t, "new:"+testSecret("b"))
+	_, _, err = retired.verify(token, now)
+	assert.ErrorIs(t, err, errInvalidSessionToken)
+}
+
+func TestParseSessionKeysRejectsShortSecret(t *testing.T) {
+	_, err := parseSessionKeys("k1:" + base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// "Did you mean": when a search finds little, every word of the query that
+// does not occur in the indexed pages is replaced by the closest word that
+// does. Candidates come from search_vocabulary by trigram similarity; the
+// pick is the smallest edit distance, then the word used by most pages.
+//
+// SEARCH_VOCABULARY_REFRESH sets how often the vocabulary is rebuilt from
+// the pages (default 6h, 0 to only build it at startup).
+const (
+	defaultVocabularyRefresh = 6 * time.Hour
+	// lowResultThreshold is the hit count below which a correction is offered.
+	lowResultThreshold = 3
+	minCorrectableWord = 3
+)
+
+var vocabularyRefreshInterval = defaultVocabularyRefresh
+
+func configureSpelling() error {
+	raw := os.Getenv("SEARCH_VOCABULARY_REFRESH")
+	if raw == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval < 0 {
+		return fmt.Errorf("invalid SEARCH_VOCABULARY_REFRESH %q", raw)
+	}
+	vocabularyRefreshInterval = interval
+	return nil
+}
+
+// refreshVocabulary builds the vocabulary now and then every
+// vocabularyRefreshInterval. Run it in its own goroutine.
+func refreshVocabulary(db *sql.DB) {
+	for {
+		start := time.Now()
+		if n, err := RefreshVocabularyQuery(db); err != nil {
+			log.Printf("[SPELLING] Vocabulary refresh failed: %v", err)
+		} else {
+			log.Printf("[SPELLING] Vocabulary refreshed: %d words in %s", n, time.Since(start).Round(time.Millisecond))
+		}
+		if vocabularyRefreshInterval == 0 {
+			return
+		}
+		time.Sleep(vocabularyRefreshInterval)
+	}
+}
+
+// correctSearchQuery returns q with misspelled words replaced, and whether
+// anything changed. Excluded terms are left alone: correcting them would
+// only change what is left out.
+func correctSearchQuery(q searchQuery, languages []string) (searchQuery, bool, error) {
+	var words []string
+	seen := map[string]struct{}{}
+	for _, clause := range q.Clauses {
+		for _, term := range clause {
+			for _, w := range strings.Fields(term.Text) {
+				w = strings.ToLower(w)
+				if _, dup := seen[w]; !dup && correctable(w) {
+					seen[w] = struct{}{}
+					words = append(words, w)
+				}
+			}
+		}
+	}
+	if len(words) == 0 {
+		return q, false, nil
+	}
+
+	candidates, err := SpellingCandidatesQuery(db, languages, words)
+	if err != nil {
+		return q, false, err
+	}
+	replacements := map[string]string{}
+	for _, w := range words {
+		if best, ok := closestWord(w, candidates[w]); ok {
+			replacements[w] = best
+		}
+	}
+	if len(replacements) == 0 {
+		return q, false, nil
+	}
+
+	corrected := searchQuery{Exclude: q.Exclude}
+	for _, clause := range q.Clauses {
+		var terms []searchTerm
+		for _, term := range clause {
+			fields := strings.Fields(term.Text)
+			for i, w := range fields {
+				if r, ok := replacements[strings.ToLower(w)]; ok {
+					fields[i] = r
+				}
+			}
+			terms = append(terms, searchTerm{Text: strings.Join(fields, " "), Phrase: term.Phrase})
+		}
+		corrected.Clauses = append(corrected.Clauses, terms)
+	}
+	return corrected, true, nil
+}
+
+// correctable reports whether w is a plain word worth correcting; numbers,
+// codes and very short words are too ambiguous.
+func correctable(w string) bool {
+	if utf8.RuneCountInString(w) < minCorrectableWord {
+		return false
+	}
+	for _, r := range w {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// closestWord picks the correction for w among candidates, or reports false
+// when w is itself known or nothing is close enough: one edit for words of
+// up to five letters, two for longer ones.
+func closestWord(w string, candidates []vocabularyWord) (string, bool) {
+	maxEdits := 1
+	if utf8.RuneCountInString(w) > 5 {
+		maxEdits = 2
+	}
+	var best vocabularyWord
+	bestDist := maxEdits + 1
+	for _, c := range candidates {
+		if c.Word == w {
+			return "", false
+		}
+		d := editDistance(w, c.Word)
+		if d < bestDist || (d == bestDist && c.Docs > best.Docs) {
+			best, bestDist = c, d
+		}
+	}
+	return best.Word, bestDist <= maxEdits
+}
+
+// editDistance is the optimal string alignment distance: insertions,
+// deletions, substitutions and swaps of adjacent letters each cost one.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	// Three rows suffice: the swap looks back two rows.
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(t)]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// vocabularyWord is a word from the indexed pages and how many pages use it.
+type vocabularyWord struct {
+	Word string
+	Docs int
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	RefreshVocabularyQuery  func(db *sql.DB) (int64, error)
+	SpellingCandidatesQuery func(db *sql.DB, languages []string, words []string) (map[string][]vocabularyWord, error)
+)
+
+// ---- Real implementations ----
+
+// realRefreshVocabularyQuery rebuilds search_vocabulary from the pages. The
+// 'simple' configuration keeps words unstemmed, so corrections are real
+// words ("kubernetes", not the stem "kubernet"). Numbers and very short or
+// long tokens are no use as corrections and are left out.
+func realRefreshVocabularyQuery(db *sql.DB) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("tx.Rollback failed: %v", err)
+		}
+	}()
+
+	if _, err := tx.Exec("DELETE FROM search_vocabulary"); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+INSERT INTO search_vocabulary (language, word, ndoc)
+SELECT l.language, s.word, s.ndoc
+FROM (SELECT DISTINCT language FROM pages) AS l,
+     LATERAL ts_stat(format(
+       'SELECT to_tsvector(''simple'', title || '' '' || content) FROM pages WHERE language = %L',
+       l.language)) AS s
+WHERE length(s.word) BETWEEN 3 AND 40
+  AND s.word !~ '[0-9_]'`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// realSpellingCandidatesQuery returns, per word, the most similar vocabulary
+// words of the given languages (the word itself first if it is known), using
+// idx_search_vocabulary_trgm.
+func realSpellingCandidatesQuery(db *sql.DB, languages []string, words []string) (map[string][]vocabularyWord, error) {
+	query := `
+SELECT w.word, v.word, v.ndoc
+FROM unnest($2::text[]) AS w(word)
+CROSS JOIN LATERAL (
+    SELECT word, ndoc
+    FROM search_vocabulary
+    WHERE language = ANY($1::text[]) AND word % w.word
+    ORDER BY similarity(word, w.word) DESC, ndoc DESC
+    LIMIT 10
+) AS v`
+
+	rows, err := db.Query(query, languages, words)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	candidates := make(map[string][]vocabularyWord)
+	for rows.Next() {
+		var word string
+		var v vocabularyWord
+		if err := rows.Scan(&word, &v.Word, &v.Docs); err != nil {
+			return nil, err
+		}
+		candidates[word] = append(candidates[word], v)
+	}
+	return candidates, rows.Err()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	RefreshVocabularyQuery = realRefreshVocabularyQuery
+	SpellingCandidatesQuery = realSpellingCandidatesQuery
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"kubernets", "kubernetes", 1},
+		{"teh", "the", 1},
+		{"søgning", "sogning", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+		{"same", "same", 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, editDistance(tt.a, tt.b), tt.a+" -> "+tt.b)
+	}
+}
+
+func TestClosestWord(t *testing.T) {
+	candidates := []vocabularyWord{{"kubernetes", 40}, {"kubernetis", 1}, {"cabernet", 9}}
+	got, ok := closestWord("kubernets", candidates)
+	assert.True(t, ok)
+	assert.Equal(t, "kubernetes", got, "equal distance goes to the more common word")
+
+	_, ok = closestWord("cabernet", candidates)
+	assert.False(t, ok, "known words are not corrected")
+	_, ok = closestWord("cat", []vocabularyWord{{"cut", 5}, {"cart", 5}})
+	assert.True(t, ok)
+	_, ok = closestWord("dog", nil)
+	assert.False(t, ok)
+	_, ok = closestWord("golang", []vocabularyWord{{"gopher", 5}})
+	assert.False(t, ok, "too far off")
+}
+
+func TestCorrectSearchQueryKeepsSyntax(t *testing.T) {
+	mockSpellingCandidatesQuery = func(_ *sql.DB, langs []string, words []string) (map[string][]vocabularyWord, error) {
+		assert.Equal(t, []string{"en"}, langs)
+		assert.ElementsMatch(t, []string{"deploy", "kubernets", "clustr"}, words)
+		return map[string][]vocabularyWord{
+			"deploy":    {{"deploy", 3}},
+			"kubernets": {{"kubernetes", 12}},
+			"clustr":    {{"cluster", 7}},
+		}, nil
+	}
+	defer func() { mockSpellingCandidatesQuery = nil }()
+
+	q, err := parseSearchQuery(`Deploy "kubernets clustr" OR k8s -dockr`)
+	assert.NoError(t, err)
+	corrected, ok, err := correctSearchQuery(q, []string{"en"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, `Deploy "kubernetes cluster" OR k8s -dockr`, corrected.String())
+}
+
+func TestSearchAutocorrectsEmptyResults(t *testing.T) {
+	mockSpellingCandidatesQuery = func(_ *sql.DB, _ []string, words []string) (map[string][]vocabularyWord, error) {
+		return map[string][]vocabularyWord{"kubernets": {{"kubernetes", 12}}}, nil
+	}
+	defer func() { mockSpellingCandidatesQuery = nil }()
+	var seen []SearchParams
+	hits := pagedSearchMock([]SearchResult{{ID: 1, Title: "a"}, {ID: 2, Title: "b"}}, &seen)
+	mockSearchPagesQuery = func(db *sql.DB, p SearchParams) (SearchPage, error) {
+		if p.Query != "kubernetes" {
+			seen = append(seen, p)
+			return SearchPage{}, nil
+		}
+		return hits(db, p)
+	}
+	router := setupRouter()
+
+	w := sendJSON(router, "GET", "/api/search?q=kubernets&language=en&limit=1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := decode[SearchResponse](t, w.Body.Bytes())
+	assert.True(t, resp.Corrected)
+	if assert.NotNil(t, resp.DidYouMean) {
+		assert.Equal(t, "kubernetes", *resp.DidYouMean)
+	}
+	assert.Equal(t, 2, resp.Total)
+	if assert.NotNil(t, resp.NextCursor) {
+		// The next page continues with the corrected query.
+		w = sendJSON(router, "GET", "/api/search?q=kubernets&language=en&limit=1&cursor="+*resp.NextCursor, "")
+		next := decode[SearchResponse](t, w.Body.Bytes())
+		assert.True(t, next.Corrected)
+		if assert.Len(t, next.Data, 1) {
+			assert.Equal(t, "b", next.Data[0].Title)
+		}
+	}
+
+	w = sendJSON(router, "GET", "/api/search?q=kubernets&language=en&autocorrect=false", "")
+	resp = decode[SearchResponse](t, w.Body.Bytes())
+	assert.False(t, resp.Corrected)
+	assert.Empty(t, resp.Data)
+	if assert.NotNil(t, resp.DidYouMean) {
+		assert.Equal(t, "kubernetes", *resp.DidYouMean)
+	}
+}
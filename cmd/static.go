@@ -30,6 +30,14 @@ func serveLoginFile(c *gin.Context) { serveHTML(c, "./public/login.html") }
 // @Router /register [get]
 func serveRegisterFile(c *gin.Context) { serveHTML(c, "./public/register.html") }
 
+// serveResetPasswordFile godoc
+// @Summary Serve password reset page
+// @Tags Pages
+// @Produce html
+// @Success 200 {string} string "HTML page"
+// @Router /reset-password [get]
+func serveResetPasswordFile(c *gin.Context) { serveHTML(c, "./public/reset-password.html") }
+
 // serverWeatherFile godoc
 // @Summary Serve weather page
 // @Tags Pages
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	minSuggestPrefix         = 2
+	maxSuggestPrefix         = 100
+	defaultSuggestLimit      = 8
+	maxSuggestLimit          = 20
+	minSuggestedQueryClients = 10 // distinct clients, counted once a day, so one user cannot make a query popular
+	suggestCacheTTL          = time.Minute
+	suggestCacheSize         = 5000
+)
+
+// suggestCache keeps recent completions per language and prefix. Keystrokes
+// from many users hit the same short prefixes, so even a minute saves most
+// queries. It is per instance, like the rate limiters.
+var suggestCache = struct {
+	mu sync.RWMutex
+	m  map[string]suggestCacheEntry
+}{m: make(map[string]suggestCacheEntry)}
+
+type suggestCacheEntry struct {
+	suggestions []Suggestion
+	expires     time.Time
+}
+
+// apiSuggest godoc
+// @Summary Complete a partial search query
+// @Description Completions come from page titles and from popular past searches, best first.
+// @Tags Search
+// @Produce json
+// @Param q query string true "What has been typed so far (at least 2 characters)"
+// @Param language query string false "Language code or name, e.g. da or danish, or all (default: detected from q)"
+// @Param limit query int false "Maximum suggestions (1-20)" minimum(1) maximum(20) default(8)
+// @Success 200 {object} SuggestResponse
+// @Header 200 {string} X-Cache "Cache status: HIT/MISS"
+// @Failure 422 {object} RequestValidationError
+// @Failure 500 {object} AuthResponse
+// @Router /api/suggest [get]
+func apiSuggest(c *gin.Context) {
+	prefix := strings.Join(strings.Fields(c.Query("q")), " ")
+	if utf8.RuneCountInString(prefix) > maxSuggestPrefix {
+		msg := "Query parameter 'q' is too long"
+		c.JSON(http.StatusUnprocessableEntity, RequestValidationError{StatusCode: 422, Message: &msg})
+		return
+	}
+	limit := defaultSuggestLimit
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			msg := "Query parameter 'limit' must be a positive integer"
+			c.JSON(http.StatusUnprocessableEntity, RequestValidationError{StatusCode: 422, Message: &msg})
+			return
+		}
+		limit = min(n, maxSuggestLimit)
+	}
+
+	c.Header("Cache-Control", "public, max-age=60")
+	// Too short to be selective; answer without touching the database.
+	if utf8.RuneCountInString(prefix) < minSuggestPrefix {
+		c.JSON(http.StatusOK, SuggestResponse{Data: []Suggestion{}})
+		return
+	}
+
+	langs := resolveLanguages(prefix, c.Query("language"))
+	key := langs.key() + "\x00" + strings.ToLower(prefix)
+	suggestions, ok := getCachedSuggestions(key)
+	if ok {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+		found, err := SuggestQuery(db, prefix, langs.Codes, maxSuggestLimit)
+		if err != nil {
+			log.Printf("[SUGGEST] Failed for langs=%q: %v", langs.key(), err)
+			code := http.StatusInternalServerError
+			msg := "could not load suggestions"
+			c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+			return
+		}
+		suggestions = rankSuggestions(found)
+		cacheSuggestions(key, suggestions)
+	}
+
+	c.JSON(http.StatusOK, SuggestResponse{Data: suggestions[:min(limit, len(suggestions))]})
+}
+
+// rankSuggestions orders by score and drops case-insensitive duplicates, so
+// a popular query that equals a title is listed once, with the better score.
+func rankSuggestions(found []Suggestion) []Suggestion {
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Score > found[j].Score })
+	seen := make(map[string]struct{}, len(found))
+	ranked := make([]Suggestion, 0, len(found))
+	for _, s := range found {
+		key := strings.ToLower(s.Text)
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		ranked = append(ranked, s)
+	}
+	return ranked
+}
+
+func getCachedSuggestions(key string) ([]Suggestion, bool) {
+	suggestCache.mu.RLock()
+	defer suggestCache.mu.RUnlock()
+	e, ok := suggestCache.m[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.suggestions, true
+}
+
+func cacheSuggestions(key string, suggestions []Suggestion) {
+	suggestCache.mu.Lock()
+	defer suggestCache.mu.Unlock()
+	now := time.Now()
+	if len(suggestCache.m) >= suggestCacheSize {
+		for k, e := range suggestCache.m {
+			if now.After(e.expires) {
+				delete(suggestCache.m, k)
+			}
+		}
+		// Still full: every entry is fresh, start over rather than grow.
+		if len(suggestCache.m) >= suggestCacheSize {
+			suggestCache.m = make(map[string]suggestCacheEntry)
+		}
+	}
+	suggestCache.m[key] = suggestCacheEntry{suggestions: suggestions, expires: now.Add(suggestCacheTTL)}
+}
+
+// searchClientSalt keys the client hashes for one day. It only lives in
+// memory and is replaced daily, so a stored hash can neither be traced back
+// to an IP address nor linked to the same client on another day. Like the
+// rate limiters it is per instance.
+var searchClientSalt = struct {
+	mu  sync.Mutex
+	day string
+	key []byte
+}{}
+
+// searchClientKey identifies a client for counting distinct searchers. The
+// first key of a day also prunes the keys whose salt is gone.
+func searchClientKey(ip string, now time.Time) (string, error) {
+	day := now.UTC().Format(time.DateOnly)
+	searchClientSalt.mu.Lock()
+	rotated := searchClientSalt.day != day
+	if rotated {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			searchClientSalt.mu.Unlock()
+			return "", err
+		}
+		searchClientSalt.day, searchClientSalt.key = day, key
+	}
+	mac := hmac.New(sha256.New, searchClientSalt.key)
+	searchClientSalt.mu.Unlock()
+
+	if rotated {
+		go func() {
+			if _, err := PruneSearchQueryClientsQuery(db); err != nil {
+				log.Printf("[SUGGEST] Failed to prune search clients: %v", err)
+			}
+		}()
+	}
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// recordSearchQuery counts a search that found something, for suggestions.
+func recordSearchQuery(lang, normalizedQuery, clientIP string) {
+	if utf8.RuneCountInString(normalizedQuery) > maxSuggestPrefix {
+		return
+	}
+	client, err := searchClientKey(clientIP, time.Now())
+	if err == nil {
+		err = RecordSearchQueryQuery(db, lang, normalizedQuery, client)
+	}
+	if err != nil {
+		log.Printf("[SUGGEST] Failed to record search query: %v", err)
+	}
+}
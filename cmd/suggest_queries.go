@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// Suggestion is one completion for the search box. Source is "title" for a
+// page title and "query" for a popular past search.
+type Suggestion struct {
+	Text   string  `json:"text"`
+	Source string  `json:"source"`
+	Score  float64 `json:"-"`
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	RecordSearchQueryQuery       func(db *sql.DB, language, query, client string) error
+	PruneSearchQueryClientsQuery func(db *sql.DB) (int64, error)
+	SuggestQuery                 func(db *sql.DB, prefix string, languages []string, limit int) ([]Suggestion, error)
+)
+
+// ---- Real implementations ----
+
+// realRecordSearchQueryQuery counts a search, and the client only if it has
+// not searched for the query before under the same key.
+func realRecordSearchQueryQuery(db *sql.DB, language, query, client string) error {
+	_, err := db.Exec(`
+WITH new_client AS (
+  INSERT INTO search_query_clients (language, query, client) VALUES ($1, $2, $3)
+  ON CONFLICT DO NOTHING
+  RETURNING 1
+)
+INSERT INTO search_queries (language, query, clients) VALUES ($1, $2, (SELECT COUNT(*) FROM new_client))
+ON CONFLICT (language, query) DO UPDATE
+SET hits = search_queries.hits + 1, clients = search_queries.clients + EXCLUDED.clients, last_searched_at = NOW()`, language, query, client)
+	return err
+}
+
+// realPruneSearchQueryClientsQuery forgets client keys from before
+// yesterday; their salt is gone, so they can never match again.
+func realPruneSearchQueryClientsQuery(db *sql.DB) (int64, error) {
+	res, err := db.Exec("DELETE FROM search_query_clients WHERE seen_at < NOW() - INTERVAL '2 days'")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// realSuggestQuery scores both sources on the same scale: 1 for a match at
+// the start, 0.5 at the start of a later word, plus trigram similarity, and
+// for past queries up to 1 more for popularity (1000 distinct clients score
+// full).
+// The title ILIKE patterns are served by idx_pages_title_trgm, the query
+// prefix by idx_search_queries_prefix.
+func realSuggestQuery(db *sql.DB, prefix string, languages []string, limit int) ([]Suggestion, error) {
+	query := `
+(SELECT title, 'title',
+        (CASE WHEN title ILIKE $2 THEN 1 WHEN title ILIKE $3 THEN 0.5 ELSE 0 END + similarity(title, $1))::float8 AS score
+   FROM pages
+  WHERE language = ANY($4::text[]) AND (title ILIKE $2 OR title ILIKE $3)
+  ORDER BY score DESC, length(title)
+  LIMIT $5)
+UNION ALL
+(SELECT query, 'query',
+        (1 + similarity(query, $1) + LEAST(ln(clients) / ln(1000), 1))::float8 AS score
+   FROM search_queries
+  WHERE language = ANY($4::text[]) AND query LIKE $6 AND clients >= $7
+  ORDER BY clients DESC, query
+  LIMIT $5)`
+
+	pattern := escapeLike(prefix)
+	rows, err := db.Query(query, prefix, pattern+"%", "% "+pattern+"%", languages, limit, strings.ToLower(pattern)+"%", minSuggestedQueryClients)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("rows.Close failed: %v", err)
+		}
+	}()
+
+	var suggestions []Suggestion
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.Text, &s.Source, &s.Score); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	RecordSearchQueryQuery = realRecordSearchQueryQuery
+	PruneSearchQueryClientsQuery = realPruneSearchQueryClientsQuery
+	SuggestQuery = realSuggestQuery
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestRanksDedupesAndCaches(t *testing.T) {
+	calls := 0
+	mockSuggestQuery = func(_ *sql.DB, prefix string, langs []string, limit int) ([]Suggestion, error) {
+		calls++
+		assert.Equal(t, "Solar p", prefix)
+		assert.Equal(t, []string{"en"}, langs)
+		return []Suggestion{
+			{Text: "Solar power", Source: "title", Score: 1.4},
+			{Text: "Solar panels", Source: "title", Score: 1.2},
+			{Text: "solar panels", Source: "query", Score: 2.1},
+		}, nil
+	}
+	router := setupRouter()
+
+	w := sendJSON(router, "GET", "/api/suggest?q=Solar%20%20p&language=en", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	resp := decode[SuggestResponse](t, w.Body.Bytes())
+	assert.Equal(t, []Suggestion{{Text: "solar panels", Source: "query"}, {Text: "Solar power", Source: "title"}}, resp.Data)
+
+	w = sendJSON(router, "GET", "/api/suggest?q=solar+P&language=en&limit=1", "")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Len(t, decode[SuggestResponse](t, w.Body.Bytes()).Data, 1)
+	assert.Equal(t, 1, calls)
+}
+
+func TestSuggestShortOrInvalidInput(t *testing.T) {
+	mockSuggestQuery = func(_ *sql.DB, _ string, _ []string, _ int) ([]Suggestion, error) {
+		t.Fatal("short prefixes must not reach the database")
+		return nil, nil
+	}
+	router := setupRouter()
+
+	w := sendJSON(router, "GET", "/api/suggest?q=s", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, decode[SuggestResponse](t, w.Body.Bytes()).Data)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, sendJSON(router, "GET", "/api/suggest?q=solar&limit=0", "").Code)
+}
+
+func TestSearchRecordsQueriesWithResults(t *testing.T) {
+	mockSearchPagesQuery = func(_ *sql.DB, p SearchParams) (SearchPage, error) {
+		if p.Query == "nothing here" {
+			return SearchPage{}, nil
+		}
+		return SearchPage{Results: []SearchResult{{Title: "t"}}}, nil
+	}
+	router := setupRouter()
+	search := func(q, ip string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/search?q="+url.QueryEscape(q)+"&language=en", nil)
+		req.RemoteAddr = ip + ":4711"
+		router.ServeHTTP(w, req)
+	}
+	// One client repeating a search is still one client.
+	for i := 0; i < 5; i++ {
+		search("Wind Turbines", "198.51.100.1")
+	}
+	search("wind turbines", "198.51.100.2")
+	search("nothing here", "198.51.100.1")
+
+	fakeSearchQueries.mu.Lock()
+	defer fakeSearchQueries.mu.Unlock()
+	assert.Equal(t, 6, fakeSearchQueries.hits["en\x00wind turbines"])
+	assert.Len(t, fakeSearchQueries.clients["en\x00wind turbines"], 2)
+	assert.Zero(t, fakeSearchQueries.hits["en\x00nothing here"])
+}
+
+func TestSearchClientKeyChangesDaily(t *testing.T) {
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	a, err := searchClientKey("198.51.100.1", day)
+	assert.NoError(t, err)
+	again, _ := searchClientKey("198.51.100.1", day.Add(time.Hour))
+	other, _ := searchClientKey("198.51.100.2", day)
+	tomorrow, _ := searchClientKey("198.51.100.1", day.Add(24*time.Hour))
+
+	assert.Equal(t, a, again)
+	assert.NotEqual(t, a, other)
+	assert.NotEqual(t, a, tomorrow)
+	assert.NotContains(t, a, "198.51.100.1")
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"WHOKNOWS_VARIATIONS/util"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -12,21 +21,623 @@ import (
 // --- Mock dependencies ---
 
 var (
-	mockInsertUserQuery        func(*sql.DB, string, string, string) (int64, error)
-	mockGetUserByUsernameQuery func(*sql.DB, string) (int, string, string, string, error)
-	mockSearchPagesQuery       func(*sql.DB, string, string, int) ([]SearchResult, error)
+	mockInsertUserQuery         func(*sql.DB, string, string, string) (int64, error)
+	mockGetUserByUsernameQuery  func(*sql.DB, string) (int, string, string, string, error)
+	mockGetUserByIDQuery        func(*sql.DB, string) (int, string, string, string, error)
+	mockSearchPagesQuery        func(*sql.DB, SearchParams) (SearchPage, error)
+	mockSuggestQuery            func(*sql.DB, string, []string, int) ([]Suggestion, error)
+	mockSpellingCandidatesQuery func(*sql.DB, []string, []string) (map[string][]vocabularyWord, error)
+	mockUpdateUserPassword      func(*sql.DB, int, string) error
+	mockGetUserByEmailQuery     func(*sql.DB, string) (int, string, string, string, error)
+	mockEmailVerified           func(int) bool
+	mockUpdateUserEmail         func(*sql.DB, int, string) error
 )
 
+// fakeSessions is an in-memory stand-in for the sessions table.
+var fakeSessions = struct {
+	mu sync.Mutex
+	m  map[string]Session
+}{m: make(map[string]Session)}
+
+// fakePasswordResets maps token hashes to user ids; consumed tokens are removed.
+var fakePasswordResets = struct {
+	mu sync.Mutex
+	m  map[string]int
+}{m: make(map[string]int)}
+
+// fakeEmailVerifications maps verification token hashes to user ids.
+var fakeEmailVerifications = struct {
+	mu       sync.Mutex
+	m        map[string]int
+	verified map[int]bool
+}{m: make(map[string]int), verified: make(map[int]bool)}
+
+// fakeTOTP is an in-memory stand-in for user_totp and user_recovery_codes.
+var fakeTOTP = struct {
+	mu       sync.Mutex
+	m        map[int]UserTOTP
+	recovery map[int]map[string]bool
+}{m: make(map[int]UserTOTP), recovery: make(map[int]map[string]bool)}
+
+// fakeIdentities maps "issuer|subject" to user ids (user_identities).
+var fakeIdentities = struct {
+	mu sync.Mutex
+	m  map[string]int
+}{m: make(map[string]int)}
+
+// fakeAPIKeys is an in-memory stand-in for the api_keys table (revoked keys are removed).
+var fakeAPIKeys = struct {
+	mu     sync.Mutex
+	nextID int64
+	m      map[int64]APIKey
+}{m: make(map[int64]APIKey)}
+
+// fakeInvitations is an in-memory stand-in for the invitations table.
+var fakeInvitations = struct {
+	mu     sync.Mutex
+	nextID int64
+	m      map[int64]Invitation
+}{m: make(map[int64]Invitation)}
+
+// fakeAuditEvents is an in-memory stand-in for the append-only audit_events table.
+var fakeAuditEvents = struct {
+	mu sync.Mutex
+	s  []AuditEvent
+}{}
+
+// fakeRefreshTokens is an in-memory stand-in for the refresh_tokens table, keyed by hash.
+var fakeRefreshTokens = struct {
+	mu sync.Mutex
+	m  map[string]RefreshToken
+}{m: make(map[string]RefreshToken)}
+
+// fakeSearchQueries counts RecordSearchQueryQuery calls and distinct clients
+// by language and query.
+var fakeSearchQueries = struct {
+	mu      sync.Mutex
+	hits    map[string]int
+	clients map[string]map[string]bool
+}{hits: make(map[string]int), clients: make(map[string]map[string]bool)}
+
+// fakeRoles maps user ids to roles; everyone else is a plain user. User 1 is
+// the seeded admin, as in InitDB.
+var fakeRoles = struct {
+	mu sync.Mutex
+	m  map[int]string
+}{m: map[int]string{1: roleAdmin}}
+
 // Patch the global functions to mocks for testing
 func init() {
+	// main calls configureTokens; tests share one ephemeral signing key.
+	keyring, err := newEphemeralTokenKeyring()
+	if err != nil {
+		panic(err)
+	}
+	tokenKeys = keyring
+
 	InsertUserQuery = func(db *sql.DB, u, e, p string) (int64, error) {
 		return mockInsertUserQuery(db, u, e, p)
 	}
 	GetUserByUsernameQuery = func(db *sql.DB, u string) (int, string, string, string, error) {
 		return mockGetUserByUsernameQuery(db, u)
 	}
-	SearchPagesQuery = func(db *sql.DB, q, lang string, limit int) ([]SearchResult, error) {
-		return mockSearchPagesQuery(db, q, lang, limit)
+	GetUserByIDQuery = func(db *sql.DB, id string) (int, string, string, string, error) {
+		return mockGetUserByIDQuery(db, id)
+	}
+	SearchPagesQuery = func(db *sql.DB, p SearchParams) (SearchPage, error) {
+		return mockSearchPagesQuery(db, p)
+	}
+	GetUserByEmailQuery = func(db *sql.DB, e string) (int, string, string, string, error) {
+		return mockGetUserByEmailQuery(db, e)
+	}
+	UpdateUserPasswordQuery = func(db *sql.DB, id int, hash string) error {
+		if mockUpdateUserPassword == nil {
+			return nil
+		}
+		return mockUpdateUserPassword(db, id, hash)
+	}
+
+	GetUserRoleQuery = func(_ *sql.DB, userID int) (string, error) {
+		fakeRoles.mu.Lock()
+		defer fakeRoles.mu.Unlock()
+		if role, ok := fakeRoles.m[userID]; ok {
+			return role, nil
+		}
+		return roleUser, nil
+	}
+	SetUserRoleQuery = func(_ *sql.DB, userID int, role string) (bool, error) {
+		fakeRoles.mu.Lock()
+		defer fakeRoles.mu.Unlock()
+		fakeRoles.m[userID] = role
+		return true, nil
+	}
+	UpdateUserEmailQuery = func(db *sql.DB, id int, email string) error {
+		if mockUpdateUserEmail == nil {
+			return nil
+		}
+		return mockUpdateUserEmail(db, id, email)
+	}
+	// DeleteUserQuery mimics ON DELETE CASCADE over the in-memory fakes.
+	DeleteUserQuery = func(_ *sql.DB, userID int) error {
+		fakeSessions.mu.Lock()
+		for id, s := range fakeSessions.m {
+			if s.UserID == userID {
+				delete(fakeSessions.m, id)
+			}
+		}
+		fakeSessions.mu.Unlock()
+		fakeAPIKeys.mu.Lock()
+		for id, k := range fakeAPIKeys.m {
+			if k.UserID == userID {
+				delete(fakeAPIKeys.m, id)
+			}
+		}
+		fakeAPIKeys.mu.Unlock()
+		fakeTOTP.mu.Lock()
+		delete(fakeTOTP.m, userID)
+		delete(fakeTOTP.recovery, userID)
+		fakeTOTP.mu.Unlock()
+		fakeRefreshTokens.mu.Lock()
+		for hash, t := range fakeRefreshTokens.m {
+			if t.UserID == userID {
+				delete(fakeRefreshTokens.m, hash)
+			}
+		}
+		fakeRefreshTokens.mu.Unlock()
+		return nil
+	}
+
+	CreatePasswordResetQuery = func(_ *sql.DB, userID int, tokenHash string, _ time.Time) error {
+		fakePasswordResets.mu.Lock()
+		defer fakePasswordResets.mu.Unlock()
+		fakePasswordResets.m[tokenHash] = userID
+		return nil
+	}
+	PeekPasswordResetQuery = func(_ *sql.DB, tokenHash string) (int, error) {
+		fakePasswordResets.mu.Lock()
+		defer fakePasswordResets.mu.Unlock()
+		userID, ok := fakePasswordResets.m[tokenHash]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		return userID, nil
+	}
+	ConsumePasswordResetQuery = func(_ *sql.DB, tokenHash string) (int, error) {
+		fakePasswordResets.mu.Lock()
+		defer fakePasswordResets.mu.Unlock()
+		userID, ok := fakePasswordResets.m[tokenHash]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		delete(fakePasswordResets.m, tokenHash)
+		return userID, nil
+	}
+
+	CreateEmailVerificationQuery = func(_ *sql.DB, userID int, tokenHash string, _ time.Time) error {
+		fakeEmailVerifications.mu.Lock()
+		defer fakeEmailVerifications.mu.Unlock()
+		fakeEmailVerifications.m[tokenHash] = userID
+		return nil
+	}
+	ConsumeEmailVerificationQuery = func(_ *sql.DB, tokenHash string) (int, error) {
+		fakeEmailVerifications.mu.Lock()
+		defer fakeEmailVerifications.mu.Unlock()
+		userID, ok := fakeEmailVerifications.m[tokenHash]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		delete(fakeEmailVerifications.m, tokenHash)
+		fakeEmailVerifications.verified[userID] = true
+		return userID, nil
+	}
+	// Users count as verified unless a test overrides mockEmailVerified.
+	GetUserEmailVerifiedQuery = func(_ *sql.DB, userID int) (bool, error) {
+		if mockEmailVerified == nil {
+			return true, nil
+		}
+		fakeEmailVerifications.mu.Lock()
+		defer fakeEmailVerifications.mu.Unlock()
+		return fakeEmailVerifications.verified[userID] || mockEmailVerified(userID), nil
+	}
+
+	MarkEmailVerifiedQuery = func(_ *sql.DB, userID int) error {
+		fakeEmailVerifications.mu.Lock()
+		defer fakeEmailVerifications.mu.Unlock()
+		fakeEmailVerifications.verified[userID] = true
+		return nil
+	}
+
+	GetUserIDByIdentityQuery = func(_ *sql.DB, issuer, subject string) (int, error) {
+		fakeIdentities.mu.Lock()
+		defer fakeIdentities.mu.Unlock()
+		userID, ok := fakeIdentities.m[issuer+"|"+subject]
+		if !ok {
+			return 0, sql.ErrNoRows
+		}
+		return userID, nil
+	}
+	ListUserIdentitiesQuery = func(_ *sql.DB, userID int) ([]UserIdentity, error) {
+		fakeIdentities.mu.Lock()
+		defer fakeIdentities.mu.Unlock()
+		out := []UserIdentity{}
+		for key, id := range fakeIdentities.m {
+			if id == userID {
+				issuer, subject, _ := strings.Cut(key, "|")
+				out = append(out, UserIdentity{Issuer: issuer, Subject: subject})
+			}
+		}
+		return out, nil
+	}
+	LinkIdentityQuery = func(_ *sql.DB, userID int, issuer, subject, _ string) error {
+		fakeIdentities.mu.Lock()
+		defer fakeIdentities.mu.Unlock()
+		fakeIdentities.m[issuer+"|"+subject] = userID
+		return nil
+	}
+
+	CreateAPIKeyQuery = func(_ *sql.DB, k APIKey) (int64, error) {
+		fakeAPIKeys.mu.Lock()
+		defer fakeAPIKeys.mu.Unlock()
+		fakeAPIKeys.nextID++
+		k.ID = fakeAPIKeys.nextID
+		fakeAPIKeys.m[k.ID] = k
+		return k.ID, nil
+	}
+	GetAPIKeyByPrefixQuery = func(_ *sql.DB, prefix string) (APIKey, error) {
+		fakeAPIKeys.mu.Lock()
+		defer fakeAPIKeys.mu.Unlock()
+		for _, k := range fakeAPIKeys.m {
+			if k.Prefix == prefix {
+				return k, nil
+			}
+		}
+		return APIKey{}, sql.ErrNoRows
+	}
+	ListAPIKeysQuery = func(_ *sql.DB, userID int) ([]APIKey, error) {
+		fakeAPIKeys.mu.Lock()
+		defer fakeAPIKeys.mu.Unlock()
+		out := []APIKey{}
+		for _, k := range fakeAPIKeys.m {
+			if k.UserID == userID {
+				out = append(out, k)
+			}
+		}
+		return out, nil
+	}
+	RevokeAPIKeyQuery = func(_ *sql.DB, userID int, id int64) (bool, error) {
+		fakeAPIKeys.mu.Lock()
+		defer fakeAPIKeys.mu.Unlock()
+		k, ok := fakeAPIKeys.m[id]
+		if !ok || k.UserID != userID {
+			return false, nil
+		}
+		delete(fakeAPIKeys.m, id)
+		return true, nil
+	}
+	TouchAPIKeyQuery = func(_ *sql.DB, id int64) error {
+		fakeAPIKeys.mu.Lock()
+		defer fakeAPIKeys.mu.Unlock()
+		k := fakeAPIKeys.m[id]
+		now := time.Now()
+		k.LastUsedAt = &now
+		fakeAPIKeys.m[id] = k
+		return nil
+	}
+
+	CreateInvitationQuery = func(_ *sql.DB, inv Invitation) (int64, error) {
+		fakeInvitations.mu.Lock()
+		defer fakeInvitations.mu.Unlock()
+		fakeInvitations.nextID++
+		inv.ID = fakeInvitations.nextID
+		fakeInvitations.m[inv.ID] = inv
+		return inv.ID, nil
+	}
+	ListInvitationsQuery = func(_ *sql.DB) ([]Invitation, error) {
+		fakeInvitations.mu.Lock()
+		defer fakeInvitations.mu.Unlock()
+		out := []Invitation{}
+		for _, inv := range fakeInvitations.m {
+			out = append(out, inv)
+		}
+		return out, nil
+	}
+	RevokeInvitationQuery = func(_ *sql.DB, id int64) (bool, error) {
+		fakeInvitations.mu.Lock()
+		defer fakeInvitations.mu.Unlock()
+		inv, ok := fakeInvitations.m[id]
+		if !ok || inv.RevokedAt != nil {
+			return false, nil
+		}
+		now := time.Now()
+		inv.RevokedAt = &now
+		fakeInvitations.m[id] = inv
+		return true, nil
+	}
+	ClaimInvitationQuery = func(_ *sql.DB, codeHash string) (int64, error) {
+		fakeInvitations.mu.Lock()
+		defer fakeInvitations.mu.Unlock()
+		for id, inv := range fakeInvitations.m {
+			if inv.CodeHash == codeHash && inv.RevokedAt == nil && time.Now().Before(inv.ExpiresAt) && inv.Uses < inv.MaxUses {
+				inv.Uses++
+				fakeInvitations.m[id] = inv
+				return id, nil
+			}
+		}
+		return 0, sql.ErrNoRows
+	}
+	ReleaseInvitationQuery = func(_ *sql.DB, id int64) error {
+		fakeInvitations.mu.Lock()
+		defer fakeInvitations.mu.Unlock()
+		if inv, ok := fakeInvitations.m[id]; ok && inv.Uses > 0 {
+			inv.Uses--
+			fakeInvitations.m[id] = inv
+		}
+		return nil
+	}
+
+	InsertAuditEventQuery = func(_ *sql.DB, e AuditEvent) error {
+		fakeAuditEvents.mu.Lock()
+		defer fakeAuditEvents.mu.Unlock()
+		e.ID = int64(len(fakeAuditEvents.s) + 1)
+		fakeAuditEvents.s = append(fakeAuditEvents.s, e)
+		return nil
+	}
+	ListAuditEventsQuery = func(_ *sql.DB, f AuditFilter) ([]AuditEvent, error) {
+		fakeAuditEvents.mu.Lock()
+		defer fakeAuditEvents.mu.Unlock()
+		out := []AuditEvent{}
+		for i := len(fakeAuditEvents.s) - 1; i >= 0 && len(out) < f.Limit; i-- {
+			e := fakeAuditEvents.s[i]
+			if (f.Event != "" && e.Event != f.Event) ||
+				(f.ActorID != 0 && e.ActorID != f.ActorID) ||
+				(f.Actor != "" && !strings.EqualFold(e.ActorName, f.Actor)) ||
+				(f.IP != "" && e.IP != f.IP) ||
+				(!f.Since.IsZero() && e.OccurredAt.Before(f.Since)) ||
+				(!f.Until.IsZero() && !e.OccurredAt.Before(f.Until)) ||
+				(f.Before != 0 && e.ID >= f.Before) {
+				continue
+			}
+			out = append(out, e)
+		}
+		return out, nil
+	}
+
+	ListUserAuditEventsQuery = func(_ *sql.DB, userID int) ([]AuditEvent, error) {
+		fakeAuditEvents.mu.Lock()
+		defer fakeAuditEvents.mu.Unlock()
+		out := []AuditEvent{}
+		for i := len(fakeAuditEvents.s) - 1; i >= 0; i-- {
+			if e := fakeAuditEvents.s[i]; e.ActorID == userID || e.TargetID == userID {
+				out = append(out, e)
+			}
+		}
+		return out, nil
+	}
+	PseudonymizeAuditEventsQuery = func(_ *sql.DB, userID int, username string) (int64, error) {
+		fakeAuditEvents.mu.Lock()
+		defer fakeAuditEvents.mu.Unlock()
+		var n int64
+		for i, e := range fakeAuditEvents.s {
+			if e.ActorID == userID || (e.ActorID == 0 && strings.EqualFold(e.ActorName, username)) {
+				e.ActorName, e.IP, e.UserAgent, e.Details = "", "", "", nil
+				fakeAuditEvents.s[i] = e
+				n++
+			}
+		}
+		return n, nil
+	}
+	DeleteAuditEventsBeforeQuery = func(_ *sql.DB, before time.Time) (int64, error) {
+		fakeAuditEvents.mu.Lock()
+		defer fakeAuditEvents.mu.Unlock()
+		kept := fakeAuditEvents.s[:0]
+		for _, e := range fakeAuditEvents.s {
+			if !e.OccurredAt.Before(before) {
+				kept = append(kept, e)
+			}
+		}
+		n := int64(len(fakeAuditEvents.s) - len(kept))
+		fakeAuditEvents.s = kept
+		return n, nil
+	}
+
+	CreateRefreshTokenQuery = func(_ *sql.DB, t RefreshToken) error {
+		fakeRefreshTokens.mu.Lock()
+		defer fakeRefreshTokens.mu.Unlock()
+		t.CreatedAt = time.Now()
+		fakeRefreshTokens.m[t.TokenHash] = t
+		return nil
+	}
+	GetRefreshTokenQuery = func(_ *sql.DB, tokenHash string) (RefreshToken, error) {
+		fakeRefreshTokens.mu.Lock()
+		defer fakeRefreshTokens.mu.Unlock()
+		t, ok := fakeRefreshTokens.m[tokenHash]
+		if !ok {
+			return RefreshToken{}, sql.ErrNoRows
+		}
+		return t, nil
+	}
+	UseRefreshTokenQuery = func(_ *sql.DB, tokenHash string) (RefreshToken, error) {
+		fakeRefreshTokens.mu.Lock()
+		defer fakeRefreshTokens.mu.Unlock()
+		t, ok := fakeRefreshTokens.m[tokenHash]
+		if !ok || t.UsedAt != nil || t.RevokedAt != nil || !time.Now().Before(t.ExpiresAt) {
+			return RefreshToken{}, sql.ErrNoRows
+		}
+		now := time.Now()
+		t.UsedAt = &now
+		fakeRefreshTokens.m[tokenHash] = t
+		return t, nil
+	}
+	revokeRefreshTokens := func(match func(RefreshToken) bool) int64 {
+		fakeRefreshTokens.mu.Lock()
+		defer fakeRefreshTokens.mu.Unlock()
+		var n int64
+		now := time.Now()
+		for hash, t := range fakeRefreshTokens.m {
+			if t.RevokedAt == nil && match(t) {
+				t.RevokedAt = &now
+				fakeRefreshTokens.m[hash] = t
+				n++
+			}
+		}
+		return n
+	}
+	RevokeRefreshFamilyQuery = func(_ *sql.DB, familyID string) (int64, error) {
+		return revokeRefreshTokens(func(t RefreshToken) bool { return t.FamilyID == familyID }), nil
+	}
+	RevokeUserRefreshTokensQuery = func(_ *sql.DB, userID int) (int64, error) {
+		return revokeRefreshTokens(func(t RefreshToken) bool { return t.UserID == userID }), nil
+	}
+
+	RecordSearchQueryQuery = func(_ *sql.DB, language, query, client string) error {
+		fakeSearchQueries.mu.Lock()
+		defer fakeSearchQueries.mu.Unlock()
+		key := language + "\x00" + query
+		fakeSearchQueries.hits[key]++
+		if fakeSearchQueries.clients[key] == nil {
+			fakeSearchQueries.clients[key] = map[string]bool{}
+		}
+		fakeSearchQueries.clients[key][client] = true
+		return nil
+	}
+	PruneSearchQueryClientsQuery = func(*sql.DB) (int64, error) { return 0, nil }
+	SuggestQuery = func(db *sql.DB, prefix string, languages []string, limit int) ([]Suggestion, error) {
+		if mockSuggestQuery == nil {
+			return nil, nil
+		}
+		return mockSuggestQuery(db, prefix, languages, limit)
+	}
+
+	RefreshVocabularyQuery = func(_ *sql.DB) (int64, error) { return 0, nil }
+	SpellingCandidatesQuery = func(db *sql.DB, languages []string, words []string) (map[string][]vocabularyWord, error) {
+		if mockSpellingCandidatesQuery == nil {
+			return nil, nil
+		}
+		return mockSpellingCandidatesQuery(db, languages, words)
+	}
+
+	GetUserTOTPQuery = func(_ *sql.DB, userID int) (UserTOTP, error) {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		t, ok := fakeTOTP.m[userID]
+		if !ok {
+			return UserTOTP{}, sql.ErrNoRows
+		}
+		return t, nil
+	}
+	SaveTOTPSecretQuery = func(_ *sql.DB, userID int, secret string) error {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		if t, ok := fakeTOTP.m[userID]; ok && t.ConfirmedAt != nil {
+			return nil
+		}
+		fakeTOTP.m[userID] = UserTOTP{UserID: userID, Secret: secret}
+		return nil
+	}
+	ConfirmTOTPQuery = func(_ *sql.DB, userID int, step int64, hashes []string) error {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		t, ok := fakeTOTP.m[userID]
+		if !ok || t.ConfirmedAt != nil {
+			return sql.ErrNoRows
+		}
+		now := time.Now()
+		t.ConfirmedAt, t.LastUsedStep = &now, step
+		fakeTOTP.m[userID] = t
+		fakeTOTP.recovery[userID] = map[string]bool{}
+		for _, h := range hashes {
+			fakeTOTP.recovery[userID][h] = true
+		}
+		return nil
+	}
+	UseTOTPStepQuery = func(_ *sql.DB, userID int, step int64) (bool, error) {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		t := fakeTOTP.m[userID]
+		if t.LastUsedStep >= step {
+			return false, nil
+		}
+		t.LastUsedStep = step
+		fakeTOTP.m[userID] = t
+		return true, nil
+	}
+	UseRecoveryCodeQuery = func(_ *sql.DB, userID int, hash string) (bool, error) {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		if !fakeTOTP.recovery[userID][hash] {
+			return false, nil
+		}
+		delete(fakeTOTP.recovery[userID], hash)
+		return true, nil
+	}
+	DeleteUserTOTPQuery = func(_ *sql.DB, userID int) error {
+		fakeTOTP.mu.Lock()
+		defer fakeTOTP.mu.Unlock()
+		delete(fakeTOTP.m, userID)
+		delete(fakeTOTP.recovery, userID)
+		return nil
+	}
+
+	CreateSessionQuery = func(_ *sql.DB, s Session) error {
+		fakeSessions.mu.Lock()
+		defer fakeSessions.mu.Unlock()
+		s.CreatedAt, s.LastSeen = time.Now(), time.Now()
+		fakeSessions.m[s.ID] = s
+		return nil
+	}
+	// The join of the real query, assembled from the user fakes.
+	GetSessionUserQuery = func(_ *sql.DB, id string) (Session, AuthUser, error) {
+		fakeSessions.mu.Lock()
+		s, ok := fakeSessions.m[id]
+		if ok && time.Since(s.LastSeen) > sessionTouchInterval {
+			touched := s
+			touched.LastSeen = time.Now()
+			fakeSessions.m[id] = touched
+		}
+		fakeSessions.mu.Unlock()
+		if !ok || time.Now().After(s.ExpiresAt) {
+			return Session{}, AuthUser{}, sql.ErrNoRows
+		}
+		userID, username, email, _, err := mockGetUserByIDQuery(nil, strconv.Itoa(s.UserID))
+		if err != nil {
+			return Session{}, AuthUser{}, err
+		}
+		verified, _ := GetUserEmailVerifiedQuery(nil, userID)
+		role, _ := GetUserRoleQuery(nil, userID)
+		return s, AuthUser{ID: userID, Username: username, Email: email, EmailVerified: verified, Role: role}, nil
+	}
+	ListSessionsQuery = func(_ *sql.DB, userID int) ([]Session, error) {
+		fakeSessions.mu.Lock()
+		defer fakeSessions.mu.Unlock()
+		out := []Session{}
+		for _, s := range fakeSessions.m {
+			if s.UserID == userID {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+	RevokeSessionQuery = func(_ *sql.DB, userID int, id string) (bool, error) {
+		fakeSessions.mu.Lock()
+		defer fakeSessions.mu.Unlock()
+		s, ok := fakeSessions.m[id]
+		if !ok || s.UserID != userID {
+			return false, nil
+		}
+		delete(fakeSessions.m, id)
+		return true, nil
+	}
+	RevokeUserSessionsQuery = func(_ *sql.DB, userID int) (int64, error) {
+		fakeSessions.mu.Lock()
+		defer fakeSessions.mu.Unlock()
+		var n int64
+		for id, s := range fakeSessions.m {
+			if s.UserID == userID {
+				delete(fakeSessions.m, id)
+				n++
+			}
+		}
+		return n, nil
 	}
 }
 
@@ -34,6 +645,10 @@ func init() {
 
 func setupRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
+	// Every test router starts without lockouts; httptest requests share one client IP.
+	accountLoginThrottle = newLoginThrottle(5, 30*time.Second, 15*time.Minute, 24*time.Hour)
+	ipLoginThrottle = newLoginThrottle(20, 30*time.Second, time.Hour, 24*time.Hour)
+	languageDetectLimiter = newRateLimiter(120, time.Minute)
 	return newRouter()
 }
 
@@ -43,3 +658,80 @@ func decode[T any](t *testing.T, body []byte) T {
 	assert.NoError(t, err)
 	return v
 }
+
+// loginAs starts a session for a mocked user and returns its auth cookie.
+func loginAs(t *testing.T, userID int, username string) *http.Cookie {
+	t.Helper()
+	mockGetUserByIDQuery = func(_ *sql.DB, id string) (int, string, string, string, error) {
+		return userID, username, username + "@example.com", "hash", nil
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("POST", "/api/login", nil)
+	assert.NoError(t, startSession(c, userID))
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == util.AuthCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("startSession did not set the auth cookie")
+	return nil
+}
+
+func postJSON(router http.Handler, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return sendJSON(router, "POST", path, body, cookies...)
+}
+
+func httpDelete(router http.Handler, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return sendJSON(router, "DELETE", path, body, cookies...)
+}
+
+// testCSRFToken is sent as cookie and header, like the frontend does.
+const testCSRFToken = "test-csrf-token"
+
+func withCSRF(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: util.CSRFCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeaderName, testCSRFToken)
+	return req
+}
+
+func sendJSON(router http.Handler, method, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	withCSRF(req)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// waitForMail returns the first mail sent to the given address.
+func waitForMail(t *testing.T, inbox *MemoryMailer, to string) Mail {
+	t.Helper()
+	var found Mail
+	assert.Eventually(t, func() bool {
+		for _, m := range inbox.Sent() {
+			if m.To == to {
+				found = m
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	return found
+}
+
+func tokenFromMail(t *testing.T, m Mail) string {
+	t.Helper()
+	for _, field := range strings.Fields(m.Body) {
+		if u, err := url.Parse(field); err == nil && u.Query().Get("token") != "" {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no token link in mail body: %q", m.Body)
+	return ""
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bearer tokens for clients that cannot use the session cookie (mobile apps,
+// CLIs). POST /api/token with grant_type=password returns a short-lived RS256
+// access token and a refresh token; grant_type=refresh_token swaps the refresh
+// token for a new pair. Access tokens are checked by bearerAuth on every /api
+// route. Like SESSION_KEYS, the first key signs and the others stay in the
+// JWKS at /.well-known/jwks.json so tokens signed before a rotation still verify.
+//
+// Example:
+//
+//	JWT_SIGNING_KEYS=2026-10:/run/secrets/jwt-2026-10.pem,2026-07:/run/secrets/jwt-2026-07.pem
+//	JWT_ACCESS_TTL=15m
+//	JWT_REFRESH_TTL=720h
+const (
+	accessTokenAudience    = "whoknows-api"
+	accessTokenType        = "at+jwt"
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	minSigningKeyBits      = 2048
+
+	grantTypePassword     = "password"
+	grantTypeRefreshToken = "refresh_token"
+)
+
+var errInvalidAccessToken = errors.New("invalid access token")
+
+type TokenRequest struct {
+	GrantType    string `form:"grant_type" json:"grant_type"`
+	Username     string `form:"username" json:"username"`
+	Password     string `form:"password" json:"password"`
+	Code         string `form:"code" json:"code"`
+	RefreshToken string `form:"refresh_token" json:"refresh_token"`
+}
+
+type RevokeTokenRequest struct {
+	RefreshToken string `form:"refresh_token" json:"refresh_token"`
+}
+
+type accessTokenClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	IssuedAt  int64       `json:"iat"`
+	ExpiresAt int64       `json:"exp"`
+	ID        string      `json:"jti"`
+}
+
+type tokenSigningKey struct {
+	ID  string
+	Key *rsa.PrivateKey
+}
+
+// tokenKeyring holds the RSA signing keys. keys[0] is the active key.
+type tokenKeyring struct {
+	keys []tokenSigningKey
+}
+
+var (
+	tokenKeys       *tokenKeyring
+	accessTokenTTL  = defaultAccessTokenTTL
+	refreshTokenTTL = defaultRefreshTokenTTL
+)
+
+// configureTokens loads JWT_SIGNING_KEYS, JWT_ACCESS_TTL and JWT_REFRESH_TTL.
+// Without JWT_SIGNING_KEYS a random key is used, so issued tokens do not
+// survive restarts.
+func configureTokens() error {
+	if raw := os.Getenv("JWT_SIGNING_KEYS"); raw != "" {
+		keyring, err := parseTokenSigningKeys(raw)
+		if err != nil {
+			return err
+		}
+		tokenKeys = keyring
+	} else {
+		log.Printf("[TOKEN] JWT_SIGNING_KEYS is not set, using an ephemeral signing key")
+		keyring, err := newEphemeralTokenKeyring()
+		if err != nil {
+			return err
+		}
+		tokenKeys = keyring
+	}
+
+	for _, setting := range []struct {
+		env  string
+		into *time.Duration
+	}{
+		{"JWT_ACCESS_TTL", &accessTokenTTL},
+		{"JWT_REFRESH_TTL", &refreshTokenTTL},
+	} {
+		raw := os.Getenv(setting.env)
+		if raw == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid %s %q", setting.env, raw)
+		}
+		*setting.into = ttl
+	}
+	return nil
+}
+
+func parseTokenSigningKeys(raw string) (*tokenKeyring, error) {
+	keyring := &tokenKeyring{}
+	seen := map[string]struct{}{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, path, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q (expected kid:/path/to/key.pem)", entry)
+		}
+		if _, dup := seen[id]; dup {
+			return nil, fmt.Errorf("duplicate JWT_SIGNING_KEYS kid %q", id)
+		}
+		pemBytes, err := os.ReadFile(path) //nolint:gosec // path comes from the operator
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS kid %q: %w", id, err)
+		}
+		key, err := parseRSAPrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS kid %q: %w", id, err)
+		}
+		seen[id] = struct{}{}
+		keyring.keys = append(keyring.keys, tokenSigningKey{ID: id, Key: key})
+	}
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("JWT_SIGNING_KEYS contains no keys")
+	}
+	return keyring, nil
+}
+
+// parseRSAPrivateKey accepts PKCS#1 ("RSA PRIVATE KEY") and PKCS#8 ("PRIVATE KEY") PEM.
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an RSA key")
+		}
+		key = rsaKey
+	}
+	if key.N.BitLen() < minSigningKeyBits {
+		return nil, fmt.Errorf("RSA key must be at least %d bits", minSigningKeyBits)
+	}
+	return key, nil
+}
+
+func newEphemeralTokenKeyring() (*tokenKeyring, error) {
+	key, err := rsa.GenerateKey(rand.Reader, minSigningKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenKeyring{keys: []tokenSigningKey{{ID: "ephemeral", Key: key}}}, nil
+}
+
+func (k *tokenKeyring) active() tokenSigningKey {
+	return k.keys[0]
+}
+
+// rsaKey returns the public half of the key with id kid, retired keys
+// included, so tokens signed before a rotation stay valid until they expire.
+func (k *tokenKeyring) rsaKey(kid string) (*rsa.PublicKey, error) {
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return &key.Key.PublicKey, nil
+		}
+	}
+	return nil, errors.New("no RSA key for kid " + kid)
+}
+
+func (k *tokenKeyring) jwks() JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, publicJWK(key.ID, &key.Key.PublicKey))
+	}
+	return set
+}
+
+func issueAccessToken(userID int, now time.Time) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	key := tokenKeys.active()
+	return signRS256(key.Key, key.ID, accessTokenType, accessTokenClaims{
+		Issuer:    appBaseURL(),
+		Subject:   strconv.Itoa(userID),
+		Audience:  jwtAudience{accessTokenAudience},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		ID:        jti,
+	})
+}
+
+// verifyAccessToken returns the user id of a valid access token.
+func verifyAccessToken(token string, now time.Time) (int, error) {
+	var claims accessTokenClaims
+	if err := verifyRS256(token, tokenKeys, &claims); err != nil {
+		return 0, err
+	}
+	switch {
+	case claims.Issuer != appBaseURL() || !claims.Audience.contains(accessTokenAudience):
+		return 0, errInvalidAccessToken
+	case now.Unix() >= claims.ExpiresAt:
+		return 0, errors.New("access token expired")
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, errInvalidAccessToken
+	}
+	return userID, nil
+}
+
+// issueTokenPair returns a new access token and the next refresh token of
+// familyID.
+func issueTokenPair(userID int, familyID string) (TokenResponse, error) {
+	now := time.Now()
+	access, err := issueAccessToken(userID, now)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if err := CreateRefreshTokenQuery(db, RefreshToken{
+		TokenHash: hashToken(refresh),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}); err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// bearerAuth authenticates "Authorization: Bearer <access token>" requests.
+// It runs before sessionMiddleware, so a token takes precedence over the
+// cookie. API keys (wk_...) are left to apiKeyAuth; any other bearer value
+// has to be a valid access token.
+func bearerAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || strings.HasPrefix(token, apiKeyTag) {
+			c.Next()
+			return
+		}
+
+		userID, err := verifyAccessToken(strings.TrimSpace(token), time.Now())
+		var id int
+		var username, email string
+		if err == nil {
+			id, username, email, _, err = GetUserByIDQuery(db, strconv.Itoa(userID))
+		}
+		if err != nil {
+			log.Printf("[TOKEN] Rejected access token from IP=%s: %v", c.ClientIP(), err)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			code := http.StatusUnauthorized
+			msg := "invalid or expired access token"
+			c.AbortWithStatusJSON(http.StatusUnauthorized, AuthResponse{&code, &msg})
+			return
+		}
+
+		verified, err := GetUserEmailVerifiedQuery(db, id)
+		if err != nil {
+			log.Printf("[TOKEN] Failed to load email_verified for user_id=%d: %v", id, err)
+		}
+		c.Set(contextUserKey, AuthUser{ID: id, Username: username, Email: email, EmailVerified: verified, Role: loadUserRole(id)})
+		c.Set(contextCredentialAuthKey, true)
+		c.Next()
+	}
+}
+
+func sendInvalidGrant(c *gin.Context) {
+	code := http.StatusUnauthorized
+	msg := "invalid or expired refresh token"
+	c.JSON(http.StatusUnauthorized, AuthResponse{&code, &msg})
+}
+
+func sendTokenError(c *gin.Context) {
+	code := http.StatusInternalServerError
+	msg := "could not issue token"
+	c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+}
+
+// apiToken godoc
+// @Summary Get an access token for the JSON API
+// @Description grant_type=password takes username, password and, with 2FA enabled, code.
+// @Description grant_type=refresh_token takes refresh_token; each refresh token can only be used once.
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body TokenRequest true "Grant"
+// @Success 200 {object} TokenResponse
+// @Failure 401 {object} AuthResponse "Invalid refresh token"
+// @Failure 422 {object} HTTPValidationError
+// @Failure 429 {object} HTTPValidationError
+// @Router /api/token [post]
+func apiToken(c *gin.Context) {
+	var form TokenRequest
+	if err := c.ShouldBind(&form); err != nil {
+		sendValidationError(c, "body", "invalid form data")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	switch form.GrantType {
+	case grantTypePassword:
+		tokenPasswordGrant(c, form)
+	case grantTypeRefreshToken:
+		tokenRefreshGrant(c, form.RefreshToken)
+	default:
+		sendValidationError(c, "grant_type", "grant_type must be password or refresh_token")
+	}
+}
+
+func tokenPasswordGrant(c *gin.Context, form TokenRequest) {
+	username := normalizeIdentifier(form.Username)
+	id, ok := checkLoginCredentials(c, username, form.Password)
+	if !ok {
+		return
+	}
+
+	enabled, totp, err := userHasTwoFactor(id)
+	if err != nil {
+		log.Printf("[TOKEN] Failed to load 2FA state for user_id=%d: %v", id, err)
+		sendTokenError(c)
+		return
+	}
+	if enabled {
+		if form.Code == "" {
+			c.JSON(http.StatusUnprocessableEntity, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"code", 0}, Msg: "two-factor code required", Type: "2fa_required"}}})
+			return
+		}
+		if valid, err := verifySecondFactor(totp, form.Code); err != nil || !valid {
+			log.Printf("[TOKEN] Invalid 2FA code for user_id=%d from IP=%s", id, c.ClientIP())
+			recordLoginFailure(c.ClientIP(), accountThrottleKey(username), time.Now())
+			recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: id, ActorName: username, Details: map[string]any{"method": "token", "reason": "invalid_2fa_code"}})
+			sendValidationError(c, "code", "invalid code")
+			return
+		}
+	}
+
+	familyID, err := randomToken(16)
+	if err != nil {
+		sendTokenError(c)
+		return
+	}
+	resp, err := issueTokenPair(id, familyID)
+	if err != nil {
+		log.Printf("[TOKEN] Failed to issue tokens for user_id=%d: %v", id, err)
+		sendTokenError(c)
+		return
+	}
+	log.Printf("[TOKEN] Issued tokens for user_id=%d", id)
+	recordAudit(c, AuditEvent{Event: auditLoginSucceeded, ActorID: id, ActorName: username, Details: map[string]any{"method": "token"}})
+	c.JSON(http.StatusOK, resp)
+}
+
+func tokenRefreshGrant(c *gin.Context, refreshToken string) {
+	if refreshToken == "" {
+		sendValidationError(c, "refresh_token", "refresh_token is required")
+		return
+	}
+	tokenHash := hashToken(refreshToken)
+	current, err := UseRefreshTokenQuery(db, tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		detectRefreshTokenReuse(c, tokenHash)
+		sendInvalidGrant(c)
+		return
+	}
+	if err != nil {
+		log.Printf("[TOKEN] Failed to use refresh token: %v", err)
+		sendTokenError(c)
+		return
+	}
+
+	if _, _, _, _, err := GetUserByIDQuery(db, strconv.Itoa(current.UserID)); err != nil {
+		log.Printf("[TOKEN] Refresh token for unknown user_id=%d: %v", current.UserID, err)
+		sendInvalidGrant(c)
+		return
+	}
+	resp, err := issueTokenPair(current.UserID, current.FamilyID)
+	if err != nil {
+		log.Printf("[TOKEN] Failed to refresh tokens for user_id=%d: %v", current.UserID, err)
+		sendTokenError(c)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// detectRefreshTokenReuse handles a refresh token that could not be used.
+// If it was valid but already rotated, someone is replaying a copy: either
+// the client or an attacker holds a stolen token, and we cannot tell which,
+// so every token of the family is revoked and the user has to log in again.
+func detectRefreshTokenReuse(c *gin.Context, tokenHash string) {
+	old, err := GetRefreshTokenQuery(db, tokenHash)
+	if err != nil || old.UsedAt == nil || old.RevokedAt != nil {
+		return
+	}
+	n, err := RevokeRefreshFamilyQuery(db, old.FamilyID)
+	if err != nil {
+		log.Printf("[TOKEN] Failed to revoke refresh token family of user_id=%d: %v", old.UserID, err)
+		return
+	}
+	log.Printf("[TOKEN] Refresh token reuse for user_id=%d from IP=%s, revoked %d token(s)", old.UserID, c.ClientIP(), n)
+	recordAudit(c, AuditEvent{Event: auditRefreshTokenReused, ActorID: old.UserID, TargetID: old.UserID, Details: map[string]any{"revoked": n}})
+}
+
+// apiRevokeToken godoc
+// @Summary Revoke a refresh token (log out a token client)
+// @Description Revokes every token issued from the same login. Unknown tokens are ignored.
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body RevokeTokenRequest true "Refresh token"
+// @Success 200 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/token/revoke [post]
+func apiRevokeToken(c *gin.Context) {
+	var form RevokeTokenRequest
+	if err := c.ShouldBind(&form); err != nil || form.RefreshToken == "" {
+		sendValidationError(c, "refresh_token", "refresh_token is required")
+		return
+	}
+	if t, err := GetRefreshTokenQuery(db, hashToken(form.RefreshToken)); err == nil {
+		if _, err := RevokeRefreshFamilyQuery(db, t.FamilyID); err != nil {
+			log.Printf("[TOKEN] Failed to revoke refresh token family of user_id=%d: %v", t.UserID, err)
+			sendTokenError(c)
+			return
+		}
+		log.Printf("[TOKEN] user_id=%d revoked a refresh token", t.UserID)
+		recordAudit(c, AuditEvent{Event: auditLogout, ActorID: t.UserID, TargetID: t.UserID, Details: map[string]any{"method": "token"}})
+	}
+	code := http.StatusOK
+	msg := "token revoked"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// serveJWKS godoc
+// @Summary Public keys for verifying access tokens
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} JWKS
+// @Router /.well-known/jwks.json [get]
+func serveJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, tokenKeys.jwks())
+}
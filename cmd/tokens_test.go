@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requestToken(router http.Handler, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func withBearer(router http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func mockTokenUser(t *testing.T, id int, username, password string) {
+	t.Helper()
+	hash, err := hashPassword(password)
+	assert.NoError(t, err)
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return id, username, username + "@example.com", hash, nil
+	}
+	mockGetUserByIDQuery = func(_ *sql.DB, _ string) (int, string, string, string, error) {
+		return id, username, username + "@example.com", hash, nil
+	}
+}
+
+func passwordGrant(t *testing.T, router http.Handler, username, password string) TokenResponse {
+	t.Helper()
+	w := requestToken(router, url.Values{"grant_type": {"password"}, "username": {username}, "password": {password}})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	return decode[TokenResponse](t, w.Body.Bytes())
+}
+
+func TestTokenPasswordGrantAuthenticatesAPI(t *testing.T) {
+	router := setupRouter()
+	mockTokenUser(t, 141, "cli-user", "Vivid-Lantern-42")
+
+	tokens := passwordGrant(t, router, "cli-user", "Vivid-Lantern-42")
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, int(accessTokenTTL.Seconds()), tokens.ExpiresIn)
+	assert.NotEmpty(t, tokens.RefreshToken)
+
+	// Only the hash of the refresh token is stored.
+	stored, err := GetRefreshTokenQuery(db, hashToken(tokens.RefreshToken))
+	assert.NoError(t, err)
+	assert.Equal(t, 141, stored.UserID)
+
+	w := withBearer(router, "GET", "/api/session", tokens.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "logged in")
+
+	w = withBearer(router, "GET", "/api/session", tokens.AccessToken+"x")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	w = requestToken(router, url.Values{"grant_type": {"password"}, "username": {"cli-user"}, "password": {"wrong"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestTokenRequiresSecondFactor(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 142, "cli-twofa")
+	_, recovery := enrollTwoFactor(t, router, cookie)
+	mockTokenUser(t, 142, "cli-twofa", "Quiet-Meadow-17")
+
+	form := url.Values{"grant_type": {"password"}, "username": {"cli-twofa"}, "password": {"Quiet-Meadow-17"}}
+	w := requestToken(router, form)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "2fa_required")
+
+	form.Set("code", recovery[0])
+	w = requestToken(router, form)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	router := setupRouter()
+	mockTokenUser(t, 143, "cli-rotate", "Vivid-Lantern-42")
+	first := passwordGrant(t, router, "cli-rotate", "Vivid-Lantern-42")
+
+	w := requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := decode[TokenResponse](t, w.Body.Bytes())
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	// Replaying the rotated token revokes the whole family, including the
+	// token the legitimate client got in exchange.
+	w = requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second.RefreshToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	admin := loginAs(t, 1, "admin")
+	events := auditEvents(t, router, "event="+auditRefreshTokenReused+"&actor_id=143", admin)
+	assert.Len(t, events.Data, 1)
+}
+
+func TestRevokeTokenAndLogoutEverywhere(t *testing.T) {
+	router := setupRouter()
+	mockTokenUser(t, 144, "cli-revoke", "Vivid-Lantern-42")
+
+	tokens := passwordGrant(t, router, "cli-revoke", "Vivid-Lantern-42")
+	w := requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	tokens = decode[TokenResponse](t, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/token/revoke", bytes.NewBufferString(`{"refresh_token":"`+tokens.RefreshToken+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Logging out everywhere also ends token logins.
+	tokens = passwordGrant(t, router, "cli-revoke", "Vivid-Lantern-42")
+	w = withBearer(router, "DELETE", "/api/sessions", tokens.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = requestToken(router, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAccessTokenVerifiesAgainstJWKS(t *testing.T) {
+	router := setupRouter()
+	w := sendJSON(router, "GET", "/.well-known/jwks.json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var set JWKS
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	assert.NotEmpty(t, set.Keys)
+
+	now := time.Now()
+	token, err := issueAccessToken(145, now)
+	assert.NoError(t, err)
+	var claims accessTokenClaims
+	assert.NoError(t, verifyRS256(token, set, &claims))
+	assert.Equal(t, "145", claims.Subject)
+	assert.True(t, claims.Audience.contains(accessTokenAudience))
+
+	_, err = verifyAccessToken(token, now.Add(accessTokenTTL))
+	assert.Error(t, err, "expired tokens are rejected")
+
+	// A token with our kid but signed by another key is rejected.
+	other, err := newEphemeralTokenKeyring()
+	assert.NoError(t, err)
+	forged, err := signRS256(other.active().Key, tokenKeys.active().ID, accessTokenType, claims)
+	assert.NoError(t, err)
+	_, err = verifyAccessToken(forged, now)
+	assert.Error(t, err)
+}
+
+func TestParseTokenSigningKeysRejectsBadInput(t *testing.T) {
+	for _, raw := range []string{"nokid", "a:/does/not/exist.pem", " , "} {
+		_, err := parseTokenSigningKeys(raw)
+		assert.Error(t, err, raw)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 appendix B vectors for the SHA1 key "12345678901234567890".
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+	for _, c := range cases {
+		got, err := totpCode(secret, c.unix/totpPeriod, 8)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, got, "t=%d", c.unix)
+	}
+}
+
+func TestVerifyTOTPAcceptsSkew(t *testing.T) {
+	secret, _ := newTOTPSecret()
+	now := time.Now()
+	prev, _ := totpCode(secret, totpStep(now)-1, totpDigits)
+
+	step, ok := verifyTOTP(secret, prev, now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now)-1, step)
+
+	old, _ := totpCode(secret, totpStep(now)-3, totpDigits)
+	_, ok = verifyTOTP(secret, old, now)
+	assert.False(t, ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("JBSWY3DPEHPK3PXP", "alice")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/WhoKnows:alice?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=WhoKnows")
+}
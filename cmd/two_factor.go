@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	twoFactorChallengeTTL         = 5 * time.Minute
+	twoFactorChallengeMaxAttempts = 5
+	recoveryCodeCount             = 10
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `form:"code" json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `form:"challenge" json:"challenge"`
+	Code      string `form:"code" json:"code"`
+}
+
+// twoFactorChallenges holds logins that passed the first factor (password or
+// single sign-on) and wait for a second one. Keys are hashed challenge tokens.
+var twoFactorChallenges = struct {
+	mu sync.Mutex
+	m  map[string]*twoFactorChallenge
+}{m: make(map[string]*twoFactorChallenge)}
+
+type twoFactorChallenge struct {
+	userID   int
+	username string
+	method   string // first factor, for the audit log
+	expires  time.Time
+	attempts int
+}
+
+func newTwoFactorChallenge(userID int, username, method string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	twoFactorChallenges.mu.Lock()
+	defer twoFactorChallenges.mu.Unlock()
+	now := time.Now()
+	for k, ch := range twoFactorChallenges.m {
+		if now.After(ch.expires) {
+			delete(twoFactorChallenges.m, k)
+		}
+	}
+	twoFactorChallenges.m[hashToken(token)] = &twoFactorChallenge{userID: userID, username: username, method: method, expires: now.Add(twoFactorChallengeTTL)}
+	return token, nil
+}
+
+// userHasTwoFactor reports whether userID has confirmed TOTP enrollment.
+func userHasTwoFactor(userID int) (bool, UserTOTP, error) {
+	totp, err := GetUserTOTPQuery(db, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, UserTOTP{}, nil
+	}
+	if err != nil {
+		return false, UserTOTP{}, err
+	}
+	return totp.ConfirmedAt != nil, totp, nil
+}
+
+// verifySecondFactor accepts a current TOTP code (once) or an unused recovery code.
+func verifySecondFactor(totp UserTOTP, code string) (bool, error) {
+	if step, ok := verifyTOTP(totp.Secret, code, time.Now()); ok {
+		return UseTOTPStepQuery(db, totp.UserID, step)
+	}
+	normalized := normalizeRecoveryCode(code)
+	if len(normalized) != 16 {
+		return false, nil
+	}
+	return UseRecoveryCodeQuery(db, totp.UserID, hashToken(normalized))
+}
+
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, hashToken(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// apiLoginTwoFactor godoc
+// @Summary Complete a login with a TOTP or recovery code
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body TwoFactorLoginRequest true "Challenge from /api/login and the code"
+// @Success 200 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/login/2fa [post]
+func apiLoginTwoFactor(c *gin.Context) {
+	var form TwoFactorLoginRequest
+	if err := c.ShouldBind(&form); err != nil || form.Challenge == "" || form.Code == "" {
+		sendValidationError(c, "code", "you have to enter a code")
+		return
+	}
+
+	key := hashToken(form.Challenge)
+	twoFactorChallenges.mu.Lock()
+	challenge, ok := twoFactorChallenges.m[key]
+	if ok && time.Now().After(challenge.expires) {
+		delete(twoFactorChallenges.m, key)
+		ok = false
+	}
+	twoFactorChallenges.mu.Unlock()
+	if !ok {
+		sendValidationError(c, "challenge", "the login has expired, please log in again")
+		return
+	}
+
+	valid := false
+	if enabled, totp, err := userHasTwoFactor(challenge.userID); err != nil {
+		log.Printf("[2FA] Failed to load TOTP for user_id=%d: %v", challenge.userID, err)
+	} else if enabled {
+		valid, err = verifySecondFactor(totp, form.Code)
+		if err != nil {
+			log.Printf("[2FA] Failed to verify code for user_id=%d: %v", challenge.userID, err)
+		}
+	}
+
+	if !valid {
+		twoFactorChallenges.mu.Lock()
+		challenge.attempts++
+		if challenge.attempts >= twoFactorChallengeMaxAttempts {
+			delete(twoFactorChallenges.m, key)
+		}
+		twoFactorChallenges.mu.Unlock()
+		log.Printf("[2FA] Invalid code for user_id=%d from IP=%s", challenge.userID, c.ClientIP())
+		recordLoginFailure(c.ClientIP(), accountThrottleKey(challenge.username), time.Now())
+		recordAudit(c, AuditEvent{Event: auditLoginFailed, ActorID: challenge.userID, ActorName: challenge.username, Details: map[string]any{"reason": "invalid_2fa_code"}})
+		sendValidationError(c, "code", "invalid code")
+		return
+	}
+
+	twoFactorChallenges.mu.Lock()
+	delete(twoFactorChallenges.m, key)
+	twoFactorChallenges.mu.Unlock()
+	accountLoginThrottle.Reset(accountThrottleKey(challenge.username))
+
+	if err := startSession(c, challenge.userID); err != nil {
+		log.Printf("[2FA] Failed to issue session for user_id=%d: %v", challenge.userID, err)
+		c.JSON(http.StatusInternalServerError, HTTPValidationError{Detail: []ValidationError{{Loc: []any{"session", 0}, Msg: "could not start session", Type: "session_error"}}})
+		return
+	}
+	log.Printf("[2FA] Login completed for user_id=%d", challenge.userID)
+	recordAudit(c, AuditEvent{Event: auditLoginSucceeded, ActorID: challenge.userID, ActorName: challenge.username, Details: map[string]any{"method": challenge.method + "+2fa"}})
+	code := 200
+	msg := "login successful"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
+
+// apiTwoFactorEnroll godoc
+// @Summary Start TOTP enrollment
+// @Description Returns a new secret and the otpauth:// URI to render as a QR code. Enrollment is pending until confirmed.
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} TwoFactorEnrollResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 409 {object} AuthResponse
+// @Router /api/2fa/enroll [post]
+func apiTwoFactorEnroll(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	enabled, _, err := userHasTwoFactor(user.ID)
+	if err != nil {
+		log.Printf("[2FA] Failed to load TOTP for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not start enrollment"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+	if enabled {
+		code := http.StatusConflict
+		msg := "two-factor authentication is already enabled"
+		c.JSON(http.StatusConflict, AuthResponse{&code, &msg})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err == nil {
+		err = SaveTOTPSecretQuery(db, user.ID, secret)
+	}
+	if err != nil {
+		log.Printf("[2FA] Failed to store TOTP secret for user_id=%d: %v", user.ID, err)
+		code := http.StatusInternalServerError
+		msg := "could not start enrollment"
+		c.JSON(http.StatusInternalServerError, AuthResponse{&code, &msg})
+		return
+	}
+
+	log.Printf("[2FA] Enrollment started for user_id=%d", user.ID)
+	c.JSON(http.StatusOK, TwoFactorEnrollResponse{Secret: secret, ProvisioningURI: totpProvisioningURI(secret, user.Username)})
+}
+
+// apiTwoFactorConfirm godoc
+// @Summary Confirm TOTP enrollment and receive recovery codes
+// @Description The recovery codes are shown only once; they are stored hashed.
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body TwoFactorCodeRequest true "Current code from the authenticator app"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/2fa/confirm [post]
+func apiTwoFactorConfirm(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form TwoFactorCodeRequest
+	if err := c.ShouldBind(&form); err != nil || form.Code == "" {
+		sendValidationError(c, "code", "you have to enter a code")
+		return
+	}
+
+	totp, err := GetUserTOTPQuery(db, user.ID)
+	if err != nil || totp.ConfirmedAt != nil {
+		sendValidationError(c, "code", "no pending enrollment, start with /api/2fa/enroll")
+		return
+	}
+	step, ok := verifyTOTP(totp.Secret, form.Code, time.Now())
+	if !ok {
+		sendValidationError(c, "code", "invalid code")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		err = ConfirmTOTPQuery(db, user.ID, step, hashes)
+	}
+	if err != nil {
+		log.Printf("[2FA] Failed to confirm TOTP for user_id=%d: %v", user.ID, err)
+		sendValidationError(c, "code", "could not enable two-factor authentication")
+		return
+	}
+
+	log.Printf("[2FA] Enabled for user_id=%d", user.ID)
+	auditSelf(c, auditTwoFactorEnabled, nil)
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// apiTwoFactorDisable godoc
+// @Summary Disable two-factor authentication
+// @Tags Auth
+// @Accept json
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param request body TwoFactorCodeRequest true "Current TOTP code or a recovery code"
+// @Success 200 {object} AuthResponse
+// @Failure 401 {object} AuthResponse
+// @Failure 422 {object} HTTPValidationError
+// @Router /api/2fa [delete]
+func apiTwoFactorDisable(c *gin.Context) {
+	user, _ := currentUser(c)
+	var form TwoFactorCodeRequest
+	if err := c.ShouldBind(&form); err != nil || form.Code == "" {
+		sendValidationError(c, "code", "you have to enter a code")
+		return
+	}
+
+	enabled, totp, err := userHasTwoFactor(user.ID)
+	if err != nil || !enabled {
+		sendValidationError(c, "code", "two-factor authentication is not enabled")
+		return
+	}
+	if ok, err := verifySecondFactor(totp, form.Code); err != nil || !ok {
+		sendValidationError(c, "code", "invalid code")
+		return
+	}
+	if err := DeleteUserTOTPQuery(db, user.ID); err != nil {
+		log.Printf("[2FA] Failed to disable TOTP for user_id=%d: %v", user.ID, err)
+		sendValidationError(c, "code", "could not disable two-factor authentication")
+		return
+	}
+
+	log.Printf("[2FA] Disabled for user_id=%d", user.ID)
+	auditSelf(c, auditTwoFactorDisabled, nil)
+	code := http.StatusOK
+	msg := "two-factor authentication disabled"
+	c.JSON(http.StatusOK, AuthResponse{&code, &msg})
+}
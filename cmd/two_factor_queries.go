@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+type UserTOTP struct {
+	UserID       int
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+// ---- Function variables (can be replaced in tests) ----
+
+var (
+	GetUserTOTPQuery     func(db *sql.DB, userID int) (UserTOTP, error)
+	SaveTOTPSecretQuery  func(db *sql.DB, userID int, secret string) error
+	ConfirmTOTPQuery     func(db *sql.DB, userID int, step int64, recoveryCodeHashes []string) error
+	UseTOTPStepQuery     func(db *sql.DB, userID int, step int64) (bool, error)
+	UseRecoveryCodeQuery func(db *sql.DB, userID int, codeHash string) (bool, error)
+	DeleteUserTOTPQuery  func(db *sql.DB, userID int) error
+)
+
+// ---- Real implementations ----
+
+func realGetUserTOTPQuery(db *sql.DB, userID int) (UserTOTP, error) {
+	query := "SELECT user_id, secret, confirmed_at, last_used_step FROM user_totp WHERE user_id = $1"
+
+	var t UserTOTP
+	var confirmedAt sql.NullTime
+	if err := db.QueryRow(query, userID).Scan(&t.UserID, &t.Secret, &confirmedAt, &t.LastUsedStep); err != nil {
+		return UserTOTP{}, err
+	}
+	if confirmedAt.Valid {
+		t.ConfirmedAt = &confirmedAt.Time
+	}
+	return t, nil
+}
+
+// realSaveTOTPSecretQuery stores a pending (unconfirmed) secret. A confirmed
+// secret is never overwritten; 2FA has to be disabled first.
+func realSaveTOTPSecretQuery(db *sql.DB, userID int, secret string) error {
+	query := `
+INSERT INTO user_totp (user_id, secret)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+WHERE user_totp.confirmed_at IS NULL`
+	_, err := db.Exec(query, userID, secret)
+	return err
+}
+
+// realConfirmTOTPQuery enables 2FA and replaces the recovery codes atomically.
+func realConfirmTOTPQuery(db *sql.DB, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Safety rollback if Commit is not reached
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.Exec("UPDATE user_totp SET confirmed_at = NOW(), last_used_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL", userID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec("INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// realUseTOTPStepQuery advances last_used_step, failing if step was already used.
+func realUseTOTPStepQuery(db *sql.DB, userID int, step int64) (bool, error) {
+	res, err := db.Exec("UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2", userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func realUseRecoveryCodeQuery(db *sql.DB, userID int, codeHash string) (bool, error) {
+	res, err := db.Exec("UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func realDeleteUserTOTPQuery(db *sql.DB, userID int) error {
+	if _, err := db.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM user_totp WHERE user_id = $1", userID)
+	return err
+}
+
+// ---- Assign real implementations ----
+
+func init() {
+	GetUserTOTPQuery = realGetUserTOTPQuery
+	SaveTOTPSecretQuery = realSaveTOTPSecretQuery
+	ConfirmTOTPQuery = realConfirmTOTPQuery
+	UseTOTPStepQuery = realUseTOTPStepQuery
+	UseRecoveryCodeQuery = realUseRecoveryCodeQuery
+	DeleteUserTOTPQuery = realDeleteUserTOTPQuery
+}
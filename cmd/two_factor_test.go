@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enrollTwoFactor runs enroll + confirm for a logged-in user and returns the
+// secret and recovery codes.
+func enrollTwoFactor(t *testing.T, router http.Handler, cookie *http.Cookie) (string, []string) {
+	t.Helper()
+	w := postJSON(router, "/api/2fa/enroll", `{}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	enroll := decode[TwoFactorEnrollResponse](t, w.Body.Bytes())
+	assert.Contains(t, enroll.ProvisioningURI, "otpauth://totp/")
+
+	code, _ := totpCode(enroll.Secret, totpStep(time.Now()), totpDigits)
+	w = postJSON(router, "/api/2fa/confirm", `{"code":"`+code+`"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	codes := decode[RecoveryCodesResponse](t, w.Body.Bytes())
+	assert.Len(t, codes.RecoveryCodes, recoveryCodeCount)
+	return enroll.Secret, codes.RecoveryCodes
+}
+
+func TestTwoFactorLoginFlow(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 41, "twofa")
+	secret, recovery := enrollTwoFactor(t, router, cookie)
+
+	hash, _ := hashPassword("goodpw")
+	mockGetUserByUsernameQuery = func(_ *sql.DB, u string) (int, string, string, string, error) {
+		return 41, "twofa", "twofa@example.com", hash, nil
+	}
+
+	// Password alone only yields a challenge, no session cookie.
+	w := postJSON(router, "/api/login", `{"username":"twofa","password":"goodpw"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+	challenge := decode[TwoFactorChallengeResponse](t, w.Body.Bytes())
+	assert.Equal(t, "2FA required", challenge.Message)
+
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"000000"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// The code used during confirmation cannot be replayed...
+	confirmed, _ := GetUserTOTPQuery(db, 41)
+	used, _ := totpCode(secret, confirmed.LastUsedStep, totpDigits)
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+used+`"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// ...but a recovery code works exactly once.
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+recovery[0]+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Result().Cookies())
+
+	w = postJSON(router, "/api/login", `{"username":"twofa","password":"goodpw"}`)
+	challenge = decode[TwoFactorChallengeResponse](t, w.Body.Bytes())
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+recovery[0]+`"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// The challenge itself is single use as well.
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+recovery[1]+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(router, "/api/login/2fa", `{"challenge":"`+challenge.Challenge+`","code":"`+recovery[2]+`"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestTwoFactorEnrollTwiceConflicts(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 42, "twice")
+	enrollTwoFactor(t, router, cookie)
+
+	w := postJSON(router, "/api/2fa/enroll", `{}`, cookie)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestTwoFactorDisable(t *testing.T) {
+	router := setupRouter()
+	cookie := loginAs(t, 43, "disabler")
+	_, recovery := enrollTwoFactor(t, router, cookie)
+
+	w := httpDelete(router, "/api/2fa", `{"code":"`+recovery[0]+`"}`, cookie)
+	assert.Equal(t, http.StatusOK, w.Code)
+	enabled, _, _ := userHasTwoFactor(43)
+	assert.False(t, enabled)
+}
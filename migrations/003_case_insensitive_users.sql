@@ -0,0 +1,34 @@
+-- Make usernames and emails unique regardless of case and Unicode form
+-- ("Admin" = "admin", fullwidth "ａｄｍｉｎ" = "admin").
+-- Needs PostgreSQL 13+ (normalize) and a UTF8 database.
+
+-- 1) Report accounts that already collide. The indexes below cannot be
+--    created while any are listed; merge or rename those accounts first.
+SELECT 'username' AS column_name, lower(normalize(username, NFKC)) AS key, array_agg(id ORDER BY id) AS user_ids
+FROM users
+GROUP BY 2
+HAVING COUNT(*) > 1
+UNION ALL
+SELECT 'email', lower(normalize(email, NFKC)), array_agg(id ORDER BY id)
+FROM users
+GROUP BY 2
+HAVING COUNT(*) > 1;
+
+-- 2) Abort with a clear message instead of a bare unique violation.
+DO $$
+DECLARE
+    dupes INTEGER;
+BEGIN
+    SELECT COUNT(*) INTO dupes FROM (
+        SELECT 1 FROM users GROUP BY lower(normalize(username, NFKC)) HAVING COUNT(*) > 1
+        UNION ALL
+        SELECT 1 FROM users GROUP BY lower(normalize(email, NFKC)) HAVING COUNT(*) > 1
+    ) AS collisions;
+    IF dupes > 0 THEN
+        RAISE EXCEPTION '% case-insensitive username/email collision(s) found, see the query above', dupes;
+    END IF;
+END$$;
+
+-- 3) Enforce uniqueness on the normalized, lower-cased values.
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_ci_key ON users (lower(normalize(username, NFKC)));
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_ci_key ON users (lower(normalize(email, NFKC)));
@@ -0,0 +1,42 @@
+-- Drive full-text search languages from a registry instead of 'en'/'da'.
+-- The server keeps search_languages in sync with cmd/languages.go on start;
+-- this script is the same change for applying by hand.
+
+-- 1) Registered languages and their text search configuration.
+CREATE TABLE IF NOT EXISTS search_languages (
+    code TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    regconfig REGCONFIG NOT NULL
+);
+
+INSERT INTO search_languages (code, name, regconfig) VALUES
+    ('en', 'english', 'english'),
+    ('da', 'danish', 'danish'),
+    ('no', 'norwegian', 'norwegian'),
+    ('sv', 'swedish', 'swedish'),
+    ('de', 'german', 'german')
+ON CONFLICT (code) DO UPDATE SET name = EXCLUDED.name, regconfig = EXCLUDED.regconfig;
+
+-- 2) Any language code is allowed; unregistered ones are indexed with 'simple'.
+ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_language_check;
+ALTER TABLE pages DROP CONSTRAINT IF EXISTS pages_language_code_check;
+ALTER TABLE pages ADD CONSTRAINT pages_language_code_check CHECK (language ~ '^[a-z]{2,3}$');
+
+-- 3) Look the configuration up instead of hard-coding it.
+CREATE OR REPLACE FUNCTION pages_tsvector_update() RETURNS trigger AS $$
+DECLARE
+    cfg regconfig := COALESCE(
+        (SELECT regconfig FROM search_languages WHERE code = NEW.language),
+        'simple'::regconfig);
+BEGIN
+    NEW.tsv_document :=
+        setweight(to_tsvector(cfg, coalesce(NEW.title, '')), 'A')
+        ||
+        setweight(to_tsvector(cfg, coalesce(NEW.content, '')), 'B');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- 4) Re-index pages whose configuration changed (everything but en/da was
+--    'english' before).
+UPDATE pages SET language = language WHERE language NOT IN ('en', 'da');
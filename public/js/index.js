@@ -1,23 +1,69 @@
 document.addEventListener("DOMContentLoaded", async () => {
   const input = document.getElementById("search-input");
   const button = document.getElementById("search-button");
+  const language = document.getElementById("search-language");
 
   input?.focus();
 
   if (button && input) {
     button.addEventListener("click", () => {
-      doSearch(input.value);
+      doSearch(input.value, language?.value || null);
     });
 
     input.addEventListener("keypress", (event) => {
       if (event.key === "Enter") {
-        doSearch(input.value);
+        doSearch(input.value, language?.value || null);
       }
     });
+
+    let suggestTimer;
+    input.addEventListener("input", () => {
+      clearTimeout(suggestTimer);
+      suggestTimer = setTimeout(() => loadSuggestions(input.value, language?.value || null), 150);
+    });
   }
 });
 
-async function doSearch(query, language = null) {
+let suggestController;
+
+// loadSuggestions fills the search box's datalist; a newer keystroke
+// cancels the request of the previous one.
+async function loadSuggestions(prefix, language = null) {
+  const list = document.getElementById("search-suggestions");
+  if (!list) return;
+
+  suggestController?.abort();
+  if (prefix.trim().length < 2) {
+    list.innerHTML = "";
+    return;
+  }
+  suggestController = new AbortController();
+
+  try {
+    let url = `/api/suggest?q=${encodeURIComponent(prefix)}`;
+    if (language) {
+      url += `&language=${encodeURIComponent(language)}`;
+    }
+    const res = await fetch(url, {
+      signal: suggestController.signal,
+    });
+    if (!res.ok) return;
+    const data = await res.json();
+
+    list.innerHTML = "";
+    (data.data || []).forEach((suggestion) => {
+      const option = document.createElement("option");
+      option.value = suggestion.text;
+      list.appendChild(option);
+    });
+  } catch (err) {
+    // Aborted or offline: keep the old suggestions.
+  }
+}
+
+// doSearch shows the first page of results; with a cursor it appends the
+// next page instead.
+async function doSearch(query, language = null, cursor = null, autocorrect = true) {
   const resultsContainer = document.getElementById("results");
 
   try {
@@ -26,6 +72,12 @@ async function doSearch(query, language = null) {
     if (language) {
       url += `&language=${encodeURIComponent(language)}`;
     }
+    if (cursor) {
+      url += `&cursor=${encodeURIComponent(cursor)}`;
+    }
+    if (!autocorrect) {
+      url += "&autocorrect=false";
+    }
 
     // GET request
     const res = await fetch(url, { method: "GET" });
@@ -36,8 +88,23 @@ async function doSearch(query, language = null) {
 
     const data = await res.json();
 
-    // Clear any old results
-    resultsContainer.innerHTML = "";
+    // Clear any old results, or just the previous "more" button
+    if (cursor) {
+      resultsContainer.querySelector(".search-more")?.remove();
+    } else {
+      resultsContainer.innerHTML = "";
+      if (data.did_you_mean) {
+        resultsContainer.appendChild(
+          spellingNotice(query, data.did_you_mean, data.corrected, language)
+        );
+      }
+      if (data.total > 0) {
+        const total = document.createElement("p");
+        total.className = "search-total";
+        total.textContent = `${data.total_estimated ? "About " : ""}${data.total} results`;
+        resultsContainer.appendChild(total);
+      }
+    }
 
     // Fill results
     if (data.data && Array.isArray(data.data) && data.data.length > 0) {
@@ -75,7 +142,17 @@ async function doSearch(query, language = null) {
 
         resultsContainer.appendChild(wrapper);
       });
-    } else {
+
+      if (data.next_cursor) {
+        const more = document.createElement("button");
+        more.className = "search-more";
+        more.textContent = "More results";
+        more.addEventListener("click", () => {
+          doSearch(query, language, data.next_cursor, autocorrect);
+        });
+        resultsContainer.appendChild(more);
+      }
+    } else if (!cursor) {
       const noResults = document.createElement("p");
       noResults.textContent = "No results found.";
       resultsContainer.appendChild(noResults);
@@ -88,3 +165,32 @@ async function doSearch(query, language = null) {
     resultsContainer.appendChild(errorP);
   }
 }
+
+// spellingNotice offers the correction, or when the results already are for
+// the correction, a way back to the original query.
+function spellingNotice(query, correction, corrected, language) {
+  const notice = document.createElement("p");
+  notice.className = "search-did-you-mean";
+  const link = document.createElement("a");
+  link.href = "#";
+
+  if (corrected) {
+    notice.append(`Showing results for ${correction}. `);
+    link.textContent = `Search instead for ${query}`;
+    link.addEventListener("click", (event) => {
+      event.preventDefault();
+      doSearch(query, language, null, false);
+    });
+  } else {
+    notice.append("Did you mean ");
+    link.textContent = correction;
+    link.addEventListener("click", (event) => {
+      event.preventDefault();
+      const input = document.getElementById("search-input");
+      if (input) input.value = correction;
+      doSearch(correction, language);
+    });
+  }
+  notice.appendChild(link);
+  return notice;
+}
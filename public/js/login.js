@@ -1,3 +1,57 @@
+const verified = new URLSearchParams(window.location.search).get("verified");
+if (verified) {
+  const errorMessage = document.getElementById("errorMessage");
+  errorMessage.textContent =
+    verified === "true"
+      ? "Your email address is verified, please log in"
+      : "The verification link is invalid or has expired";
+  errorMessage.style.color = verified === "true" ? "" : "red";
+  errorMessage.style.display = "block";
+}
+
+const params = new URLSearchParams(window.location.search);
+if (params.get("oidc") === "failed") {
+  const errorMessage = document.getElementById("errorMessage");
+  errorMessage.textContent = "Single sign-on failed, please try again";
+  errorMessage.style.display = "block";
+} else if (params.get("oidc") === "exists") {
+  const errorMessage = document.getElementById("errorMessage");
+  errorMessage.textContent =
+    "An account with this email already exists. Log in with your password, then use single sign-on to link it";
+  errorMessage.style.display = "block";
+} else if (params.get("oidc") === "closed") {
+  const errorMessage = document.getElementById("errorMessage");
+  errorMessage.textContent = "There is no account for this login and registration is not open";
+  errorMessage.style.display = "block";
+}
+
+// Only offer single sign-on when the server has it configured
+fetch("/api/oidc")
+  .then((response) => response.json())
+  .then((data) => {
+    if (data.enabled) {
+      document.getElementById("oidcLogin").style.display = "";
+    }
+  })
+  .catch(() => {});
+
+let twoFactorChallenge = null; // Set when the password was accepted but a code is required
+
+// Single sign-on succeeded but the account has 2FA: only the code is missing
+if (params.get("oidc") === "2fa") {
+  twoFactorChallenge = new URLSearchParams(window.location.hash.slice(1)).get("challenge");
+  history.replaceState(null, "", "/login");
+  if (twoFactorChallenge) {
+    const form = document.getElementById("loginForm");
+    form.querySelectorAll("input[name=username], input[name=password]").forEach((input) => {
+      input.required = false;
+      input.closest("label").style.display = "none";
+    });
+    document.getElementById("twoFactorField").style.display = "";
+    form.querySelector("input[name=code]").focus();
+  }
+}
+
 document.getElementById("loginForm").addEventListener("submit", (e) => {
   e.preventDefault();
   const form = e.target;
@@ -6,26 +60,52 @@ document.getElementById("loginForm").addEventListener("submit", (e) => {
 
   let responseStatus; // Gem response status her
 
-  fetch("/api/login", {
+  const request = twoFactorChallenge
+    ? {
+        url: "/api/login/2fa",
+        body: { challenge: twoFactorChallenge, code: formData.get("code") },
+      }
+    : {
+        url: "/api/login",
+        body: {
+          username: formData.get("username"),
+          password: formData.get("password"),
+        },
+      };
+
+  fetch(request.url, {
     method: "POST",
     headers: {
       "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
     },
-    body: JSON.stringify({
-      username: formData.get("username"),
-      password: formData.get("password"),
-    }),
+    body: JSON.stringify(request.body),
   })
     .then((response) => {
       responseStatus = response.ok; // Gem response.ok
       return response.json();
     })
     .then((data) => {
-      if (responseStatus) {
+      if (responseStatus && data.challenge) {
+        // Password accepted, ask for the authenticator code
+        twoFactorChallenge = data.challenge;
+        document.getElementById("twoFactorField").style.display = "";
+        form.querySelector("input[name=code]").focus();
+        errorMessage.style.display = "none";
+      } else if (responseStatus) {
         // Brug den gemte status
         // Login successful
         window.location.href = "/";
       } else {
+        if (data.detail && data.detail[0].loc[0] === "challenge") {
+          // Challenge expired, start over with the password
+          twoFactorChallenge = null;
+          document.getElementById("twoFactorField").style.display = "none";
+          form.querySelectorAll("input[name=username], input[name=password]").forEach((input) => {
+            input.required = true;
+            input.closest("label").style.display = "";
+          });
+        }
         // Show error message
         errorMessage.textContent = data.detail[0].msg || "Login failed";
         errorMessage.style.display = "block";
@@ -1,3 +1,10 @@
+// csrfToken returns the double-submit token the server set as a cookie.
+// State-changing requests must send it in the X-CSRF-Token header.
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
 async function checkSession() {
   try {
     const res = await fetch("/api/session", { credentials: "include" });
@@ -19,7 +26,11 @@ async function checkSession() {
   // logout button click
   document.getElementById("nav-logout").addEventListener("click", async (e) => {
     e.preventDefault();
-    await fetch("/api/logout", { method: "GET", credentials: "include" });
+    await fetch("/api/logout", {
+      method: "POST",
+      credentials: "include",
+      headers: { "X-CSRF-Token": csrfToken() },
+    });
     location.reload();
   });
 }
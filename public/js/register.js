@@ -1,5 +1,20 @@
 document.addEventListener("DOMContentLoaded", () => {
   const form = document.querySelector(".register-container");
+
+  fetch("/api/register")
+    .then((response) => response.json())
+    .then((data) => {
+      if (data.mode === "invite-only") {
+        document.getElementById("inviteCode").style.display = "";
+      } else if (data.mode === "closed") {
+        const errorMessageContainer = document.getElementById("errorMessage");
+        errorMessageContainer.textContent = "Registration is closed.";
+        errorMessageContainer.style.display = "block";
+        form.querySelector("button[type=submit]").disabled = true;
+      }
+    })
+    .catch(() => {});
+
   form.addEventListener("submit", (e) => {
     e.preventDefault();
     const formData = new FormData(form);
@@ -7,17 +22,20 @@ document.addEventListener("DOMContentLoaded", () => {
     const email = formData.get("email");
     const password = formData.get("password");
     const password2 = formData.get("password2");
+    const invite_code = formData.get("invite_code");
 
     fetch("/api/register", {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
       },
       body: JSON.stringify({
         username,
         email,
         password,
         password2,
+        invite_code,
       }),
     })
       .then((response) => {
@@ -25,13 +43,22 @@ document.addEventListener("DOMContentLoaded", () => {
           return response.json();
         } else {
           return response.json().then((data) => {
-            throw new Error(data.detail[0].msg || "Registration failed");
+            // The password policy can report several problems at once
+            throw new Error(data.detail.map((d) => d.msg).join(". ") || "Registration failed");
           });
         }
       })
       .then((data) => {
-        // Registration successful, redirect to home page, user is logged in
-        window.location.href = "/";
+        if (data.message === "user registered successfully") {
+          // Registration successful, redirect to home page, user is logged in
+          window.location.href = "/";
+          return;
+        }
+        // Email verification required before the first login
+        const errorMessageContainer = document.getElementById("errorMessage");
+        errorMessageContainer.textContent = data.message;
+        errorMessageContainer.style.color = "";
+        errorMessageContainer.style.display = "block";
       })
       .catch((error) => {
         const errorMessageContainer = document.getElementById("errorMessage");
@@ -0,0 +1,60 @@
+document.addEventListener("DOMContentLoaded", () => {
+  const token = new URLSearchParams(window.location.search).get("token");
+  const forgotForm = document.getElementById("forgotForm");
+  const resetForm = document.getElementById("resetForm");
+  const message = document.getElementById("resetMessage");
+
+  function showMessage(text, isError) {
+    message.textContent = text;
+    message.style.color = isError ? "red" : "";
+    message.style.display = "block";
+  }
+
+  async function post(url, body) {
+    const res = await fetch(url, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
+      },
+      body: JSON.stringify(body),
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error((data.detail && data.detail.map((d) => d.msg).join(". ")) || data.message || "Request failed");
+    }
+    return data;
+  }
+
+  if (!token) {
+    forgotForm.style.display = "";
+    forgotForm.addEventListener("submit", async (e) => {
+      e.preventDefault();
+      try {
+        const data = await post("/api/password/forgot", {
+          email: new FormData(forgotForm).get("email"),
+        });
+        showMessage(data.message, false);
+      } catch (err) {
+        showMessage(err.message, true);
+      }
+    });
+    return;
+  }
+
+  resetForm.style.display = "";
+  resetForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const formData = new FormData(resetForm);
+    try {
+      await post("/api/password/reset", {
+        token,
+        password: formData.get("password"),
+        password2: formData.get("password2"),
+      });
+      window.location.href = "/login";
+    } catch (err) {
+      showMessage(err.message, true);
+    }
+  });
+});
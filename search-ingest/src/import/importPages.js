@@ -4,7 +4,12 @@ import path from "node:path";
 import { fileURLToPath } from "node:url";
 import { Pool } from "pg";
 
-// Imports pages from a JSON file or STDIN into the database
+// Imports pages from a JSON file or STDIN into the database.
+//
+// With --detect-url (or LANGUAGE_DETECT_URL) pointing at the app, e.g.
+// http://localhost:8080, every page is labelled by the app's language
+// identifier, the one search uses. Its label wins when it is reliable;
+// otherwise the page keeps its own language, or "en".
 
 const __filename = fileURLToPath(import.meta.url);
 const __dirname = path.dirname(__filename);
@@ -17,8 +22,37 @@ function getArg(flag, fallback = null) {
     return fallback;
 }
 
+// The identifier only reads the start of a text.
+const DETECT_TEXT_LIMIT = 10000;
+
+async function detectLanguage(detectUrl, page) {
+    const text = `${page.title || ""}\n${page.content || ""}`.slice(0, DETECT_TEXT_LIMIT);
+    let res;
+    for (;;) {
+        res = await fetch(new URL("/api/languages/detect", detectUrl), {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ text }),
+        });
+        if (res.status !== 429) {
+            break;
+        }
+        // Rate limited per client: wait for the window to move on.
+        await new Promise((resolve) => setTimeout(resolve, 5000));
+    }
+    if (res.status === 422) {
+        return null; // nothing to go on, e.g. no letters
+    }
+    if (!res.ok) {
+        throw new Error(`Language detection failed for ${page.url}: HTTP ${res.status}`);
+    }
+    const result = await res.json();
+    return result.reliable ? result.language : null;
+}
+
 async function main() {
     const databaseUrl = getArg("--database-url", process.env.DATABASE_URL);
+    const detectUrl = getArg("--detect-url", process.env.LANGUAGE_DETECT_URL);
     const fileArg = getArg("--file");
     const filePath = fileArg
         ? path.resolve(fileArg)
@@ -56,7 +90,16 @@ async function main() {
     try {
         await client.query("BEGIN");
 
+        let relabelled = 0;
         for (const page of pages) {
+            let language = page.language || "en";
+            if (detectUrl) {
+                const detected = await detectLanguage(detectUrl, page);
+                if (detected && detected !== language) {
+                    language = detected;
+                    relabelled++;
+                }
+            }
             await client.query(
                 `
         INSERT INTO pages (title, url, language, last_updated, content)
@@ -70,7 +113,7 @@ async function main() {
                 [
                     page.title,
                     page.url,
-                    page.language || "en",
+                    language,
                     page.last_updated || new Date().toISOString(),
                     page.content,
                 ]
@@ -79,6 +122,9 @@ async function main() {
 
         await client.query("COMMIT");
         console.log(`Imported ${pages.length} pages`);
+        if (detectUrl) {
+            console.log(`Language detection relabelled ${relabelled} pages`);
+        }
     } catch (err) {
         await client.query("ROLLBACK");
         throw err;
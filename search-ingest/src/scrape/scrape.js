@@ -7,7 +7,9 @@ export async function scrape(url) {
     const { title, content } = extractContent(html, url);
 
     const detected = detect.detectOne(content);
-    const language = detected === "da" ? "da" : "en";
+    // The server indexes any two- or three-letter code; languages it has no
+    // stemmer for are searched without one.
+    const language = /^[a-z]{2,3}$/.test(detected ?? "") ? detected : "en";
 
     return { title, url, content, language };
 }
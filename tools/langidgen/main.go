@@ -0,0 +1,299 @@
+// Command langidgen trains the language identification profiles that the
+// server embeds (cmd/data/langid/profiles.json) and writes held-out text to
+// test them on (cmd/testdata/langid/<code>.txt).
+//
+// The corpus is the gettext translations installed with the operating system
+// (/usr/share/locale/<locale>/LC_MESSAGES/*.mo): real, human-translated text
+// about software in every language we detect, with the English originals as
+// the English corpus. Each message is assigned to training or held-out text
+// by a hash of its original, so a message and its translations never end up
+// on both sides.
+//
+// The search engine's own data adds what software messages lack, names and
+// everyday words: the indexed pages, labelled with their language, and the
+// log of past queries, which are English. Held-out queries go to
+// cmd/testdata/langid/queries-<code>.txt.
+//
+// Run it from the cmd directory with go generate; the output is committed.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"WHOKNOWS_VARIATIONS/util"
+)
+
+// locales maps the language codes the server detects to the gettext locales
+// whose translations are in that language. English is the originals.
+var locales = map[string][]string{
+	"da": {"da"},
+	"de": {"de"},
+	"no": {"nb", "no"},
+	"sv": {"sv"},
+}
+
+// markup is everything in a message that is not prose: printf and Python
+// format directives, placeholders, tags and command line options.
+var markup = regexp.MustCompile(`%(\d+\$)?[-#+ 0-9.*'lhqjztL]*[a-zA-Z%]|%\([^)]*\)[a-z]|\{[^}]*\}|<[^>]*>|\$\{?\w+\}?|(^|\s)--?[A-Za-z][\w-]*`)
+
+func main() {
+	root := flag.String("locales", "/usr/share/locale", "directory with <locale>/LC_MESSAGES/*.mo")
+	out := flag.String("out", "data/langid/profiles.json", "profiles to write")
+	heldOutDir := flag.String("heldout", "testdata/langid", "directory for the held-out texts")
+	keep := flag.Int("keep", 10000, "most frequent n-grams kept per language")
+	heldOutShare := flag.Uint("heldout-share", 10, "one in this many messages is held out")
+	heldOutLines := flag.Int("heldout-lines", 300, "held-out texts written per language")
+	pagesPath := flag.String("pages", "../search-ingest/pages.json", "indexed pages, a JSON array with title, content and language")
+	queriesPath := flag.String("queries", "../search-ingest/queries.txt", "past search queries, one per line")
+	queriesLanguage := flag.String("queries-language", "en", "language of the past search queries")
+	flag.Parse()
+
+	train := map[string][]string{}
+	heldOut := map[string][]string{}
+	seen := map[string]map[string]bool{}
+	add := func(code, original, text string) {
+		text = clean(text)
+		if seen[code] == nil {
+			seen[code] = map[string]bool{}
+		}
+		if len(util.TextGrams(text)) == 0 || seen[code][text] {
+			return
+		}
+		seen[code][text] = true
+		if hash(original)%uint32(*heldOutShare) == 0 {
+			heldOut[code] = append(heldOut[code], text)
+		} else {
+			train[code] = append(train[code], text)
+		}
+	}
+
+	codes := make([]string, 0, len(locales))
+	for code := range locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		for _, locale := range locales[code] {
+			files, _ := filepath.Glob(filepath.Join(*root, locale, "LC_MESSAGES", "*.mo"))
+			for _, path := range files {
+				// Country, language and currency names are proper nouns.
+				if strings.HasPrefix(filepath.Base(path), "iso_") {
+					continue
+				}
+				messages, err := readCatalog(path)
+				if err != nil {
+					log.Printf("skipping %s: %v", path, err)
+					continue
+				}
+				for _, m := range messages {
+					add(code, m.original, m.translation)
+					add("en", m.original, m.original)
+				}
+			}
+		}
+	}
+
+	pages, err := readPages(*pagesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range pages {
+		add(p.Language, p.URL, p.Title+"\n"+p.Content)
+	}
+
+	// Queries are short, so half of them are held out to test short texts on.
+	var heldOutQueries []string
+	queries, err := os.ReadFile(*queriesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, q := range strings.Split(string(queries), "\n") {
+		q = clean(q)
+		if len(util.TextGrams(q)) == 0 {
+			continue
+		}
+		if hash(q)%2 == 0 {
+			heldOutQueries = append(heldOutQueries, q)
+		} else {
+			train[*queriesLanguage] = append(train[*queriesLanguage], q)
+		}
+	}
+
+	profiles := map[string]util.LangidProfile{}
+	for code, texts := range train {
+		profiles[code] = profile(texts, *keep)
+		log.Printf("%s: %d messages (%d n-grams) for training, %d held out", code, len(texts), profiles[code].Total, len(heldOut[code]))
+	}
+	raw, err := json.MarshalIndent(profiles, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, append(raw, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(*heldOutDir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	for code, texts := range heldOut {
+		writeLines(filepath.Join(*heldOutDir, code+".txt"), sentences(texts, *heldOutLines))
+	}
+	writeLines(filepath.Join(*heldOutDir, "queries-"+*queriesLanguage+".txt"), heldOutQueries)
+}
+
+func writeLines(path string, lines []string) {
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+type page struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Language string `json:"language"`
+	Content  string `json:"content"`
+}
+
+func readPages(path string) ([]page, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pages []page
+	return pages, json.Unmarshal(raw, &pages)
+}
+
+// clean drops markup and folds a message onto one line.
+func clean(s string) string {
+	s = markup.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// profile counts the n-grams of texts and keeps the keep most frequent.
+func profile(texts []string, keep int) util.LangidProfile {
+	counts := map[string]int{}
+	total := 0
+	for _, t := range texts {
+		for _, g := range util.TextGrams(t) {
+			counts[g]++
+			total++
+		}
+	}
+	grams := make([]string, 0, len(counts))
+	for g := range counts {
+		grams = append(grams, g)
+	}
+	sort.Slice(grams, func(i, j int) bool {
+		if counts[grams[i]] != counts[grams[j]] {
+			return counts[grams[i]] > counts[grams[j]]
+		}
+		return grams[i] < grams[j]
+	})
+	kept := map[string]int{}
+	for _, g := range grams[:min(keep, len(grams))] {
+		kept[g] = counts[g]
+	}
+	return util.LangidProfile{Total: total, Grams: kept}
+}
+
+// sentences picks up to n held-out texts of four to 25 words, the length of
+// a sentence or two, in a fixed order that does not favour any one catalog.
+func sentences(texts []string, n int) []string {
+	var picked []string
+	for _, t := range texts {
+		if words := len(strings.Fields(t)); words >= 4 && words <= 25 {
+			picked = append(picked, t)
+		}
+	}
+	sort.Slice(picked, func(i, j int) bool { return hash(picked[i]) < hash(picked[j]) })
+	return picked[:min(n, len(picked))]
+}
+
+type message struct {
+	original    string
+	translation string
+}
+
+// readCatalog reads the translated messages of a GNU .mo file. Catalogs that
+// are not UTF-8 are skipped; untranslated messages and copies of the
+// original are left out.
+func readCatalog(path string) ([]message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 20 {
+		return nil, errors.New("not a .mo file")
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(data) {
+	case 0x950412de:
+		order = binary.LittleEndian
+	case 0xde120495:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a .mo file")
+	}
+	str := func(table, i uint32) (string, error) {
+		at := table + 8*i
+		if int(at)+8 > len(data) {
+			return "", errors.New("truncated")
+		}
+		length, offset := order.Uint32(data[at:]), order.Uint32(data[at+4:])
+		if int(offset)+int(length) > len(data) {
+			return "", errors.New("truncated")
+		}
+		return string(data[offset : offset+length]), nil
+	}
+
+	n, originals, translations := order.Uint32(data[8:]), order.Uint32(data[12:]), order.Uint32(data[16:])
+	var messages []message
+	for i := uint32(0); i < n; i++ {
+		original, err := str(originals, i)
+		if err != nil {
+			return nil, err
+		}
+		translation, err := str(translations, i)
+		if err != nil {
+			return nil, err
+		}
+		if original == "" {
+			if !bytes.Contains(bytes.ToLower([]byte(translation)), []byte("charset=utf-8")) {
+				return nil, errors.New("not UTF-8")
+			}
+			continue
+		}
+		// Strip the message context and keep the singular form.
+		if _, rest, ok := strings.Cut(original, "\x04"); ok {
+			original = rest
+		}
+		original, _, _ = strings.Cut(original, "\x00")
+		translation, _, _ = strings.Cut(translation, "\x00")
+		if translation == "" || translation == original || !utf8.ValidString(translation) {
+			continue
+		}
+		messages = append(messages, message{original: original, translation: translation})
+	}
+	return messages, nil
+}
@@ -1,16 +1,26 @@
 package util
 
 import (
-	"fmt"
+	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetAuthCookie(c *gin.Context, userID int) {
+// AuthCookieName is the cookie holding the signed session token.
+const AuthCookieName = "session"
+
+// CSRFCookieName is the double-submit CSRF cookie. It is readable by our own
+// scripts, which echo it in the X-CSRF-Token header.
+const CSRFCookieName = "csrf_token"
+
+func SetAuthCookie(c *gin.Context, token string, maxAge int) {
+    // Lax keeps the session on top-level navigations from other sites
+    // (links, the OIDC redirect) but not on cross-site POSTs.
+    c.SetSameSite(http.SameSiteLaxMode)
     c.SetCookie(
-        "user_id",
-        fmt.Sprintf("%d", userID),
-        0, // maxAge in seconds; 0 means session cookie
+        AuthCookieName,
+        token,
+        maxAge, // maxAge in seconds; 0 means session cookie
         "/",
         "",
         false,  // secure //NOSONAR
@@ -19,8 +29,9 @@ func SetAuthCookie(c *gin.Context, userID int) {
 }
 
 func RemoveAuthCookie(c *gin.Context) {
+    c.SetSameSite(http.SameSiteLaxMode)
     c.SetCookie(
-        "user_id",
+        AuthCookieName,
         "",
         -1, // maxAge in seconds; -1 means delete cookie
         "/",
@@ -29,3 +40,16 @@ func RemoveAuthCookie(c *gin.Context) {
         true,  // httpOnly
     )
 }
+
+func SetCSRFCookie(c *gin.Context, token string) {
+    c.SetSameSite(http.SameSiteStrictMode)
+    c.SetCookie(
+        CSRFCookieName,
+        token,
+        0, // session cookie
+        "/",
+        "",
+        false,  // secure //NOSONAR
+        false,  // httpOnly: the frontend has to read it
+    )
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Character n-grams for language identification, shared by the server and
+// the tools/langidgen program that trains the profiles it ships with.
+const (
+	LangidMaxGrams = 4
+	LangidMaxText  = 10000 // runes looked at; the start of a page is enough
+)
+
+// LangidProfile is the trained profile of one language: how often each kept
+// n-gram occurred, and how many n-grams the training text had in total.
+type LangidProfile struct {
+	Total int            `json:"total"`
+	Grams map[string]int `json:"grams"`
+}
+
+// TextGrams splits text into words of letters and returns their 1- to
+// LangidMaxGrams-grams, lower-cased and padded with a space at both ends so
+// word beginnings and endings count.
+func TextGrams(text string) []string {
+	runes := []rune(text)
+	if len(runes) > LangidMaxText {
+		runes = runes[:LangidMaxText]
+	}
+	words := strings.FieldsFunc(strings.ToLower(string(runes)), func(r rune) bool { return !unicode.IsLetter(r) })
+
+	var grams []string
+	for _, w := range words {
+		padded := []rune(" " + w + " ")
+		for n := 1; n <= LangidMaxGrams; n++ {
+			for i := 0; i+n <= len(padded); i++ {
+				g := string(padded[i : i+n])
+				if g != " " {
+					grams = append(grams, g)
+				}
+			}
+		}
+	}
+	return grams
+}